@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/zalhui/calc_golang/internal/mtls"
+)
+
+// devCA создаёт в -dir локальный CA, сертификат оркестратора и сертификаты
+// агентов из -agents. Если CA в -dir уже есть, новые сертификаты подписываются им,
+// так можно добавить агента, не перевыпуская остальные.
+func devCA(args []string) {
+	flags := flag.NewFlagSet("dev-ca", flag.ExitOnError)
+	dir := flags.String("dir", "certs", "каталог для сертификатов")
+	agents := flags.String("agents", "agent-1", "id агентов через запятую, CN их сертификатов")
+	hosts := flags.String("hosts", "localhost,127.0.0.1", "имена и адреса оркестратора через запятую")
+	ttl := flags.Duration("ttl", 365*24*time.Hour, "срок действия сертификатов")
+	flags.Parse(args)
+
+	if err := os.MkdirAll(*dir, 0o755); err != nil {
+		log.Fatalf("Failed to create %s: %v", *dir, err)
+	}
+
+	ca, err := loadOrCreateCA(*dir, *ttl)
+	if err != nil {
+		log.Fatalf("Failed to prepare CA: %v", err)
+	}
+
+	certPEM, keyPEM, err := ca.IssueServer("orchestrator", splitList(*hosts), *ttl)
+	if err != nil {
+		log.Fatalf("Failed to issue orchestrator certificate: %v", err)
+	}
+	writePair(*dir, "orchestrator", certPEM, keyPEM)
+
+	for _, id := range splitList(*agents) {
+		certPEM, keyPEM, err := ca.IssueAgent(id, *ttl)
+		if err != nil {
+			log.Fatalf("Failed to issue certificate for agent %s: %v", id, err)
+		}
+		writePair(*dir, id, certPEM, keyPEM)
+	}
+}
+
+func loadOrCreateCA(dir string, ttl time.Duration) (*mtls.Authority, error) {
+	certPEM, err := os.ReadFile(filepath.Join(dir, "ca.pem"))
+	if err == nil {
+		keyPEM, err := os.ReadFile(filepath.Join(dir, "ca-key.pem"))
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Using existing CA from %s", dir)
+		return mtls.LoadAuthority(certPEM, keyPEM)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	ca, err := mtls.NewAuthority("calc dev CA", ttl)
+	if err != nil {
+		return nil, err
+	}
+	writePair(dir, "ca", ca.CertPEM, ca.KeyPEM)
+	return ca, nil
+}
+
+// writePair пишет <name>.pem и <name>-key.pem, ключ доступен только владельцу
+func writePair(dir, name string, certPEM, keyPEM []byte) {
+	certFile := filepath.Join(dir, name+".pem")
+	if err := os.WriteFile(certFile, certPEM, 0o644); err != nil {
+		log.Fatalf("Failed to write %s: %v", certFile, err)
+	}
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		log.Fatalf("Failed to write %s: %v", keyFile, err)
+	}
+	log.Printf("Wrote %s and %s", certFile, keyFile)
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
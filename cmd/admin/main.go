@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/google/uuid"
+	"github.com/zalhui/calc_golang/config"
+	"github.com/zalhui/calc_golang/internal/auth"
+)
+
+const usage = `Usage: admin <command> [flags]
+
+Commands:
+  agent-token  выдать агенту токен для /internal
+  dev-ca       создать локальный CA и сертификаты для режима mTLS
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "agent-token":
+		agentToken(os.Args[2:])
+	case "dev-ca":
+		devCA(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+// agentToken печатает токен агента, подписанный JWT_SECRET оркестратора.
+// Агент передаёт его в AGENT_TOKEN.
+func agentToken(args []string) {
+	flags := flag.NewFlagSet("agent-token", flag.ExitOnError)
+	id := flags.String("id", "", "id агента, по умолчанию случайный")
+	ttl := flags.Duration("ttl", 0, "срок действия токена, 0 - бессрочный")
+	flags.Parse(args)
+
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("Invalid config:\n%v", err)
+	}
+	if cfg.JWTSecret == "" {
+		log.Fatal("JWT_SECRET is not set, agent tokens must be signed with the orchestrator's secret")
+	}
+	auth.SetSecret(cfg.JWTSecret)
+
+	if *id == "" {
+		*id = uuid.New().String()
+	}
+	token, err := auth.GenerateAgentToken(*id, *ttl)
+	if err != nil {
+		log.Fatalf("Failed to issue agent token: %v", err)
+	}
+	fmt.Println(token)
+}
@@ -1,23 +1,54 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/zalhui/calc_golang/config"
 	"github.com/zalhui/calc_golang/internal/agent/worker"
 )
 
 func main() {
-	cfg := config.LoadConfig()
-
-	for i := 0; i < cfg.ComputingPower; i++ {
-		go worker.StartWorker()
+	printConfig := config.ParseFlags("agent", os.Args[1:], config.AgentFlags)
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("Invalid config:\n%v", err)
+	}
+	if printConfig {
+		cfg.Print(os.Stdout)
+		return
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid config:\n%v", err)
+	}
+	if cfg.AgentToken == "" && !cfg.MTLSEnabled() {
+		log.Fatal("AGENT_TOKEN is not set, issue a token with: go run ./cmd/admin agent-token -id <agent-id>" +
+			" or use mTLS with certificates from: go run ./cmd/admin dev-ca")
 	}
 
-	log.Printf("Agent started with %d workers\n", cfg.ComputingPower)
-	select {}
+	// по SIGINT и SIGTERM агент перестаёт брать задачи и досчитывает начатые,
+	// повторный сигнал завершает его сразу
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	context.AfterFunc(ctx, stop)
 
-	//defer log.Println("Shutting down agent...")
-	//defer log.Println("Agent stopped")
-	//cancel()
+	// heartbeat и перезагрузка настроек нужны, пока агент досчитывает задачи
+	running, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	worker.Setup(cfg)
+	// время операций, паузы и ожидание задач меняются без перезапуска
+	store := config.NewStore(cfg)
+	store.Subscribe(worker.ApplyConfig)
+	go store.Watch(running)
+
+	// оркестратор узнаёт об агенте и следит, что он жив
+	go worker.StartHeartbeat(running)
+
+	log.Printf("Agent started with %d workers\n", cfg.ComputingPower)
+	worker.StartWorker(ctx)
+	log.Println("Agent stopped")
 }
@@ -2,66 +2,111 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
-	"github.com/gorilla/mux"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/zalhui/calc_golang/config"
+	"github.com/zalhui/calc_golang/internal/auth"
 	"github.com/zalhui/calc_golang/internal/db"
 	"github.com/zalhui/calc_golang/internal/middleware"
+	"github.com/zalhui/calc_golang/internal/mtls"
 	"github.com/zalhui/calc_golang/internal/orchestrator/application"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 func main() {
+	// Настройки: флаги, переменные окружения и файл конфигурации
+	printConfig := config.ParseFlags("orchestrator", os.Args[1:], config.OrchestratorFlags)
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("Invalid config:\n%v", err)
+	}
+	if printConfig {
+		cfg.Print(os.Stdout)
+		return
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid config:\n%v", err)
+	}
+	// пустым ключом токен пользователя или агента подпишет кто угодно
+	if cfg.JWTSecret == "" {
+		log.Fatal("JWT_SECRET is not set, user and agent tokens cannot be signed securely")
+	}
+	auth.SetSecret(cfg.JWTSecret)
+	// время операций и политики повторов меняются без перезапуска
+	store := config.NewStore(cfg)
+
 	// Инициализация базы данных
-	database, err := db.NewDB("calc.db")
+	database, err := db.NewDB(cfg.DBPath)
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 	defer database.Close()
 
 	// Создание экземпляра приложения
-	app := application.New(database)
-
-	// Настройка маршрутизатора
-	router := mux.NewRouter()
-
-	// Публичные эндпоинты
-	publicRouter := router.PathPrefix("/api/v1").Subrouter()
-	publicRouter.HandleFunc("/register", app.RegisterHandler).Methods("POST")
-	publicRouter.HandleFunc("/login", app.LoginHandler).Methods("POST")
-
-	// Защищенные эндпоинты
-	protectedRouter := router.PathPrefix("/api/v1").Subrouter()
-	protectedRouter.Use(middleware.JWTAuthMiddleware)
-
-	protectedRouter.HandleFunc("/calculate", app.AddExpressionHandler).Methods("POST")
-	protectedRouter.HandleFunc("/expressions", app.GetAllExpressionsHandler).Methods("GET")
-	protectedRouter.HandleFunc("/expressions/{id}", app.GetExpressionByIDHandler).Methods("GET")
-	protectedRouter.HandleFunc("/history", app.GetUserHistoryHandler).Methods("GET")
-
-	// Внутренние эндпоинты для агентов
-	internalRouter := router.PathPrefix("/internal").Subrouter()
-	internalRouter.HandleFunc("/task", app.GetPendingTaskHandler).Methods("GET")
-	internalRouter.HandleFunc("/task/result", app.SubmitTaskResultHandler).Methods("POST", "GET")
+	app := application.New(database, cfg)
+	store.Subscribe(app.ApplyConfig)
+
+	// Настройка маршрутизатора. В режиме mTLS /internal не на :8080,
+	// а на отдельном listener'е, куда пускают только агентов с сертификатом.
+	router, internalRoot := application.NewRouter(app, cfg)
+	var tlsConfig *tls.Config
+	if cfg.MTLSEnabled() {
+		tlsConfig, err = mtls.ServerConfig(cfg.TLSCAFile, cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to load TLS config: %v", err)
+		}
+	}
 
 	// Настройка HTTP сервера
 	server := &http.Server{
-		Addr:         ":8080",
+		Addr:         cfg.ListenAddr,
 		Handler:      router,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		ReadTimeout:  cfg.HTTPReadTimeout,
+		WriteTimeout: cfg.HTTPWriteTimeout,
+		IdleTimeout:  cfg.HTTPIdleTimeout,
 	}
 
+	var internalServer *http.Server
+	if tlsConfig != nil {
+		internalServer = &http.Server{
+			Addr:         cfg.InternalTLSAddr,
+			Handler:      internalRoot,
+			TLSConfig:    tlsConfig,
+			ReadTimeout:  cfg.HTTPReadTimeout,
+			WriteTimeout: cfg.HTTPWriteTimeout,
+			IdleTimeout:  cfg.HTTPIdleTimeout,
+		}
+	}
+
+	// gRPC-сервер для агентов, то же, что /internal
+	grpcOptions := []grpc.ServerOption{
+		grpc.UnaryInterceptor(middleware.AgentAuthUnaryInterceptor),
+		grpc.StreamInterceptor(middleware.AgentAuthStreamInterceptor),
+	}
+	if tlsConfig != nil {
+		grpcOptions = append(grpcOptions, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	grpcServer := grpc.NewServer(grpcOptions...)
+	app.RegisterAgentServer(grpcServer)
+
 	// Graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// задачи упавших агентов возвращаются в очередь
+	go app.StartLeaseReaper(ctx)
+	// настройки перечитываются по SIGHUP и при изменении файлов
+	go store.Watch(ctx)
+
 	go func() {
 		sigChan := make(chan os.Signal, 1)
 		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -74,10 +119,36 @@ func main() {
 		if err := server.Shutdown(shutdownCtx); err != nil {
 			log.Printf("Server shutdown error: %v", err)
 		}
+		if internalServer != nil {
+			if err := internalServer.Shutdown(shutdownCtx); err != nil {
+				log.Printf("Internal server shutdown error: %v", err)
+			}
+		}
+		grpcServer.GracefulStop()
+	}()
+
+	grpcListener, err := net.Listen("tcp", cfg.GRPCListenAddr)
+	if err != nil {
+		log.Fatalf("Failed to listen for gRPC: %v", err)
+	}
+	go func() {
+		log.Printf("Starting gRPC agent server on %s", cfg.GRPCListenAddr)
+		if err := grpcServer.Serve(grpcListener); err != nil {
+			log.Fatalf("gRPC server failed: %v", err)
+		}
 	}()
 
+	if internalServer != nil {
+		go func() {
+			log.Printf("Starting mTLS agent server on %s", cfg.InternalTLSAddr)
+			if err := internalServer.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("mTLS server failed: %v", err)
+			}
+		}()
+	}
+
 	// Запуск сервера
-	log.Println("Starting orchestrator on :8080")
+	log.Printf("Starting orchestrator on %s", cfg.ListenAddr)
 	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Server failed: %v", err)
 	}
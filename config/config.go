@@ -1,59 +1,192 @@
 package config
 
 import (
-	"log"
-	"os"
+	"errors"
 	"strconv"
+	"strings"
 	"time"
-
-	"github.com/joho/godotenv"
 )
 
+// Config - настройки процесса. После Load они не меняются: перезагрузка
+// создаёт новый Config (см. Store). Поля с тегом reload применяются без перезапуска.
 type Config struct {
-	TimeAddition       time.Duration
-	TimeSubtraction    time.Duration
-	TimeMultiplication time.Duration
-	TimeDivision       time.Duration
-	ComputingPower     int
-	JWTSecret          string
+	TimeAddition         time.Duration `env:"TIME_ADDITION_MS" reload:"true"`
+	TimeSubtraction      time.Duration `env:"TIME_SUBTRACTION_MS" reload:"true"`
+	TimeMultiplication   time.Duration `env:"TIME_MULTIPLICATIONS_MS" reload:"true"`
+	TimeDivision         time.Duration `env:"TIME_DIVISIONS_MS" reload:"true"`
+	TimeExponentiation   time.Duration `env:"TIME_EXPONENTIATION_MS" reload:"true"`
+	TimeModulo           time.Duration `env:"TIME_MODULO_MS" reload:"true"`
+	TimeIntegerDivision  time.Duration `env:"TIME_INTEGER_DIVISION_MS" reload:"true"`
+	TimeFunction         time.Duration `env:"TIME_FUNCTION_MS" reload:"true"`
+	ComputingPower       int           `env:"COMPUTING_POWER"`
+	JWTSecret            string        `env:"JWT_SECRET" secret:"true"`
+	TaskLease            time.Duration `env:"TASK_LEASE_MS"`                       // сколько задача числится за агентом без продления
+	LeaseReapInterval    time.Duration `env:"LEASE_REAP_INTERVAL_MS"`              // как часто оркестратор возвращает в очередь задачи с истёкшей арендой
+	RetryMaxAttempts     int           `env:"RETRY_MAX_ATTEMPTS" reload:"true"`    // сколько раз запускать задачу после временных ошибок
+	RetryBaseDelay       time.Duration `env:"RETRY_BASE_DELAY_MS" reload:"true"`   // пауза перед повтором, удваивается с каждой попыткой
+	RetryMaxDelay        time.Duration `env:"RETRY_MAX_DELAY_MS" reload:"true"`    // пауза перед повтором не бывает больше
+	ErrorMaxAttempts     int           `env:"ERROR_MAX_ATTEMPTS" reload:"true"`    // сколько раз запускать задачу с ошибкой вроде деления на ноль
+	AdminToken           string        `env:"ADMIN_TOKEN" secret:"true"`           // токен для /admin, пустой - админские эндпоинты выключены
+	AgentTransport       string        `env:"AGENT_TRANSPORT"`                     // poll - запросы к /internal/task, websocket - постоянное соединение, grpc и grpc-stream - gRPC
+	TaskWait             time.Duration `env:"TASK_WAIT_MS" reload:"true"`          // сколько агент ждёт задачу в одном запросе /internal/task
+	HeartbeatInterval    time.Duration `env:"HEARTBEAT_INTERVAL_MS" reload:"true"` // как часто агент сообщает оркестратору, что жив
+	AgentTimeout         time.Duration `env:"AGENT_TIMEOUT_MS"`                    // агент без heartbeat дольше этого считается потерянным, его задачи возвращаются в очередь
+	AgentOperations      []string      `env:"AGENT_OPERATIONS"`                    // операции, которые агент берёт, пустой - все, что он умеет
+	AgentModes           []string      `env:"AGENT_MODES"`                         // числовые режимы, которые агент берёт, пустой - все
+	MaxOperandSize       int           `env:"MAX_OPERAND_SIZE"`                    // наибольшая длина операнда в символах, 0 - без ограничений
+	AgentToken           string        `env:"AGENT_TOKEN" secret:"true"`           // токен агента для /internal, выдаётся командой admin agent-token
+	TLSCAFile            string        `env:"TLS_CA_FILE"`                         // CA, которым подписаны сертификаты оркестратора и агентов
+	TLSCertFile          string        `env:"TLS_CERT_FILE"`                       // свой сертификат оркестратора или агента
+	TLSKeyFile           string        `env:"TLS_KEY_FILE"`                        // ключ к TLSCertFile
+	InternalTLSAddr      string        `env:"INTERNAL_TLS_ADDR"`                   // адрес, где оркестратор в режиме mTLS слушает /internal
+	ListenAddr           string        `env:"LISTEN_ADDR"`                         // адрес HTTP API оркестратора
+	GRPCListenAddr       string        `env:"GRPC_LISTEN_ADDR"`                    // адрес gRPC-сервиса оркестратора для агентов
+	DBPath               string        `env:"DB_PATH"`                             // файл базы SQLite
+	HTTPReadTimeout      time.Duration `env:"HTTP_READ_TIMEOUT_MS"`                // таймауты HTTP-серверов оркестратора
+	HTTPWriteTimeout     time.Duration `env:"HTTP_WRITE_TIMEOUT_MS"`
+	HTTPIdleTimeout      time.Duration `env:"HTTP_IDLE_TIMEOUT_MS"`
+	OrchestratorURL      string        `env:"ORCHESTRATOR_URL"`                  // где агент находит /internal, по умолчанию оркестратор на этой же машине
+	OrchestratorGRPCAddr string        `env:"ORCHESTRATOR_GRPC_ADDR"`            // где агент находит gRPC-сервис оркестратора
+	PollInterval         time.Duration `env:"POLL_INTERVAL_MS" reload:"true"`    // пауза агента, когда задач нет или оркестратор недоступен
+	HTTPClientTimeout    time.Duration `env:"HTTP_CLIENT_TIMEOUT_MS"`            // таймаут запроса агента к оркестратору, 0 - без ограничений
+	ShutdownTimeout      time.Duration `env:"SHUTDOWN_TIMEOUT_MS" reload:"true"` // сколько агент после сигнала остановки досчитывает начатые задачи
 }
 
-func LoadConfig() *Config {
+// MTLSEnabled - заданы CA, сертификат и ключ: оркестратор и агенты
+// узнают друг друга по сертификатам, а не по токенам
+func (c *Config) MTLSEnabled() bool {
+	return c.TLSCAFile != "" && c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
 
-	err := godotenv.Load()
+// Load читает настройки один раз при запуске: флаги командной строки важнее
+// переменных окружения, они - .env, а .env - файла конфигурации (см. ParseFlags).
+// .env необязателен. Значения, которые не разбираются, не заменяются молча
+// значениями по умолчанию: Load возвращает их все как *FieldError.
+func Load() (*Config, error) {
+	src, err := readSources()
 	if err != nil {
-		log.Fatalf("Error loading .env file: %v", err)
+		return nil, err
+	}
+	l := &loader{src: src}
+	cfg := &Config{
+		TimeAddition:         l.duration("TIME_ADDITION_MS", time.Second),
+		TimeSubtraction:      l.duration("TIME_SUBTRACTION_MS", time.Second),
+		TimeMultiplication:   l.duration("TIME_MULTIPLICATIONS_MS", time.Second),
+		TimeDivision:         l.duration("TIME_DIVISIONS_MS", time.Second),
+		TimeExponentiation:   l.duration("TIME_EXPONENTIATION_MS", time.Second),
+		TimeModulo:           l.duration("TIME_MODULO_MS", time.Second),
+		TimeIntegerDivision:  l.duration("TIME_INTEGER_DIVISION_MS", time.Second),
+		TimeFunction:         l.duration("TIME_FUNCTION_MS", time.Second),
+		ComputingPower:       l.int("COMPUTING_POWER", 1),
+		JWTSecret:            l.get("JWT_SECRET"),
+		TaskLease:            l.duration("TASK_LEASE_MS", 30*time.Second),
+		LeaseReapInterval:    l.duration("LEASE_REAP_INTERVAL_MS", 5*time.Second),
+		RetryMaxAttempts:     l.int("RETRY_MAX_ATTEMPTS", 5),
+		RetryBaseDelay:       l.duration("RETRY_BASE_DELAY_MS", time.Second),
+		RetryMaxDelay:        l.duration("RETRY_MAX_DELAY_MS", time.Minute),
+		ErrorMaxAttempts:     l.int("ERROR_MAX_ATTEMPTS", 1),
+		AdminToken:           l.get("ADMIN_TOKEN"),
+		AgentTransport:       l.string("AGENT_TRANSPORT", "poll"),
+		TaskWait:             l.duration("TASK_WAIT_MS", 30*time.Second),
+		HeartbeatInterval:    l.duration("HEARTBEAT_INTERVAL_MS", 5*time.Second),
+		AgentTimeout:         l.duration("AGENT_TIMEOUT_MS", 15*time.Second),
+		AgentOperations:      l.list("AGENT_OPERATIONS"),
+		AgentModes:           l.list("AGENT_MODES"),
+		MaxOperandSize:       l.int("MAX_OPERAND_SIZE", 0),
+		AgentToken:           l.get("AGENT_TOKEN"),
+		TLSCAFile:            l.get("TLS_CA_FILE"),
+		TLSCertFile:          l.get("TLS_CERT_FILE"),
+		TLSKeyFile:           l.get("TLS_KEY_FILE"),
+		InternalTLSAddr:      l.string("INTERNAL_TLS_ADDR", ":8443"),
+		ListenAddr:           l.string("LISTEN_ADDR", ":8080"),
+		GRPCListenAddr:       l.string("GRPC_LISTEN_ADDR", ":9090"),
+		DBPath:               l.string("DB_PATH", "calc.db"),
+		HTTPReadTimeout:      l.duration("HTTP_READ_TIMEOUT_MS", 15*time.Second),
+		HTTPWriteTimeout:     l.duration("HTTP_WRITE_TIMEOUT_MS", 15*time.Second),
+		HTTPIdleTimeout:      l.duration("HTTP_IDLE_TIMEOUT_MS", 60*time.Second),
+		OrchestratorURL:      l.get("ORCHESTRATOR_URL"),
+		OrchestratorGRPCAddr: l.string("ORCHESTRATOR_GRPC_ADDR", "localhost:9090"),
+		PollInterval:         l.duration("POLL_INTERVAL_MS", time.Second),
+		HTTPClientTimeout:    l.duration("HTTP_CLIENT_TIMEOUT_MS", 0),
+		ShutdownTimeout:      l.duration("SHUTDOWN_TIMEOUT_MS", 30*time.Second),
 	}
-	return &Config{
-		TimeAddition:       getEnvDuration("TIME_ADDITION_MS", 1000),
-		TimeSubtraction:    getEnvDuration("TIME_SUBTRACTION_MS", 1000),
-		TimeMultiplication: getEnvDuration("TIME_MULTIPLICATIONS_MS", 1000),
-		TimeDivision:       getEnvDuration("TIME_DIVISIONS_MS", 1000),
-		ComputingPower:     getEnvInt("COMPUTING_POWER", 1),
-		JWTSecret:          os.Getenv("JWT_SECRET"),
+	if err := errors.Join(l.errs...); err != nil {
+		return nil, err
 	}
+	if cfg.OrchestratorURL == "" {
+		cfg.OrchestratorURL = defaultOrchestratorURL(cfg)
+	}
+	return cfg, nil
 }
 
-func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
-	valueStr := os.Getenv(key)
+// defaultOrchestratorURL - оркестратор на этой же машине: /internal на
+// LISTEN_ADDR или, в режиме mTLS, на INTERNAL_TLS_ADDR
+func defaultOrchestratorURL(c *Config) string {
+	scheme, addr := "http://", c.ListenAddr
+	if c.MTLSEnabled() {
+		scheme, addr = "https://", c.InternalTLSAddr
+	}
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+	return scheme + addr
+}
+
+// loader разбирает значения из src и копит ошибки разбора
+type loader struct {
+	src  sources
+	errs []error
+}
+
+func (l *loader) get(key string) string {
+	return l.src.get(key)
+}
+
+func (l *loader) fail(key, value, reason string) {
+	l.errs = append(l.errs, &FieldError{Key: key, Value: value, Reason: reason})
+}
+
+// duration разбирает миллисекунды
+func (l *loader) duration(key string, defaultValue time.Duration) time.Duration {
+	valueStr := l.get(key)
 	if valueStr == "" {
 		return defaultValue
 	}
 	value, err := strconv.Atoi(valueStr)
-	if err != nil {
+	if err != nil || value < 0 {
+		l.fail(key, valueStr, "must be a non-negative number of milliseconds")
 		return defaultValue
 	}
 	return time.Duration(value) * time.Millisecond
 }
 
-func getEnvInt(key string, defaultValue int) int {
-	valueStr := os.Getenv(key)
+func (l *loader) string(key string, defaultValue string) string {
+	if value := l.get(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func (l *loader) int(key string, defaultValue int) int {
+	valueStr := l.get(key)
 	if valueStr == "" {
 		return defaultValue
 	}
 	value, err := strconv.Atoi(valueStr)
 	if err != nil {
+		l.fail(key, valueStr, "must be an integer")
 		return defaultValue
 	}
 	return value
 }
+
+// list разбирает список через запятую, пустая переменная - пустой список
+func (l *loader) list(key string) []string {
+	var list []string
+	for _, item := range strings.Split(l.get(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
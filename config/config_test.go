@@ -0,0 +1,258 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetSources забывает флаги и файл конфигурации после теста
+func resetSources(t *testing.T) {
+	t.Cleanup(func() {
+		flagValues = map[string]string{}
+		configFile = ""
+	})
+}
+
+// inDir запускает тест в каталоге dir, где может не быть .env
+func inDir(t *testing.T, dir string) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// unsetEnv убирает переменные окружения на время теста, чтобы значения
+// брались из .env и файлов
+func unsetEnv(t *testing.T, keys ...string) {
+	for _, key := range keys {
+		t.Setenv(key, "")
+		os.Unsetenv(key)
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	resetSources(t)
+	dir := t.TempDir()
+	inDir(t, dir)
+
+	unsetEnv(t, "POLL_INTERVAL_MS", "LISTEN_ADDR")
+	writeFile(t, ".env", "DB_PATH=dotenv.db\nPOLL_INTERVAL_MS=300\n")
+	writeFile(t, "calc.env", "LISTEN_ADDR=:7000\nDB_PATH=file.db\nGRPC_LISTEN_ADDR=:7001\nPOLL_INTERVAL_MS=400\n")
+	// .env важнее файла, окружение - .env, флаг - окружения
+	t.Setenv("DB_PATH", "env.db")
+	t.Setenv("GRPC_LISTEN_ADDR", ":7101")
+
+	printConfig := ParseFlags("orchestrator", []string{
+		"-config", "calc.env",
+		"-grpc-listen", ":7201",
+		"-read-timeout", "2s",
+		"--print-config",
+	}, OrchestratorFlags)
+	if !printConfig {
+		t.Error("printConfig = false; want true")
+	}
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	tests := []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{"from file", cfg.ListenAddr, ":7000"},
+		{".env over file", cfg.PollInterval, 300 * time.Millisecond},
+		{"env over .env", cfg.DBPath, "env.db"},
+		{"flag over env", cfg.GRPCListenAddr, ":7201"},
+		{"duration flag", cfg.HTTPReadTimeout, 2 * time.Second},
+		{"default", cfg.HTTPIdleTimeout, 60 * time.Second},
+		{"orchestrator URL from listen address", cfg.OrchestratorURL, "http://localhost:7000"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v; want %v", tt.name, tt.got, tt.want)
+		}
+	}
+
+	ParseFlags("agent", []string{"-config", "missing.env"}, AgentFlags)
+	if _, err := Load(); err == nil {
+		t.Error("Load() with missing config file: expected error")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	resetSources(t)
+
+	t.Run("No .env", func(t *testing.T) {
+		inDir(t, t.TempDir())
+		unsetEnv(t, "TIME_ADDITION_MS", "COMPUTING_POWER")
+		cfg, err := Load()
+		if err != nil {
+			t.Fatalf("Load() error = %v", err)
+		}
+		if cfg.TimeAddition != time.Second || cfg.ComputingPower != 1 {
+			t.Errorf("defaults = %v, %d; want 1s, 1", cfg.TimeAddition, cfg.ComputingPower)
+		}
+	})
+
+	t.Run("Bad values", func(t *testing.T) {
+		inDir(t, t.TempDir())
+		t.Setenv("TIME_ADDITION_MS", "fast")
+		t.Setenv("TASK_WAIT_MS", "-5")
+		t.Setenv("COMPUTING_POWER", "many")
+
+		_, err := Load()
+		if err == nil {
+			t.Fatal("Load() with bad values: expected error")
+		}
+		var keys []string
+		for _, e := range err.(interface{ Unwrap() []error }).Unwrap() {
+			var fieldErr *FieldError
+			if !errors.As(e, &fieldErr) {
+				t.Fatalf("error %v is not a *FieldError", e)
+			}
+			keys = append(keys, fieldErr.Key)
+		}
+		if got := strings.Join(keys, ","); got != "TIME_ADDITION_MS,COMPUTING_POWER,TASK_WAIT_MS" {
+			t.Errorf("invalid keys = %s", got)
+		}
+	})
+}
+
+func TestValidate(t *testing.T) {
+	resetSources(t)
+	inDir(t, t.TempDir())
+	valid, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		key    string
+	}{
+		{"Valid", func(c *Config) {}, ""},
+		{"No workers", func(c *Config) { c.ComputingPower = 0 }, "COMPUTING_POWER"},
+		{"No retry attempts", func(c *Config) { c.RetryMaxAttempts = 0 }, "RETRY_MAX_ATTEMPTS"},
+		{"Negative error attempts", func(c *Config) { c.ErrorMaxAttempts = -1 }, "ERROR_MAX_ATTEMPTS"},
+		{"Bad listen address", func(c *Config) { c.ListenAddr = "8080" }, "LISTEN_ADDR"},
+		{"Bad orchestrator URL", func(c *Config) { c.OrchestratorURL = "localhost:8080" }, "ORCHESTRATOR_URL"},
+		{"Unknown transport", func(c *Config) { c.AgentTransport = "carrier-pigeon" }, "AGENT_TRANSPORT"},
+		{"Zero poll interval", func(c *Config) { c.PollInterval = 0 }, "POLL_INTERVAL_MS"},
+		{"Client timeout shorter than wait", func(c *Config) { c.HTTPClientTimeout = 10 * time.Second }, "HTTP_CLIENT_TIMEOUT_MS"},
+		{"Wait too long", func(c *Config) { c.TaskWait = 2 * time.Minute }, "TASK_WAIT_MS"},
+		{"Partial TLS", func(c *Config) { c.TLSCAFile = "ca.pem" }, "TLS_CA_FILE"},
+		{"Negative shutdown timeout", func(c *Config) { c.ShutdownTimeout = -time.Second }, "SHUTDOWN_TIMEOUT_MS"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := *valid
+			tt.modify(&c)
+			err := c.Validate()
+			if tt.key == "" {
+				if err != nil {
+					t.Errorf("Validate() error = %v", err)
+				}
+				return
+			}
+			var fieldErr *FieldError
+			if !errors.As(err, &fieldErr) || fieldErr.Key != tt.key {
+				t.Errorf("Validate() error = %v; want *FieldError for %s", err, tt.key)
+			}
+		})
+	}
+}
+
+func TestPrint(t *testing.T) {
+	resetSources(t)
+	inDir(t, t.TempDir())
+	cfg, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.JWTSecret = "secret"
+	cfg.AdminToken = ""
+	cfg.PollInterval = 1500 * time.Millisecond
+	cfg.AgentOperations = []string{"+", "-"}
+	cfg.TLSCAFile = "certs/ca.pem"
+	cfg.TLSCertFile = "certs/agent.pem"
+	cfg.TLSKeyFile = "certs/agent-key.pem"
+	cfg.OrchestratorURL = defaultOrchestratorURL(cfg)
+
+	var out strings.Builder
+	cfg.Print(&out)
+	for _, line := range []string{
+		"JWT_SECRET=***\n",
+		"ADMIN_TOKEN=\n",
+		"POLL_INTERVAL_MS=1500\n",
+		"AGENT_OPERATIONS=+,-\n",
+		"ORCHESTRATOR_URL=https://localhost:8443\n",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("Print() output has no %q:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestStoreReload(t *testing.T) {
+	resetSources(t)
+	inDir(t, t.TempDir())
+	unsetEnv(t, "TIME_ADDITION_MS", "DB_PATH")
+	writeFile(t, ".env", "TIME_ADDITION_MS=100\nDB_PATH=first.db\n")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewStore(cfg)
+	var notified []*Config
+	store.Subscribe(func(c *Config) { notified = append(notified, c) })
+
+	// время операций меняется на ходу, а путь к базе - только после перезапуска
+	writeFile(t, ".env", "TIME_ADDITION_MS=250\nDB_PATH=second.db\n")
+	if err := store.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	current := store.Current()
+	if current.TimeAddition != 250*time.Millisecond || current.DBPath != "first.db" {
+		t.Errorf("after reload TimeAddition = %v, DBPath = %s; want 250ms, first.db", current.TimeAddition, current.DBPath)
+	}
+	if cfg.TimeAddition != 100*time.Millisecond {
+		t.Errorf("reload changed the loaded config: TimeAddition = %v", cfg.TimeAddition)
+	}
+	if len(notified) != 1 || notified[0] != current {
+		t.Errorf("subscribers notified %d times; want once with the new config", len(notified))
+	}
+
+	// с ошибками в файле остаются прежние настройки
+	writeFile(t, ".env", "TIME_ADDITION_MS=soon\n")
+	var fieldErr *FieldError
+	if err := store.Reload(); !errors.As(err, &fieldErr) || fieldErr.Key != "TIME_ADDITION_MS" {
+		t.Errorf("Reload() error = %v; want *FieldError for TIME_ADDITION_MS", err)
+	}
+	if store.Current() != current || len(notified) != 1 {
+		t.Error("failed reload replaced the config")
+	}
+
+	// без изменений подписчиков не будят
+	writeFile(t, ".env", "TIME_ADDITION_MS=250\nDB_PATH=second.db\n")
+	if err := store.Reload(); err != nil || len(notified) != 1 {
+		t.Errorf("Reload() without changes = %v, %d notifications", err, len(notified))
+	}
+}
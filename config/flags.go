@@ -0,0 +1,150 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// Flag - флаг командной строки, который задаёт переменную Key.
+// Значение Duration-флага пишется как время Go (500ms, 2s), а не в миллисекундах.
+type Flag struct {
+	Name     string
+	Key      string
+	Usage    string
+	Duration bool
+}
+
+// OrchestratorFlags - флаги cmd/orchestrator
+var OrchestratorFlags = []Flag{
+	{Name: "listen", Key: "LISTEN_ADDR", Usage: "адрес HTTP API"},
+	{Name: "grpc-listen", Key: "GRPC_LISTEN_ADDR", Usage: "адрес gRPC-сервиса для агентов"},
+	{Name: "internal-tls-listen", Key: "INTERNAL_TLS_ADDR", Usage: "адрес /internal в режиме mTLS"},
+	{Name: "db", Key: "DB_PATH", Usage: "файл базы SQLite"},
+	{Name: "read-timeout", Key: "HTTP_READ_TIMEOUT_MS", Usage: "таймаут чтения запроса", Duration: true},
+	{Name: "write-timeout", Key: "HTTP_WRITE_TIMEOUT_MS", Usage: "таймаут записи ответа", Duration: true},
+	{Name: "idle-timeout", Key: "HTTP_IDLE_TIMEOUT_MS", Usage: "таймаут простаивающего соединения", Duration: true},
+	{Name: "reap-interval", Key: "LEASE_REAP_INTERVAL_MS", Usage: "как часто возвращать в очередь задачи с истёкшей арендой", Duration: true},
+}
+
+// AgentFlags - флаги cmd/agent
+var AgentFlags = []Flag{
+	{Name: "orchestrator", Key: "ORCHESTRATOR_URL", Usage: "адрес оркестратора, например http://calc:8080"},
+	{Name: "orchestrator-grpc", Key: "ORCHESTRATOR_GRPC_ADDR", Usage: "адрес gRPC-сервиса оркестратора"},
+	{Name: "transport", Key: "AGENT_TRANSPORT", Usage: "poll, websocket, grpc или grpc-stream"},
+	{Name: "workers", Key: "COMPUTING_POWER", Usage: "число воркеров"},
+	{Name: "poll-interval", Key: "POLL_INTERVAL_MS", Usage: "пауза, когда задач нет или оркестратор недоступен", Duration: true},
+	{Name: "task-wait", Key: "TASK_WAIT_MS", Usage: "сколько ждать задачу в одном запросе", Duration: true},
+	{Name: "heartbeat-interval", Key: "HEARTBEAT_INTERVAL_MS", Usage: "как часто сообщать, что агент жив", Duration: true},
+	{Name: "http-timeout", Key: "HTTP_CLIENT_TIMEOUT_MS", Usage: "таймаут запроса к оркестратору, 0 - без ограничений", Duration: true},
+	{Name: "shutdown-timeout", Key: "SHUTDOWN_TIMEOUT_MS", Usage: "сколько досчитывать начатые задачи после сигнала остановки", Duration: true},
+}
+
+var (
+	// flagValues - переменные, заданные флагами командной строки
+	flagValues = map[string]string{}
+	// configFile - файл конфигурации из -config
+	configFile string
+)
+
+// configPath - файл конфигурации из -config, а без флага - из CONFIG_FILE
+func configPath() string {
+	if configFile != "" {
+		return configFile
+	}
+	return os.Getenv("CONFIG_FILE")
+}
+
+// dotenvFile - необязательный файл с переменными окружения
+const dotenvFile = ".env"
+
+// sources - откуда Load берёт значения, кроме флагов и окружения
+type sources struct {
+	dotenv map[string]string
+	file   map[string]string
+}
+
+// readSources читает .env, если он есть, и файл конфигурации, если он задан
+func readSources() (sources, error) {
+	src := sources{dotenv: map[string]string{}, file: map[string]string{}}
+	values, err := godotenv.Read(dotenvFile)
+	if err == nil {
+		src.dotenv = values
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return src, fmt.Errorf("error reading %s: %w", dotenvFile, err)
+	}
+
+	if path := configPath(); path != "" {
+		values, err := godotenv.Read(path)
+		if err != nil {
+			return src, fmt.Errorf("error reading config file: %w", err)
+		}
+		src.file = values
+	}
+	return src, nil
+}
+
+// get ищет переменную во флагах, в окружении, в .env, а потом в файле конфигурации
+func (s sources) get(key string) string {
+	if value, ok := flagValues[key]; ok {
+		return value
+	}
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	if value, ok := s.dotenv[key]; ok {
+		return value
+	}
+	return s.file[key]
+}
+
+// watchedFiles - файлы, при изменении которых настройки перечитываются
+func watchedFiles() []string {
+	files := []string{dotenvFile}
+	if path := configPath(); path != "" {
+		files = append(files, path)
+	}
+	return files
+}
+
+// ParseFlags разбирает флаги программы name: flags, -config с файлом
+// конфигурации и -print-config. Файл - в формате .env, его путь можно задать
+// и в CONFIG_FILE. Вызывается в main до Load.
+func ParseFlags(name string, args []string, flags []Flag) (printConfig bool) {
+	set := flag.NewFlagSet(name, flag.ExitOnError)
+	set.StringVar(&configFile, "config", os.Getenv("CONFIG_FILE"), "файл конфигурации в формате .env (CONFIG_FILE)")
+	set.BoolVar(&printConfig, "print-config", false, "напечатать итоговую конфигурацию и выйти")
+	for _, f := range flags {
+		set.Var(flagValue{key: f.Key, duration: f.Duration}, f.Name, fmt.Sprintf("%s (%s)", f.Usage, f.Key))
+	}
+	set.Parse(args)
+	return printConfig
+}
+
+// flagValue записывает значение флага в flagValues под ключом переменной
+type flagValue struct {
+	key      string
+	duration bool
+}
+
+func (v flagValue) String() string {
+	return ""
+}
+
+func (v flagValue) Set(value string) error {
+	if v.duration {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		value = strconv.FormatInt(d.Milliseconds(), 10)
+	}
+	flagValues[v.key] = value
+	return nil
+}
@@ -0,0 +1,138 @@
+package config
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// watchInterval - как часто Watch проверяет, не изменились ли .env и файл конфигурации
+const watchInterval = 2 * time.Second
+
+// Store хранит текущие настройки процесса и перечитывает их по SIGHUP или
+// при изменении файлов. Без перезапуска меняются только поля с тегом reload,
+// остальные остаются как при запуске. Подписчики получают новый Config.
+type Store struct {
+	current     atomic.Pointer[Config]
+	mu          sync.Mutex
+	subscribers []func(*Config)
+}
+
+// NewStore создаёт Store с настройками, загруженными при запуске
+func NewStore(cfg *Config) *Store {
+	s := &Store{}
+	s.current.Store(cfg)
+	return s
+}
+
+// Current возвращает текущие настройки. Config не меняется, его можно хранить.
+func (s *Store) Current() *Config {
+	return s.current.Load()
+}
+
+// Subscribe добавляет fn, которую Store вызывает с новыми настройками после перезагрузки
+func (s *Store) Subscribe(fn func(*Config)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscribers = append(s.subscribers, fn)
+}
+
+// Reload перечитывает настройки. Если они не разбираются или не проходят
+// Validate, текущие остаются в силе и Reload возвращает ошибку.
+func (s *Store) Reload() error {
+	fresh, err := Load()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := *s.Current()
+	changed := applyReloadable(&next, fresh)
+	if len(changed) == 0 {
+		return nil
+	}
+	if err := next.Validate(); err != nil {
+		return err
+	}
+	s.current.Store(&next)
+	log.Printf("Config reloaded: %s", strings.Join(changed, ", "))
+
+	for _, fn := range s.subscribers {
+		fn(&next)
+	}
+	return nil
+}
+
+// applyReloadable переносит в cfg изменённые поля fresh с тегом reload
+// и возвращает их переменные. Об остальных изменениях только предупреждает.
+func applyReloadable(cfg, fresh *Config) []string {
+	v := reflect.ValueOf(cfg).Elem()
+	fv := reflect.ValueOf(fresh).Elem()
+	t := v.Type()
+
+	var changed []string
+	for i := 0; i < t.NumField(); i++ {
+		if reflect.DeepEqual(v.Field(i).Interface(), fv.Field(i).Interface()) {
+			continue
+		}
+		field := t.Field(i)
+		if field.Tag.Get("reload") != "true" {
+			log.Printf("%s changed, restart to apply it", field.Tag.Get("env"))
+			continue
+		}
+		v.Field(i).Set(fv.Field(i))
+		changed = append(changed, field.Tag.Get("env"))
+	}
+	return changed
+}
+
+// Watch перезагружает настройки по SIGHUP и когда меняются .env или файл
+// конфигурации, пока не отменят ctx
+func (s *Store) Watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	modified := modTimes()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Println("SIGHUP received, reloading config")
+		case <-ticker.C:
+			current := modTimes()
+			if reflect.DeepEqual(current, modified) {
+				continue
+			}
+			modified = current
+			log.Println("Config files changed, reloading config")
+		}
+		if err := s.Reload(); err != nil {
+			log.Printf("Config reload failed, keeping current config:\n%v", err)
+		}
+	}
+}
+
+// modTimes - время изменения файлов настроек, нулевое у тех, которых нет
+func modTimes() map[string]time.Time {
+	times := map[string]time.Time{}
+	for _, file := range watchedFiles() {
+		if info, err := os.Stat(file); err == nil {
+			times[file] = info.ModTime()
+		}
+	}
+	return times
+}
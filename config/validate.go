@@ -0,0 +1,130 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FieldError - недопустимое значение настройки Key. Load и Validate
+// возвращают все такие ошибки разом через errors.Join.
+type FieldError struct {
+	Key    string // переменная окружения, например TASK_WAIT_MS
+	Value  string
+	Reason string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s=%q: %s", e.Key, e.Value, e.Reason)
+}
+
+// transports - допустимые значения AGENT_TRANSPORT
+var transports = []string{"poll", "websocket", "grpc", "grpc-stream"}
+
+// Validate проверяет настройки и возвращает все найденные ошибки разом
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, key string, value interface{}, reason string) {
+		if !ok {
+			errs = append(errs, &FieldError{Key: key, Value: formatValue(value), Reason: reason})
+		}
+	}
+
+	check(c.ComputingPower >= 1, "COMPUTING_POWER", c.ComputingPower, "must be at least 1")
+	// задачу запускают хотя бы раз
+	check(c.RetryMaxAttempts >= 1, "RETRY_MAX_ATTEMPTS", c.RetryMaxAttempts, "must be at least 1")
+	check(c.ErrorMaxAttempts >= 1, "ERROR_MAX_ATTEMPTS", c.ErrorMaxAttempts, "must be at least 1")
+	check(c.DBPath != "", "DB_PATH", c.DBPath, "must not be empty")
+	for _, addr := range []struct{ key, value string }{
+		{"LISTEN_ADDR", c.ListenAddr},
+		{"GRPC_LISTEN_ADDR", c.GRPCListenAddr},
+		{"INTERNAL_TLS_ADDR", c.InternalTLSAddr},
+		{"ORCHESTRATOR_GRPC_ADDR", c.OrchestratorGRPCAddr},
+	} {
+		_, _, err := net.SplitHostPort(addr.value)
+		check(err == nil, addr.key, addr.value, "must be host:port")
+	}
+	u, err := url.Parse(c.OrchestratorURL)
+	check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+		"ORCHESTRATOR_URL", c.OrchestratorURL, "must be an http or https URL")
+
+	check(contains(transports, c.AgentTransport), "AGENT_TRANSPORT", c.AgentTransport,
+		"must be one of "+strings.Join(transports, ", "))
+	for _, interval := range []struct {
+		key   string
+		value time.Duration
+	}{
+		{"TASK_LEASE_MS", c.TaskLease},
+		{"LEASE_REAP_INTERVAL_MS", c.LeaseReapInterval},
+		{"HEARTBEAT_INTERVAL_MS", c.HeartbeatInterval},
+		{"AGENT_TIMEOUT_MS", c.AgentTimeout},
+		{"POLL_INTERVAL_MS", c.PollInterval},
+	} {
+		check(interval.value > 0, interval.key, interval.value, "must be positive")
+	}
+	// дольше минуты оркестратор задачу не ждёт
+	check(c.TaskWait <= time.Minute, "TASK_WAIT_MS", c.TaskWait, "must not exceed 60000")
+	check(c.HTTPClientTimeout == 0 || c.HTTPClientTimeout > c.TaskWait, "HTTP_CLIENT_TIMEOUT_MS", c.HTTPClientTimeout,
+		"must be 0 or longer than TASK_WAIT_MS")
+	check(c.ShutdownTimeout >= 0, "SHUTDOWN_TIMEOUT_MS", c.ShutdownTimeout, "must not be negative")
+	check(c.AgentTimeout > c.HeartbeatInterval, "AGENT_TIMEOUT_MS", c.AgentTimeout,
+		"must be longer than HEARTBEAT_INTERVAL_MS")
+
+	tlsFiles := 0
+	for _, file := range []string{c.TLSCAFile, c.TLSCertFile, c.TLSKeyFile} {
+		if file != "" {
+			tlsFiles++
+		}
+	}
+	check(tlsFiles == 0 || tlsFiles == 3, "TLS_CA_FILE", c.TLSCAFile,
+		"TLS_CA_FILE, TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+
+	return errors.Join(errs...)
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Print печатает настройки в формате .env, так что вывод годится как файл
+// конфигурации. Секреты скрыты.
+func (c *Config) Print(w io.Writer) {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := field.Tag.Get("env")
+		if key == "" {
+			continue
+		}
+
+		value := formatValue(v.Field(i).Interface())
+		if field.Tag.Get("secret") == "true" && value != "" {
+			value = "***"
+		}
+		fmt.Fprintf(w, "%s=%s\n", key, value)
+	}
+}
+
+// formatValue записывает значение настройки так же, как в переменной окружения
+func formatValue(value interface{}) string {
+	switch x := value.(type) {
+	case time.Duration:
+		return strconv.FormatInt(x.Milliseconds(), 10)
+	case []string:
+		return strings.Join(x, ",")
+	default:
+		return fmt.Sprint(x)
+	}
+}
@@ -0,0 +1,998 @@
+package calc_golang_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/zalhui/calc_golang/config"
+	"github.com/zalhui/calc_golang/internal/auth"
+	"github.com/zalhui/calc_golang/internal/common/agentpb"
+	"github.com/zalhui/calc_golang/internal/common/models"
+	"github.com/zalhui/calc_golang/internal/db"
+	"github.com/zalhui/calc_golang/internal/middleware"
+	"github.com/zalhui/calc_golang/internal/mtls"
+	"github.com/zalhui/calc_golang/internal/orchestrator/application"
+	"github.com/zalhui/calc_golang/pkg/calculation"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// newServer поднимает оркестратор с маршрутами application.NewRouter,
+// как cmd/orchestrator, на временной базе
+func newServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server, _ := newApp(t)
+	return server
+}
+
+// newApp - то же, что newServer, но отдаёт и само приложение
+func newApp(t *testing.T) (*httptest.Server, *application.Application) {
+	t.Helper()
+
+	database, err := db.NewDB(filepath.Join(t.TempDir(), "calc.db"))
+	if err != nil {
+		t.Fatalf("NewDB() error = %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	// настройки читаются заново для каждого теста, чтобы действовал t.Setenv
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("config.Load() error = %v", err)
+	}
+	auth.SetSecret(cfg.JWTSecret)
+	app := application.New(database, cfg)
+	router, _ := application.NewRouter(app, cfg)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server, app
+}
+
+// client ходит в API от имени одного пользователя, а в /internal - от имени агента
+type client struct {
+	t          *testing.T
+	server     *httptest.Server
+	token      string
+	agentToken string
+	httpClient *http.Client // nil - http.DefaultClient
+}
+
+func newClient(t *testing.T, server *httptest.Server) *client {
+	c := &client{t: t, server: server, agentToken: agentToken(t, "test-agent")}
+	credentials := map[string]string{"login": "user", "password": "secret"}
+	c.do("POST", "/api/v1/register", credentials, nil)
+
+	var auth models.AuthResponse
+	c.do("POST", "/api/v1/login", credentials, &auth)
+	c.token = auth.Token
+	return c
+}
+
+// agentToken выдаёт токен агенту agentID, как команда admin agent-token
+func agentToken(t *testing.T, agentID string) string {
+	t.Helper()
+	token, err := auth.GenerateAgentToken(agentID, time.Hour)
+	if err != nil {
+		t.Fatalf("GenerateAgentToken: %v", err)
+	}
+	return token
+}
+
+// do отправляет запрос и декодирует ответ в out, если он не nil.
+// Возвращает код ответа.
+func (c *client) do(method, path string, body, out interface{}) int {
+	c.t.Helper()
+
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			c.t.Fatalf("marshal %s %s: %v", method, path, err)
+		}
+	}
+	req, err := http.NewRequest(method, c.server.URL+path, bytes.NewReader(data))
+	if err != nil {
+		c.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	token := c.token
+	if strings.HasPrefix(path, "/internal") {
+		token = c.agentToken
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	httpClient := c.httpClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		c.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if out != nil && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			c.t.Fatalf("decode %s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// runAgent выполняет задачи, пока оркестратор их выдаёт, и возвращает их число.
+// Каждая выданная задача должна быть готова к вычислению без ожидания других задач.
+func (c *client) runAgent() int {
+	c.t.Helper()
+
+	done := 0
+	for {
+		var response struct {
+			Task models.Task `json:"task"`
+		}
+		if c.do("GET", "/internal/task", nil, &response) == http.StatusNotFound {
+			return done
+		}
+		task := response.Task
+
+		args := make([]string, len(task.Args))
+		for i, arg := range task.Args {
+			if arg.IsRef() {
+				c.t.Fatalf("task %s %s was dispatched with unresolved operand %s", task.ID, task.Operation, arg)
+			}
+			args[i] = arg.Value
+		}
+		mode, _ := calculation.ParseMode(task.Mode)
+		result := map[string]interface{}{"id": task.ID}
+		if value, err := calculation.ApplyMode(mode, task.Operation, args); err != nil {
+			result["error"] = err.Error()
+		} else {
+			result["exact_result"] = value
+		}
+		c.do("POST", "/internal/task/result", result, nil)
+		done++
+	}
+}
+
+func TestDependencyAwareDispatch(t *testing.T) {
+	c := newClient(t, newServer(t))
+
+	tests := []struct {
+		expression string
+		mode       string
+		tasks      int
+		status     string
+		result     interface{}
+	}{
+		{"(2+3)*(4-1) - 6/2", "decimal", 5, "completed", "12"},
+		{"max(1, 2, 3) ^ 2 // (1 + 1)", "float", 4, "completed", "4"},
+		// после ошибки в 2-2 остальные задачи не выдаются
+		{"1/(2-2) + 3", "float", 2, "error", nil},
+	}
+
+	for _, tt := range tests {
+		var created struct {
+			ID string `json:"id"`
+		}
+		body := map[string]string{"expression": tt.expression, "mode": tt.mode}
+		if code := c.do("POST", "/api/v1/calculate", body, &created); code != http.StatusCreated {
+			t.Fatalf("calculate %q: status %d", tt.expression, code)
+		}
+
+		if done := c.runAgent(); done != tt.tasks {
+			t.Errorf("%q: agent ran %d tasks; want %d", tt.expression, done, tt.tasks)
+		}
+
+		var expression map[string]interface{}
+		c.do("GET", "/api/v1/expressions/"+created.ID, nil, &expression)
+		if expression["status"] != tt.status || expression["exact_result"] != tt.result {
+			t.Errorf("%q: status %v, exact_result %v; want %s, %v",
+				tt.expression, expression["status"], expression["exact_result"], tt.status, tt.result)
+		}
+	}
+}
+
+// TestExpressionList проверяет, что список выражений и история отдают
+// результат числом и строкой, как GET /api/v1/expressions/{id}
+func TestExpressionList(t *testing.T) {
+	c := newClient(t, newServer(t))
+
+	c.do("POST", "/api/v1/calculate", map[string]string{"expression": "1/4+1/4", "mode": "rational"}, nil)
+	if done := c.runAgent(); done != 3 {
+		t.Fatalf("agent ran %d tasks; want 3", done)
+	}
+
+	// result и exact_result декодируются как число и строка, а не как sql.Null*
+	type item struct {
+		Status      string   `json:"status"`
+		Result      *float64 `json:"result"`
+		ExactResult string   `json:"exact_result"`
+		Decimal     string   `json:"decimal"`
+	}
+	var list struct {
+		Expressions []item `json:"expressions"`
+	}
+	var history struct {
+		History []item `json:"history"`
+	}
+	c.do("GET", "/api/v1/expressions?digits=2", nil, &list)
+	c.do("GET", "/api/v1/history?digits=2", nil, &history)
+
+	for name, items := range map[string][]item{"expressions": list.Expressions, "history": history.History} {
+		if len(items) != 1 {
+			t.Fatalf("%s = %+v; want one expression", name, items)
+		}
+		got := items[0]
+		if got.Status != "completed" || got.Result == nil || got.ExactResult != "1/2" || got.Decimal != "0.50" {
+			t.Errorf("%s = %s %v %q %q; want completed, 1/2, 0.50", name, got.Status, got.Result, got.ExactResult, got.Decimal)
+		}
+	}
+}
+
+func TestRetryAndDeadLetter(t *testing.T) {
+	t.Setenv("RETRY_MAX_ATTEMPTS", "2")
+	t.Setenv("RETRY_BASE_DELAY_MS", "0")
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+	server := newServer(t)
+	c := newClient(t, server)
+	admin := &client{t: t, server: server, token: "admin-secret"}
+
+	var created struct {
+		ID string `json:"id"`
+	}
+	c.do("POST", "/api/v1/calculate", map[string]string{"expression": "2+3"}, &created)
+
+	// агент дважды не смог посчитать задачу из-за временной ошибки
+	for attempt := 1; attempt <= 2; attempt++ {
+		var response struct {
+			Task models.Task `json:"task"`
+		}
+		if code := c.do("GET", "/internal/task", nil, &response); code != http.StatusOK {
+			t.Fatalf("attempt %d: GET /internal/task status %d", attempt, code)
+		}
+		if response.Task.Attempts != attempt {
+			t.Errorf("attempt %d: task attempts = %d", attempt, response.Task.Attempts)
+		}
+		c.do("POST", "/internal/task/result", map[string]string{
+			"id":          response.Task.ID,
+			"error":       "connection reset",
+			"error_class": models.ErrorClassTransient,
+		}, nil)
+	}
+
+	if done := c.runAgent(); done != 0 {
+		t.Errorf("agent ran %d tasks after the task died; want 0", done)
+	}
+	var expression map[string]interface{}
+	c.do("GET", "/api/v1/expressions/"+created.ID, nil, &expression)
+	if expression["status"] != "error" {
+		t.Errorf("expression status = %v; want error", expression["status"])
+	}
+
+	if code := c.do("GET", "/admin/tasks/dead", nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("GET /admin/tasks/dead with user token: status %d; want 401", code)
+	}
+	var dead struct {
+		Tasks []map[string]interface{} `json:"tasks"`
+	}
+	admin.do("GET", "/admin/tasks/dead", nil, &dead)
+	if len(dead.Tasks) != 1 || dead.Tasks[0]["last_error"] != "connection reset" {
+		t.Fatalf("dead tasks = %v; want one task with the agent error", dead.Tasks)
+	}
+
+	taskID := dead.Tasks[0]["id"].(string)
+	if code := admin.do("POST", "/admin/tasks/"+taskID+"/redrive", nil, nil); code != http.StatusOK {
+		t.Fatalf("redrive: status %d", code)
+	}
+	if done := c.runAgent(); done != 1 {
+		t.Errorf("agent ran %d tasks after redrive; want 1", done)
+	}
+	c.do("GET", "/api/v1/expressions/"+created.ID, nil, &expression)
+	if expression["status"] != "completed" || expression["exact_result"] != "5" {
+		t.Errorf("expression = %v %v; want completed 5", expression["status"], expression["exact_result"])
+	}
+}
+
+// TestReleasedTask проверяет, что задачу, которую вернул останавливающийся
+// агент, сразу получает следующий и попытка не считается
+func TestReleasedTask(t *testing.T) {
+	c := newClient(t, newServer(t))
+	c.do("POST", "/api/v1/calculate", map[string]string{"expression": "2+3"}, nil)
+
+	var response struct {
+		Task models.Task `json:"task"`
+	}
+	c.do("GET", "/internal/task", nil, &response)
+	code := c.do("POST", "/internal/task/result", map[string]string{
+		"id":          response.Task.ID,
+		"error":       "agent is shutting down",
+		"error_class": models.ErrorClassReleased,
+	}, nil)
+	if code != http.StatusOK {
+		t.Fatalf("release: status %d", code)
+	}
+
+	response.Task = models.Task{}
+	if code := c.do("GET", "/internal/task", nil, &response); code != http.StatusOK {
+		t.Fatalf("GET /internal/task after release: status %d", code)
+	}
+	if response.Task.Attempts != 1 {
+		t.Errorf("task attempts after release = %d; want 1", response.Task.Attempts)
+	}
+}
+
+func TestCancelExpression(t *testing.T) {
+	c := newClient(t, newServer(t))
+
+	var created struct {
+		ID string `json:"id"`
+	}
+	c.do("POST", "/api/v1/calculate", map[string]string{"expression": "(2+3)*(4+5)"}, &created)
+
+	var response struct {
+		Task models.Task `json:"task"`
+	}
+	c.do("GET", "/internal/task", nil, &response)
+
+	if code := c.do("POST", "/api/v1/expressions/"+created.ID+"/cancel", nil, nil); code != http.StatusOK {
+		t.Fatalf("cancel: status %d", code)
+	}
+
+	// агент узнаёт об отмене при продлении аренды и при отправке результата
+	if code := c.do("POST", "/internal/task/lease", map[string]string{"id": response.Task.ID}, nil); code != http.StatusGone {
+		t.Errorf("lease renewal after cancel: status %d; want 410", code)
+	}
+	result := map[string]string{"id": response.Task.ID, "exact_result": "5"}
+	if code := c.do("POST", "/internal/task/result", result, nil); code != http.StatusGone {
+		t.Errorf("result after cancel: status %d; want 410", code)
+	}
+	if done := c.runAgent(); done != 0 {
+		t.Errorf("agent ran %d tasks of a cancelled expression; want 0", done)
+	}
+
+	var expression map[string]interface{}
+	c.do("GET", "/api/v1/expressions/"+created.ID, nil, &expression)
+	if expression["status"] != "cancelled" {
+		t.Errorf("expression status = %v; want cancelled", expression["status"])
+	}
+
+	if code := c.do("POST", "/api/v1/expressions/"+created.ID+"/cancel", nil, nil); code != http.StatusConflict {
+		t.Errorf("second cancel: status %d; want 409", code)
+	}
+	if code := c.do("POST", "/api/v1/expressions/missing/cancel", nil, nil); code != http.StatusNotFound {
+		t.Errorf("cancel of missing expression: status %d; want 404", code)
+	}
+}
+
+func TestLiteralExpression(t *testing.T) {
+	c := newClient(t, newServer(t))
+
+	tests := []struct {
+		body   map[string]interface{}
+		result interface{}
+		exact  string
+	}{
+		{map[string]interface{}{"expression": "42"}, 42.0, "42"},
+		{map[string]interface{}{"expression": "(0x10)"}, 16.0, "16"},
+		{map[string]interface{}{"expression": "x", "variables": map[string]interface{}{"x": 0.25}, "mode": "rational"}, 0.25, "1/4"},
+		{map[string]interface{}{"expression": "1e-30", "mode": "decimal"}, 0.0, "0"},
+	}
+
+	for _, tt := range tests {
+		var created struct {
+			ID     string `json:"id"`
+			Status string `json:"status"`
+		}
+		if code := c.do("POST", "/api/v1/calculate", tt.body, &created); code != http.StatusCreated {
+			t.Fatalf("calculate %v: status %d", tt.body, code)
+		}
+		if created.Status != "completed" {
+			t.Errorf("calculate %v: status %q; want completed right away", tt.body, created.Status)
+		}
+		if done := c.runAgent(); done != 0 {
+			t.Errorf("calculate %v: agent ran %d tasks; want 0", tt.body, done)
+		}
+
+		var expression map[string]interface{}
+		c.do("GET", "/api/v1/expressions/"+created.ID, nil, &expression)
+		if expression["status"] != "completed" || expression["result"] != tt.result || expression["exact_result"] != tt.exact {
+			t.Errorf("calculate %v: got %v %v %v; want completed %v %s",
+				tt.body, expression["status"], expression["result"], expression["exact_result"], tt.result, tt.exact)
+		}
+	}
+}
+
+func TestLongPoll(t *testing.T) {
+	c := newClient(t, newServer(t))
+
+	if code := c.do("GET", "/internal/task?wait=forever", nil, nil); code != http.StatusBadRequest {
+		t.Errorf("wait=forever: status %d; want 400", code)
+	}
+
+	start := time.Now()
+	if code := c.do("GET", "/internal/task?wait=200ms", nil, nil); code != http.StatusNotFound {
+		t.Errorf("empty queue: status %d; want 404", code)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("empty queue: answered after %s; want to wait 200ms", elapsed)
+	}
+
+	// агент ждёт задачу, а выражение приходит позже: агента должно разбудить
+	// уведомление, а не очередная проверка очереди раз в секунду
+	type polled struct {
+		code    int
+		elapsed time.Duration
+	}
+	done := make(chan polled)
+	go func() {
+		start := time.Now()
+		code := c.do("GET", "/internal/task?wait=10s", nil, nil)
+		done <- polled{code, time.Since(start)}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	c.do("POST", "/api/v1/calculate", map[string]string{"expression": "2+3"}, nil)
+
+	got := <-done
+	if got.code != http.StatusOK || got.elapsed > 900*time.Millisecond {
+		t.Errorf("long poll: status %d after %s; want 200 right after the expression arrives", got.code, got.elapsed)
+	}
+}
+
+func TestLongPollRetry(t *testing.T) {
+	t.Setenv("RETRY_BASE_DELAY_MS", "300")
+	server := newServer(t)
+	c := newClient(t, server)
+	c.do("POST", "/api/v1/calculate", map[string]string{"expression": "2+3"}, nil)
+
+	var response struct {
+		Task models.Task `json:"task"`
+	}
+	c.do("GET", "/internal/task", nil, &response)
+	c.do("POST", "/internal/task/result", map[string]string{
+		"id":          response.Task.ID,
+		"error":       "connection reset",
+		"error_class": models.ErrorClassTransient,
+	}, nil)
+
+	// пауза перед повтором кончается без уведомления: агента будит таймер
+	// на not_before задачи, а не проверка очереди раз в секунду
+	start := time.Now()
+	code := c.do("GET", "/internal/task?wait=10s", nil, &response)
+	if elapsed := time.Since(start); code != http.StatusOK || elapsed < 200*time.Millisecond || elapsed > 900*time.Millisecond {
+		t.Errorf("long poll: status %d after %s; want 200 after the 300ms retry delay", code, elapsed)
+	}
+	if response.Task.Attempts != 2 {
+		t.Errorf("task attempts = %d; want 2", response.Task.Attempts)
+	}
+}
+
+func TestWebSocketAgent(t *testing.T) {
+	server := newServer(t)
+	c := newClient(t, server)
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+agentToken(t, "ws-agent"))
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/internal/ws", header)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// агент готов раньше, чем появилась задача: оркестратор пришлёт её сам
+	conn.WriteJSON(map[string]string{"type": "ready"})
+	var created struct {
+		ID string `json:"id"`
+	}
+	c.do("POST", "/api/v1/calculate", map[string]string{"expression": "2+3", "mode": "decimal"}, &created)
+
+	var msg struct {
+		Type           string      `json:"type"`
+		ID             string      `json:"id"`
+		Code           int         `json:"code"`
+		LeaseExpiresAt time.Time   `json:"lease_expires_at"`
+		Task           models.Task `json:"task"`
+	}
+	if err := conn.ReadJSON(&msg); err != nil || msg.Type != "task" || msg.Task.Operation != "+" {
+		t.Fatalf("pushed message = %+v, %v; want task +", msg, err)
+	}
+	taskID := msg.Task.ID
+
+	conn.WriteJSON(map[string]string{"type": "lease", "id": taskID})
+	if err := conn.ReadJSON(&msg); err != nil || msg.Type != "lease" || msg.Code != http.StatusOK || msg.LeaseExpiresAt.IsZero() {
+		t.Fatalf("lease reply = %+v, %v; want renewed lease", msg, err)
+	}
+
+	conn.WriteJSON(map[string]string{"type": "result", "id": taskID, "exact_result": "5"})
+	if err := conn.ReadJSON(&msg); err != nil || msg.Type != "result" || msg.Code != http.StatusOK {
+		t.Fatalf("result reply = %+v, %v; want 200", msg, err)
+	}
+
+	// результат уже принят, повторный - от агента, который задачу не держит
+	conn.WriteJSON(map[string]string{"type": "result", "id": taskID, "exact_result": "5"})
+	if err := conn.ReadJSON(&msg); err != nil || msg.Code != http.StatusConflict {
+		t.Errorf("second result reply = %+v, %v; want 409", msg, err)
+	}
+
+	var expression map[string]interface{}
+	c.do("GET", "/api/v1/expressions/"+created.ID, nil, &expression)
+	if expression["status"] != "completed" || expression["exact_result"] != "5" {
+		t.Errorf("expression = %v %v; want completed 5", expression["status"], expression["exact_result"])
+	}
+}
+
+func TestWebSocketReadyBatch(t *testing.T) {
+	server := newServer(t)
+	c := newClient(t, server)
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+agentToken(t, "ws-agent"))
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/internal/ws", header)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// три свободных воркера, а готовых задач две: третья придёт, когда
+	// после них станет готово умножение
+	for i := 0; i < 3; i++ {
+		conn.WriteJSON(map[string]string{"type": "ready"})
+	}
+	c.do("POST", "/api/v1/calculate", map[string]string{"expression": "(1+2)*(3+4)"}, nil)
+
+	var msg struct {
+		Type string      `json:"type"`
+		Code int         `json:"code"`
+		Task models.Task `json:"task"`
+	}
+	results := map[string]string{"1": "3", "3": "7"}
+	for i := 0; i < 2; i++ {
+		if err := conn.ReadJSON(&msg); err != nil || msg.Type != "task" || msg.Task.Operation != "+" {
+			t.Fatalf("pushed message %d = %+v, %v; want task +", i, msg, err)
+		}
+		conn.WriteJSON(map[string]string{"type": "result", "id": msg.Task.ID, "exact_result": results[msg.Task.Args[0].Value]})
+	}
+
+	tasks := 0
+	for tasks < 1 {
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		switch msg.Type {
+		case "result":
+			if msg.Code != http.StatusOK {
+				t.Fatalf("result reply code = %d; want 200", msg.Code)
+			}
+		case "task":
+			if msg.Task.Operation != "*" {
+				t.Fatalf("third task = %+v; want *", msg.Task)
+			}
+			tasks++
+		}
+	}
+}
+
+func TestGRPCAgent(t *testing.T) {
+	server, app := newApp(t)
+	c := newClient(t, server)
+
+	grpcServer := grpc.NewServer(
+		grpc.UnaryInterceptor(middleware.AgentAuthUnaryInterceptor),
+		grpc.StreamInterceptor(middleware.AgentAuthStreamInterceptor),
+	)
+	app.RegisterAgentServer(grpcServer)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer conn.Close()
+	agent := agentpb.NewAgentClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := agent.AgentHeartbeat(ctx, &agentpb.AgentHeartbeatRequest{}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("AgentHeartbeat without token: %v; want Unauthenticated", err)
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+agentToken(t, "grpc-agent"))
+
+	var created struct {
+		ID string `json:"id"`
+	}
+	c.do("POST", "/api/v1/calculate", map[string]string{"expression": "2*3+4", "mode": "decimal"}, &created)
+
+	// первая задача - отдельными вызовами
+	resp, err := agent.GetTask(ctx, &agentpb.GetTaskRequest{})
+	if err != nil || resp.GetTask().GetOperation() != "*" || resp.GetTask().GetLeaseExpiresAt() == nil {
+		t.Fatalf("GetTask() = %v, %v; want leased task *", resp, err)
+	}
+	taskID := resp.GetTask().GetId()
+
+	if _, err := agent.Heartbeat(ctx, &agentpb.HeartbeatRequest{TaskId: taskID}); err != nil {
+		t.Fatalf("Heartbeat() error = %v", err)
+	}
+	if _, err := agent.SubmitResult(ctx, &agentpb.SubmitResultRequest{TaskId: taskID, ExactResult: "6"}); err != nil {
+		t.Fatalf("SubmitResult() error = %v", err)
+	}
+	_, err = agent.Heartbeat(ctx, &agentpb.HeartbeatRequest{TaskId: taskID})
+	if status.Code(err) != codes.Aborted {
+		t.Errorf("Heartbeat() after result error = %v; want Aborted", err)
+	}
+
+	// вторая - по потоку, с уже подставленным результатом первой
+	stream, err := agent.TaskStream(ctx)
+	if err != nil {
+		t.Fatalf("TaskStream() error = %v", err)
+	}
+	stream.Send(&agentpb.AgentMessage{Kind: &agentpb.AgentMessage_Ready{Ready: &agentpb.Ready{}}})
+	msg, err := stream.Recv()
+	task := msg.GetTask()
+	if err != nil || task.GetOperation() != "+" || task.GetArgs()[0].GetValue() != "6" {
+		t.Fatalf("pushed message = %v, %v; want task 6+4", msg, err)
+	}
+
+	stream.Send(&agentpb.AgentMessage{Kind: &agentpb.AgentMessage_Heartbeat{Heartbeat: &agentpb.HeartbeatRequest{TaskId: task.GetId()}}})
+	msg, err = stream.Recv()
+	if err != nil || msg.GetHeartbeat().GetCode() != int32(codes.OK) || msg.GetHeartbeat().GetLeaseExpiresAt() == nil {
+		t.Fatalf("heartbeat reply = %v, %v; want renewed lease", msg, err)
+	}
+
+	stream.Send(&agentpb.AgentMessage{Kind: &agentpb.AgentMessage_Result{Result: &agentpb.SubmitResultRequest{TaskId: task.GetId(), ExactResult: "10"}}})
+	msg, err = stream.Recv()
+	if err != nil || msg.GetResult().GetTaskId() != task.GetId() || msg.GetResult().GetCode() != int32(codes.OK) {
+		t.Fatalf("result reply = %v, %v; want OK", msg, err)
+	}
+	stream.CloseSend()
+
+	var expression map[string]interface{}
+	c.do("GET", "/api/v1/expressions/"+created.ID, nil, &expression)
+	if expression["status"] != "completed" || expression["exact_result"] != "10" {
+		t.Errorf("expression = %v %v; want completed 10", expression["status"], expression["exact_result"])
+	}
+
+	_, err = agent.GetTask(ctx, &agentpb.GetTaskRequest{})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("GetTask() without tasks error = %v; want NotFound", err)
+	}
+}
+
+func TestAgentRegistry(t *testing.T) {
+	t.Setenv("TASK_LEASE_MS", "60000")
+	t.Setenv("LEASE_REAP_INTERVAL_MS", "20")
+	t.Setenv("AGENT_TIMEOUT_MS", "200")
+	t.Setenv("ADMIN_TOKEN", "admin-secret")
+	server, app := newApp(t)
+	c := newClient(t, server)
+	admin := &client{t: t, server: server, token: "admin-secret"}
+	agent1 := &client{t: t, server: server, agentToken: agentToken(t, "agent-1")}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.StartLeaseReaper(ctx)
+
+	if code := agent1.do("POST", "/internal/agents/agent-1/heartbeat", nil, nil); code != http.StatusNotFound {
+		t.Errorf("heartbeat before registration = %d; want 404", code)
+	}
+	registration := map[string]interface{}{
+		"id": "agent-1", "hostname": "host", "version": "1.0", "computing_power": 2, "operations": []string{"+", "*"},
+	}
+	// агент регистрируется и присылает heartbeat только под id из своего токена
+	if code := c.do("POST", "/internal/agents", registration, nil); code != http.StatusForbidden {
+		t.Errorf("register as another agent = %d; want 403", code)
+	}
+	if code := agent1.do("POST", "/internal/agents", registration, nil); code != http.StatusCreated {
+		t.Fatalf("register = %d; want 201", code)
+	}
+	if code := c.do("POST", "/internal/agents/agent-1/heartbeat", nil, nil); code != http.StatusForbidden {
+		t.Errorf("heartbeat as another agent = %d; want 403", code)
+	}
+	if code := agent1.do("POST", "/internal/agents/agent-1/heartbeat", nil, nil); code != http.StatusOK {
+		t.Errorf("heartbeat = %d; want 200", code)
+	}
+
+	var online struct {
+		Agents []models.Agent `json:"agents"`
+	}
+	c.do("GET", "/internal/agents", nil, &online)
+	if len(online.Agents) != 1 || online.Agents[0].ComputingPower != 2 || len(online.Agents[0].Operations) != 2 {
+		t.Fatalf("agents = %+v; want agent-1 with its capabilities", online.Agents)
+	}
+
+	c.do("POST", "/api/v1/calculate", map[string]string{"expression": "2+2"}, nil)
+	if code := agent1.do("GET", "/internal/task", nil, nil); code != http.StatusOK {
+		t.Fatalf("GET /internal/task as agent-1 = %d; want 200", code)
+	}
+
+	var stats struct {
+		Agents []models.Agent `json:"agents"`
+	}
+	admin.do("GET", "/admin/agents", nil, &stats)
+	if len(stats.Agents) != 1 || stats.Agents[0].TasksInFlight != 1 || stats.Agents[0].LastSeenAt.IsZero() {
+		t.Fatalf("admin agents = %+v; want agent-1 with 1 task in flight", stats.Agents)
+	}
+
+	// agent-1 больше не присылает heartbeat: его задача возвращается в очередь
+	// задолго до конца минутной аренды
+	deadline := time.Now().Add(3 * time.Second)
+	for c.runAgent() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("task of lost agent was not released")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	admin.do("GET", "/admin/agents", nil, &stats)
+	if stats.Agents[0].Status != "offline" || stats.Agents[0].TasksInFlight != 0 {
+		t.Errorf("admin agents = %+v; want offline agent-1 without tasks", stats.Agents)
+	}
+	c.do("GET", "/internal/agents", nil, &online)
+	if len(online.Agents) != 0 {
+		t.Errorf("online agents = %+v; want none", online.Agents)
+	}
+}
+
+// TestBlockedOnCreate проверяет, что выражение, которое не может посчитать
+// ни один агент на связи, получает статус blocked сразу, без проверки по таймеру
+func TestBlockedOnCreate(t *testing.T) {
+	server := newServer(t)
+	c := newClient(t, server)
+	agent := &client{t: t, server: server, agentToken: agentToken(t, "adder")}
+	registration := map[string]interface{}{"id": "adder", "computing_power": 1, "operations": []string{"+"}}
+	if code := agent.do("POST", "/internal/agents", registration, nil); code != http.StatusCreated {
+		t.Fatalf("register = %d; want 201", code)
+	}
+
+	tests := []struct {
+		expression string
+		status     string
+	}{
+		{"2+2", "pending"},
+		{"2*3", "blocked"},
+	}
+	for _, tt := range tests {
+		var created struct {
+			ID     string `json:"id"`
+			Status string `json:"status"`
+		}
+		c.do("POST", "/api/v1/calculate", map[string]string{"expression": tt.expression}, &created)
+		if created.Status != tt.status {
+			t.Errorf("calculate %q: status %q; want %q", tt.expression, created.Status, tt.status)
+		}
+		var expression map[string]interface{}
+		c.do("GET", "/api/v1/expressions/"+created.ID, nil, &expression)
+		if expression["status"] != tt.status {
+			t.Errorf("%q: status %v; want %s", tt.expression, expression["status"], tt.status)
+		}
+	}
+}
+
+func TestTaskBatch(t *testing.T) {
+	c := newClient(t, newServer(t))
+
+	for _, query := range []string{"limit=0", "limit=1000", "limit=x"} {
+		if code := c.do("GET", "/internal/tasks?"+query, nil, nil); code != http.StatusBadRequest {
+			t.Errorf("%s: status %d; want 400", query, code)
+		}
+	}
+
+	var created struct {
+		ID string `json:"id"`
+	}
+	c.do("POST", "/api/v1/calculate", map[string]string{"expression": "(1+2)*(3+4)*(5+6)"}, &created)
+
+	// готовы только три сложения, умножения ждут их результатов
+	var batch struct {
+		Tasks []models.Task `json:"tasks"`
+	}
+	if code := c.do("GET", "/internal/tasks?limit=10", nil, &batch); code != http.StatusOK || len(batch.Tasks) != 3 {
+		t.Fatalf("GET /internal/tasks?limit=10 = %d, %d tasks; want 3 tasks", code, len(batch.Tasks))
+	}
+	var empty struct {
+		Tasks []models.Task `json:"tasks"`
+	}
+	if c.do("GET", "/internal/tasks?limit=10", nil, &empty); len(empty.Tasks) != 0 {
+		t.Errorf("second batch = %d tasks; want none: all ready tasks are leased", len(empty.Tasks))
+	}
+
+	var results []map[string]interface{}
+	for _, task := range batch.Tasks {
+		value, err := calculation.ApplyMode(calculation.ModeFloat, task.Operation, []string{task.Args[0].Value, task.Args[1].Value})
+		if err != nil {
+			t.Fatalf("task %s: %v", task.ID, err)
+		}
+		results = append(results, map[string]interface{}{"id": task.ID, "exact_result": value})
+	}
+	results = append(results, map[string]interface{}{"id": "missing", "exact_result": "1"})
+
+	var replies struct {
+		Results []struct {
+			ID   string `json:"id"`
+			Code int    `json:"code"`
+		} `json:"results"`
+	}
+	if code := c.do("POST", "/internal/tasks/results", map[string]interface{}{"results": results}, &replies); code != http.StatusOK {
+		t.Fatalf("POST /internal/tasks/results = %d; want 200", code)
+	}
+	wantCodes := []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusConflict}
+	if len(replies.Results) != len(wantCodes) {
+		t.Fatalf("replies = %+v; want %d", replies.Results, len(wantCodes))
+	}
+	for i, reply := range replies.Results {
+		if reply.Code != wantCodes[i] {
+			t.Errorf("reply %d (%s) code = %d; want %d", i, reply.ID, reply.Code, wantCodes[i])
+		}
+	}
+
+	c.runAgent()
+	var expr struct {
+		Status      string `json:"status"`
+		ExactResult string `json:"exact_result"`
+	}
+	c.do("GET", "/api/v1/expressions/"+created.ID, nil, &expr)
+	if expr.Status != "completed" || expr.ExactResult != "231" {
+		t.Errorf("expression = %s %s; want completed 231", expr.Status, expr.ExactResult)
+	}
+}
+
+func TestAgentAuth(t *testing.T) {
+	server := newServer(t)
+	c := newClient(t, server)
+	other := &client{t: t, server: server, agentToken: agentToken(t, "other-agent")}
+
+	// без токена агента, с токеном пользователя, поддельным или без id агента /internal закрыт
+	for _, token := range []string{"", c.token, "not-a-token", agentToken(t, "")} {
+		intruder := &client{t: t, server: server, agentToken: token}
+		if code := intruder.do("GET", "/internal/task", nil, nil); code != http.StatusUnauthorized {
+			t.Errorf("GET /internal/task with token %q = %d; want 401", token, code)
+		}
+	}
+	// а токен агента не пускает к API пользователей
+	agentAsUser := &client{t: t, server: server, token: c.agentToken}
+	if code := agentAsUser.do("POST", "/api/v1/calculate", map[string]string{"expression": "1+1"}, nil); code != http.StatusUnauthorized {
+		t.Errorf("POST /api/v1/calculate with agent token = %d; want 401", code)
+	}
+
+	var created struct {
+		ID string `json:"id"`
+	}
+	c.do("POST", "/api/v1/calculate", map[string]string{"expression": "2+3"}, &created)
+	var response struct {
+		Task models.Task `json:"task"`
+	}
+	if code := c.do("GET", "/internal/task", nil, &response); code != http.StatusOK {
+		t.Fatalf("GET /internal/task = %d; want 200", code)
+	}
+
+	// результат и продление аренды принимаются только от агента, за которым задача
+	forged := map[string]interface{}{"id": response.Task.ID, "exact_result": "100"}
+	if code := other.do("POST", "/internal/task/result", forged, nil); code != http.StatusConflict {
+		t.Errorf("forged result = %d; want 409", code)
+	}
+	if code := other.do("POST", "/internal/task/lease", map[string]string{"id": response.Task.ID}, nil); code != http.StatusConflict {
+		t.Errorf("lease renewal by another agent = %d; want 409", code)
+	}
+	result := map[string]interface{}{"id": response.Task.ID, "exact_result": "5"}
+	if code := c.do("POST", "/internal/task/result", result, nil); code != http.StatusOK {
+		t.Errorf("result = %d; want 200", code)
+	}
+
+	var expression map[string]interface{}
+	c.do("GET", "/api/v1/expressions/"+created.ID, nil, &expression)
+	if expression["exact_result"] != "5" {
+		t.Errorf("exact_result = %v; want 5", expression["exact_result"])
+	}
+}
+
+// writeCert пишет сертификат и ключ в dir, как команда admin dev-ca
+func writeCert(t *testing.T, dir, name string, certPEM, keyPEM []byte) (string, string) {
+	t.Helper()
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	if err := os.WriteFile(certFile, certPEM, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestAgentMTLS(t *testing.T) {
+	server := newServer(t)
+	c := newClient(t, server)
+
+	dir := t.TempDir()
+	ca, err := mtls.NewAuthority("test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile, _ := writeCert(t, dir, "ca", ca.CertPEM, ca.KeyPEM)
+	certPEM, keyPEM, err := ca.IssueServer("orchestrator", []string{"127.0.0.1"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, serverKey := writeCert(t, dir, "orchestrator", certPEM, keyPEM)
+	certPEM, keyPEM, err = ca.IssueAgent("cert-agent", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentCert, agentKey := writeCert(t, dir, "cert-agent", certPEM, keyPEM)
+
+	// отдельный listener для /internal, как в cmd/orchestrator с TLS_CA_FILE
+	serverTLS, err := mtls.ServerConfig(caFile, serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsServer := httptest.NewUnstartedServer(server.Config.Handler)
+	tlsServer.TLS = serverTLS
+	tlsServer.StartTLS()
+	t.Cleanup(tlsServer.Close)
+
+	clientTLS, err := mtls.ClientConfig(caFile, agentCert, agentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// агент с сертификатом обходится без токена
+	agent := &client{
+		t:          t,
+		server:     tlsServer,
+		httpClient: &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}},
+	}
+
+	// id агента берётся из сертификата, чужой id в теле запроса не принимается
+	if code := agent.do("POST", "/internal/agents", map[string]interface{}{"id": "someone-else"}, nil); code != http.StatusForbidden {
+		t.Errorf("register as another agent = %d; want 403", code)
+	}
+	if code := agent.do("POST", "/internal/agents", map[string]interface{}{"id": "cert-agent", "computing_power": 1}, nil); code != http.StatusCreated {
+		t.Fatalf("register = %d; want 201", code)
+	}
+
+	var created struct {
+		ID string `json:"id"`
+	}
+	c.do("POST", "/api/v1/calculate", map[string]string{"expression": "2+3"}, &created)
+	if done := agent.runAgent(); done != 1 {
+		t.Fatalf("agent ran %d tasks; want 1", done)
+	}
+
+	var expression map[string]interface{}
+	c.do("GET", "/api/v1/expressions/"+created.ID, nil, &expression)
+	if expression["exact_result"] != "5" {
+		t.Errorf("exact_result = %v; want 5", expression["exact_result"])
+	}
+
+	var agents struct {
+		Agents []models.Agent `json:"agents"`
+	}
+	agent.do("GET", "/internal/agents", nil, &agents)
+	if len(agents.Agents) != 1 || agents.Agents[0].ID != "cert-agent" {
+		t.Errorf("agents = %+v; want cert-agent", agents.Agents)
+	}
+
+	// без сертификата к TLS listener'у не подключиться
+	noCert := clientTLS.Clone()
+	noCert.Certificates = nil
+	plain := &http.Client{Transport: &http.Transport{TLSClientConfig: noCert}}
+	if resp, err := plain.Get(tlsServer.URL + "/internal/task"); err == nil {
+		resp.Body.Close()
+		t.Error("GET /internal/task without client certificate succeeded")
+	}
+}
@@ -0,0 +1,136 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/zalhui/calc_golang/internal/common/models"
+	"github.com/zalhui/calc_golang/pkg/calculation"
+)
+
+// agentID - id агента из его токена AGENT_TOKEN или, в режиме mTLS, из
+// сертификата: под ним оркестратор знает агента и записывает за ним задачи,
+// которые считают все его воркеры
+var agentID string
+
+// tokenAgentID достаёт id агента из токена. Подпись проверяет оркестратор,
+// агенту секрет не нужен.
+func tokenAgentID(token string) string {
+	if token == "" {
+		return ""
+	}
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(token, claims); err != nil {
+		log.Printf("Error parsing AGENT_TOKEN: %v", err)
+		return ""
+	}
+	id, _ := claims["agent_id"].(string)
+	return id
+}
+
+// authorization - заголовок Authorization для запросов к оркестратору
+func authorization() string {
+	return "Bearer " + cfg().AgentToken
+}
+
+// Version - версия агента, которую он сообщает оркестратору при регистрации.
+// Задаётся при сборке: -ldflags "-X github.com/zalhui/calc_golang/internal/agent/worker.Version=1.0.0"
+var Version = "dev"
+
+// errAgentUnknown - оркестратор не знает агента, например потерял базу
+var errAgentUnknown = errors.New("agent is not registered")
+
+// registry - то, как агент регистрируется у оркестратора и сообщает, что жив
+type registry interface {
+	register(ctx context.Context, info agentInfo) error
+	// heartbeat возвращает errAgentUnknown, если нужно зарегистрироваться снова
+	heartbeat(ctx context.Context) error
+}
+
+// agentInfo - то, что агент сообщает о себе при регистрации
+type agentInfo struct {
+	ID             string `json:"id"`
+	Hostname       string `json:"hostname"`
+	Version        string `json:"version"`
+	ComputingPower int    `json:"computing_power"`
+	models.Capabilities
+}
+
+// StartHeartbeat регистрирует агента у оркестратора и каждые HeartbeatInterval
+// сообщает, что он жив. Агент без heartbeat дольше AGENT_TIMEOUT_MS оркестратор
+// считает потерянным и отдаёт его задачи другим. Останавливается, когда отменяют ctx.
+func StartHeartbeat(ctx context.Context) {
+	var reg registry = httpTransport{agentID: agentID}
+	if strings.HasPrefix(cfg().AgentTransport, "grpc") {
+		reg = newGRPCTransport()
+	}
+
+	operations := cfg().AgentOperations
+	if len(operations) == 0 {
+		operations = calculation.Operations()
+	}
+	hostname, _ := os.Hostname()
+	info := agentInfo{
+		ID:             agentID,
+		Hostname:       hostname,
+		Version:        Version,
+		ComputingPower: cfg().ComputingPower,
+		Capabilities: models.Capabilities{
+			Operations:     operations,
+			Modes:          cfg().AgentModes,
+			MaxOperandSize: cfg().MaxOperandSize,
+		},
+	}
+
+	registered := false
+	for ctx.Err() == nil {
+		if !registered {
+			if err := reg.register(ctx, info); err != nil {
+				log.Printf("Error registering agent %s: %v", agentID, err)
+			} else {
+				log.Printf("Agent %s registered with orchestrator", agentID)
+				registered = true
+			}
+		} else if err := reg.heartbeat(ctx); errors.Is(err, errAgentUnknown) {
+			log.Printf("Orchestrator does not know agent %s, registering again", agentID)
+			registered = false
+			continue
+		} else if err != nil {
+			log.Printf("Error sending heartbeat: %v", err)
+		}
+		sleep(ctx, cfg().HeartbeatInterval)
+	}
+}
+
+func (t httpTransport) register(ctx context.Context, info agentInfo) error {
+	resp, err := t.post(ctx, "/internal/agents", info)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (t httpTransport) heartbeat(ctx context.Context) error {
+	resp, err := t.post(ctx, "/internal/agents/"+t.agentID+"/heartbeat", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return errAgentUnknown
+	}
+	return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+}
@@ -0,0 +1,242 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/zalhui/calc_golang/internal/common/models"
+)
+
+// maxResultBatch - больше результатов оркестратор не принимает одним запросом
+const maxResultBatch = 100
+
+// runBatches заполняет пул из cfg().ComputingPower воркеров задачами одного
+// запроса GET /internal/tasks: агент просит столько задач, сколько у него
+// свободных воркеров. Результаты уходят пачками через POST /internal/tasks/results.
+// Задачи запрашиваются, пока не отменят ctx, а считаются в work.
+func runBatches(ctx, work context.Context, t httpTransport) {
+	// результаты отправляются, пока не досчитает последний воркер
+	resultsCtx, stopResults := context.WithCancel(context.WithoutCancel(ctx))
+	defer stopResults()
+	results := &resultBatcher{t: t, queue: make(chan pendingResult)}
+	go results.run(resultsCtx)
+	bt := batchTransport{httpTransport: t, results: results}
+
+	// слот - свободный воркер
+	workers := cfg().ComputingPower
+	slots := make(chan struct{}, workers)
+	releaseSlots(slots, workers)
+
+	for {
+		free := acquireSlots(ctx, slots)
+		if free == 0 {
+			break
+		}
+		tasks, err := t.fetchTasks(ctx, free)
+		if err != nil {
+			releaseSlots(slots, free)
+			if ctx.Err() == nil {
+				log.Printf("Error getting tasks: %v", err)
+				sleep(ctx, cfg().PollInterval)
+			}
+			continue
+		}
+		if len(tasks) == 0 {
+			releaseSlots(slots, free)
+			if cfg().TaskWait <= 0 {
+				log.Printf("No tasks found, waiting for %s...", cfg().PollInterval)
+				sleep(ctx, cfg().PollInterval)
+			}
+			continue
+		}
+		if ctx.Err() != nil {
+			// задачи пришли, когда агент уже останавливался
+			for _, task := range tasks {
+				releaseTask(ctx, bt, task.ID)
+			}
+			releaseSlots(slots, free)
+			break
+		}
+
+		releaseSlots(slots, free-len(tasks))
+		for _, task := range tasks {
+			go func() {
+				defer func() { slots <- struct{}{} }()
+				processTask(work, bt, task)
+			}()
+		}
+	}
+
+	// воркеры досчитали, когда все слоты снова свободны
+	for i := 0; i < workers; i++ {
+		<-slots
+	}
+}
+
+// acquireSlots ждёт хотя бы один свободный слот и забирает все свободные.
+// Если раньше отменили ctx, возвращает 0.
+func acquireSlots(ctx context.Context, slots chan struct{}) int {
+	select {
+	case <-slots:
+	case <-ctx.Done():
+		return 0
+	}
+	free := 1
+	for {
+		select {
+		case <-slots:
+			free++
+		default:
+			return free
+		}
+	}
+}
+
+func releaseSlots(slots chan struct{}, n int) {
+	for i := 0; i < n; i++ {
+		slots <- struct{}{}
+	}
+}
+
+// batchTransport продлевает аренду отдельными запросами, а результаты
+// отдаёт resultBatcher, чтобы отправить их вместе с результатами других воркеров
+type batchTransport struct {
+	httpTransport
+	results *resultBatcher
+}
+
+func (t batchTransport) submit(ctx context.Context, res models.TaskResult) error {
+	return t.results.submit(ctx, res)
+}
+
+// pendingResult - результат, который ждёт отправки, и канал для ответа оркестратора
+type pendingResult struct {
+	res  models.TaskResult
+	done chan error
+}
+
+// resultBatcher отправляет результаты воркеров пачками: пока идёт один запрос,
+// следующие результаты копятся и уходят следующим
+type resultBatcher struct {
+	t     httpTransport
+	queue chan pendingResult
+}
+
+// submit ставит результат в очередь и ждёт ответа оркестратора на него,
+// пока не отменят ctx
+func (b *resultBatcher) submit(ctx context.Context, res models.TaskResult) error {
+	done := make(chan error, 1)
+	select {
+	case b.queue <- pendingResult{res: res, done: done}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run отправляет результаты из очереди, пока не отменят ctx
+func (b *resultBatcher) run(ctx context.Context) {
+	for {
+		var batch []pendingResult
+		select {
+		case p := <-b.queue:
+			batch = append(batch, p)
+		case <-ctx.Done():
+			return
+		}
+	collect:
+		for len(batch) < maxResultBatch {
+			select {
+			case p := <-b.queue:
+				batch = append(batch, p)
+			default:
+				break collect
+			}
+		}
+
+		results := make([]models.TaskResult, 0, len(batch))
+		for _, p := range batch {
+			results = append(results, p.res)
+		}
+		errs, err := b.t.submitResults(ctx, results)
+		for i, p := range batch {
+			if err != nil {
+				p.done <- err
+			} else {
+				p.done <- errs[i]
+			}
+		}
+	}
+}
+
+// fetchTasks запрашивает до limit задач, ожидая их до cfg().TaskWait
+func (t httpTransport) fetchTasks(ctx context.Context, limit int) ([]models.Task, error) {
+	url := cfg().OrchestratorURL + "/internal/tasks?limit=" + strconv.Itoa(limit)
+	if cfg().TaskWait > 0 {
+		url += "&wait=" + cfg().TaskWait.String()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", authorization())
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var response struct {
+		Tasks []models.Task `json:"tasks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("error decoding tasks response: %w", err)
+	}
+	return response.Tasks, nil
+}
+
+// submitResults отправляет результаты одним запросом и возвращает ошибку
+// для каждого из них, как submit
+func (t httpTransport) submitResults(ctx context.Context, results []models.TaskResult) ([]error, error) {
+	resp, err := t.post(ctx, "/internal/tasks/results", map[string]interface{}{"results": results})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var response struct {
+		Results []struct {
+			ID   string `json:"id"`
+			Code int    `json:"code"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("error decoding results response: %w", err)
+	}
+	if len(response.Results) != len(results) {
+		return nil, fmt.Errorf("got %d replies for %d results", len(response.Results), len(results))
+	}
+
+	errs := make([]error, len(results))
+	for i, reply := range response.Results {
+		errs[i] = statusError(reply.Code)
+	}
+	return errs, nil
+}
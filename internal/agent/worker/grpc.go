@@ -0,0 +1,302 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/zalhui/calc_golang/internal/common/agentpb"
+	"github.com/zalhui/calc_golang/internal/common/models"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcConn - одно соединение на всех воркеров агента, gRPC сам распределяет по нему вызовы
+var grpcConn = sync.OnceValue(func() *grpc.ClientConn {
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	conn, err := grpc.NewClient(cfg().OrchestratorGRPCAddr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		log.Fatalf("Failed to create gRPC client: %v", err)
+	}
+	return conn
+})
+
+// runGRPC говорит с оркестратором по gRPC, пока не отменят ctx: отдельными
+// вызовами, как по HTTP, или, при AGENT_TRANSPORT=grpc-stream, по постоянному
+// потоку TaskStream
+func runGRPC(ctx, work context.Context) {
+	t := newGRPCTransport()
+	if cfg().AgentTransport != "grpc-stream" {
+		pollTasks(ctx, work, t)
+		return
+	}
+	for {
+		err := serveTaskStream(ctx, work, t.client)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("gRPC stream closed: %v, reconnecting in %s...", err, cfg().PollInterval)
+		if !sleep(ctx, cfg().PollInterval) {
+			return
+		}
+	}
+}
+
+// grpcTransport - вызовы GetTask, Heartbeat и SubmitResult
+type grpcTransport struct {
+	client agentpb.AgentClient
+}
+
+func newGRPCTransport() grpcTransport {
+	return grpcTransport{client: agentpb.NewAgentClient(grpcConn())}
+}
+
+// outgoing добавляет к ctx токен агента: он уходит с каждым вызовом, как заголовок Authorization
+func outgoing(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "authorization", authorization())
+}
+
+func (t grpcTransport) fetchTask(ctx context.Context) (*models.Task, error) {
+	resp, err := t.client.GetTask(outgoing(ctx), &agentpb.GetTaskRequest{Wait: durationpb.New(cfg().TaskWait)})
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fromTaskMessage(resp.GetTask()), nil
+}
+
+func (t grpcTransport) renewLease(ctx context.Context, taskID string) (time.Time, error) {
+	resp, err := t.client.Heartbeat(outgoing(ctx), &agentpb.HeartbeatRequest{TaskId: taskID})
+	if err != nil {
+		return time.Time{}, codeError(status.Code(err), err)
+	}
+	return fromTimestamp(resp.GetLeaseExpiresAt()), nil
+}
+
+func (t grpcTransport) submit(ctx context.Context, res models.TaskResult) error {
+	_, err := t.client.SubmitResult(outgoing(ctx), resultMessage(res))
+	if err != nil {
+		return codeError(status.Code(err), err)
+	}
+	return nil
+}
+
+func (t grpcTransport) register(ctx context.Context, info agentInfo) error {
+	_, err := t.client.Register(outgoing(ctx), &agentpb.RegisterRequest{
+		Hostname:       info.Hostname,
+		Version:        info.Version,
+		ComputingPower: int32(info.ComputingPower),
+		Operations:     info.Operations,
+		Modes:          info.Modes,
+		MaxOperandSize: int32(info.MaxOperandSize),
+	})
+	return err
+}
+
+func (t grpcTransport) heartbeat(ctx context.Context) error {
+	_, err := t.client.AgentHeartbeat(outgoing(ctx), &agentpb.AgentHeartbeatRequest{})
+	if status.Code(err) == codes.NotFound {
+		return errAgentUnknown
+	}
+	return err
+}
+
+// streamTransport - поток TaskStream. Как и у wsTransport, задачи приходят
+// по нему сами, а ответы на heartbeat и result находят запрос по типу и id задачи.
+type streamTransport struct {
+	stream agentpb.Agent_TaskStreamClient
+	sendMu sync.Mutex
+
+	tasks chan *agentpb.Task
+
+	mu      sync.Mutex
+	replies map[string]chan *agentpb.Reply
+
+	closed chan struct{} // закрывается, когда поток оборвался
+	err    error
+}
+
+// serveTaskStream просит у оркестратора задачи по одной, пока поток открыт
+// и не отменили ctx, и считает их в work
+func serveTaskStream(ctx, work context.Context, client agentpb.AgentClient) error {
+	// поток нужен и после ctx: по нему уходят результаты и возвращаются задачи
+	streamCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+
+	stream, err := client.TaskStream(outgoing(streamCtx))
+	if err != nil {
+		return err
+	}
+
+	t := &streamTransport{
+		stream:  stream,
+		tasks:   make(chan *agentpb.Task, 1),
+		replies: make(map[string]chan *agentpb.Reply),
+		closed:  make(chan struct{}),
+	}
+	go t.recvLoop()
+
+	for ctx.Err() == nil {
+		if err := t.send(&agentpb.AgentMessage{Kind: &agentpb.AgentMessage_Ready{Ready: &agentpb.Ready{}}}); err != nil {
+			return err
+		}
+		select {
+		case task := <-t.tasks:
+			processTask(work, t, *fromTaskMessage(task))
+		case <-t.closed:
+			return t.err
+		case <-ctx.Done():
+			// оркестратор мог успеть ответить на ready задачей
+			select {
+			case task := <-t.tasks:
+				releaseTask(ctx, t, task.GetId())
+			default:
+			}
+		}
+	}
+	return nil
+}
+
+// recvLoop разбирает сообщения оркестратора, пока поток не оборвётся
+func (t *streamTransport) recvLoop() {
+	for {
+		msg, err := t.stream.Recv()
+		if err != nil {
+			t.err = err
+			close(t.closed)
+			return
+		}
+
+		switch kind := msg.Kind.(type) {
+		case *agentpb.OrchestratorMessage_Task:
+			t.tasks <- kind.Task
+		case *agentpb.OrchestratorMessage_Heartbeat:
+			t.reply("heartbeat", kind.Heartbeat)
+		case *agentpb.OrchestratorMessage_Result:
+			t.reply("result", kind.Result)
+		default:
+			log.Printf("Unexpected message from orchestrator: %v", msg)
+		}
+	}
+}
+
+// reply передаёт ответ оркестратора тому, кто его ждёт
+func (t *streamTransport) reply(msgType string, msg *agentpb.Reply) {
+	key := msgType + ":" + msg.GetTaskId()
+	t.mu.Lock()
+	reply := t.replies[key]
+	delete(t.replies, key)
+	t.mu.Unlock()
+	if reply != nil {
+		reply <- msg
+	}
+}
+
+func (t *streamTransport) send(msg *agentpb.AgentMessage) error {
+	t.sendMu.Lock()
+	defer t.sendMu.Unlock()
+	return t.stream.Send(msg)
+}
+
+// request отправляет сообщение msg типа msgType о задаче taskID и ждёт ответа на него
+func (t *streamTransport) request(ctx context.Context, msgType, taskID string, msg *agentpb.AgentMessage) (*agentpb.Reply, error) {
+	key := msgType + ":" + taskID
+	reply := make(chan *agentpb.Reply, 1)
+	t.mu.Lock()
+	t.replies[key] = reply
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.replies, key)
+		t.mu.Unlock()
+	}()
+
+	if err := t.send(msg); err != nil {
+		return nil, err
+	}
+
+	select {
+	case msg := <-reply:
+		return msg, codeError(codes.Code(msg.GetCode()), errors.New(msg.GetError()))
+	case <-t.closed:
+		return nil, t.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(wsReplyTimeout):
+		return nil, errors.New("no reply from orchestrator")
+	}
+}
+
+func (t *streamTransport) renewLease(ctx context.Context, taskID string) (time.Time, error) {
+	msg := &agentpb.AgentMessage{Kind: &agentpb.AgentMessage_Heartbeat{Heartbeat: &agentpb.HeartbeatRequest{TaskId: taskID}}}
+	reply, err := t.request(ctx, "heartbeat", taskID, msg)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fromTimestamp(reply.GetLeaseExpiresAt()), nil
+}
+
+func (t *streamTransport) submit(ctx context.Context, res models.TaskResult) error {
+	msg := &agentpb.AgentMessage{Kind: &agentpb.AgentMessage_Result{Result: resultMessage(res)}}
+	_, err := t.request(ctx, "result", res.ID, msg)
+	return err
+}
+
+// codeError переводит код gRPC в ошибку, как statusError - код HTTP
+func codeError(code codes.Code, err error) error {
+	switch code {
+	case codes.OK:
+		return nil
+	case codes.Aborted:
+		return errLeaseLost
+	case codes.FailedPrecondition:
+		return errTaskCancelled
+	}
+	return err
+}
+
+func resultMessage(res models.TaskResult) *agentpb.SubmitResultRequest {
+	return &agentpb.SubmitResultRequest{
+		TaskId:      res.ID,
+		Result:      res.Result,
+		ExactResult: res.ExactResult,
+		Error:       res.Error,
+		ErrorClass:  res.ErrorClass,
+	}
+}
+
+func fromTaskMessage(msg *agentpb.Task) *models.Task {
+	task := &models.Task{
+		ID:             msg.GetId(),
+		ExpressionID:   msg.GetExpressionId(),
+		Operation:      msg.GetOperation(),
+		Mode:           msg.GetMode(),
+		LeaseExpiresAt: fromTimestamp(msg.GetLeaseExpiresAt()),
+		Attempts:       int(msg.GetAttempts()),
+	}
+	for _, arg := range msg.GetArgs() {
+		task.Args = append(task.Args, models.Operand{Value: arg.GetValue(), TaskID: arg.GetTaskId()})
+	}
+	return task
+}
+
+// fromTimestamp - как AsTime, только без срока получается нулевое время, а не 1970 год
+func fromTimestamp(ts *timestamppb.Timestamp) time.Time {
+	if ts == nil {
+		return time.Time{}
+	}
+	return ts.AsTime()
+}
@@ -0,0 +1,67 @@
+package worker
+
+import (
+	"crypto/tls"
+	"log"
+	"net/http"
+
+	"github.com/zalhui/calc_golang/config"
+	"github.com/zalhui/calc_golang/internal/mtls"
+)
+
+var (
+	// tlsConfig - сертификат агента для mTLS, nil - агент ходит к оркестратору
+	// без TLS и представляется токеном
+	tlsConfig *tls.Config
+	// httpClient - клиент для /internal, с сертификатом агента в режиме mTLS
+	httpClient = http.DefaultClient
+)
+
+// Setup применяет настройки агента. main вызывает её после загрузки настроек,
+// до StartHeartbeat и StartWorker.
+func Setup(c *config.Config) {
+	settings.Store(c)
+	tlsConfig = loadTLSConfig()
+	httpClient = newHTTPClient()
+	if tlsConfig != nil {
+		agentID = certAgentID()
+	} else {
+		agentID = tokenAgentID(cfg().AgentToken)
+	}
+}
+
+// ApplyConfig подписывается на перезагрузку настроек: время операций, паузы
+// и ожидание задач меняются без перезапуска агента
+func ApplyConfig(c *config.Config) {
+	settings.Store(c)
+}
+
+func loadTLSConfig() *tls.Config {
+	if !cfg().MTLSEnabled() {
+		return nil
+	}
+	tlsCfg, err := mtls.ClientConfig(cfg().TLSCAFile, cfg().TLSCertFile, cfg().TLSKeyFile)
+	if err != nil {
+		log.Fatalf("Failed to load TLS config: %v", err)
+	}
+	return tlsCfg
+}
+
+func newHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsConfig != nil {
+		// http.Transport дописывает в конфиг h2, поэтому у него своя копия
+		transport.TLSClientConfig = tlsConfig.Clone()
+	}
+	return &http.Client{Transport: transport, Timeout: cfg().HTTPClientTimeout}
+}
+
+// certAgentID - id агента из CN его сертификата
+func certAgentID() string {
+	id, err := mtls.CertAgentID(cfg().TLSCertFile)
+	if err != nil {
+		log.Printf("Error reading agent id from TLS_CERT_FILE: %v", err)
+		return ""
+	}
+	return id
+}
@@ -0,0 +1,186 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/zalhui/calc_golang/internal/common/models"
+)
+
+// wsReplyTimeout - сколько ждать ответа оркестратора на lease и result
+const wsReplyTimeout = 10 * time.Second
+
+// wsMessage - сообщение оркестратора, формат описан у AgentWebSocketHandler
+type wsMessage struct {
+	Type           string      `json:"type"`
+	ID             string      `json:"id"`
+	Code           int         `json:"code"`
+	Error          string      `json:"error"`
+	LeaseExpiresAt time.Time   `json:"lease_expires_at"`
+	Task           models.Task `json:"task"`
+}
+
+// wsTransport - постоянное соединение с оркестратором. Задачи приходят по нему
+// сами, а ответы на lease и result находят запрос по типу и id задачи.
+type wsTransport struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+
+	tasks chan models.Task
+
+	mu      sync.Mutex
+	replies map[string]chan wsMessage
+
+	closed chan struct{} // закрывается, когда соединение оборвалось
+	err    error
+}
+
+// runWebSocket держит соединение с оркестратором, пока не отменят ctx,
+// и переподключается, если оно оборвалось
+func runWebSocket(ctx, work context.Context) {
+	for {
+		err := serveWebSocket(ctx, work)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("WebSocket connection closed: %v, reconnecting in %s...", err, cfg().PollInterval)
+		if !sleep(ctx, cfg().PollInterval) {
+			return
+		}
+	}
+}
+
+// serveWebSocket просит у оркестратора задачи по одной, пока соединение открыто
+// и не отменили ctx, и считает их в work
+func serveWebSocket(ctx, work context.Context) error {
+	header := http.Header{}
+	header.Set("Authorization", authorization())
+	url := "ws" + strings.TrimPrefix(cfg().OrchestratorURL, "http") + "/internal/ws"
+	dialer := *websocket.DefaultDialer
+	if tlsConfig != nil {
+		dialer.TLSClientConfig = tlsConfig.Clone()
+	}
+	conn, _, err := dialer.DialContext(ctx, url, header)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	t := &wsTransport{
+		conn:    conn,
+		tasks:   make(chan models.Task, 1),
+		replies: make(map[string]chan wsMessage),
+		closed:  make(chan struct{}),
+	}
+	go t.readLoop()
+
+	for ctx.Err() == nil {
+		if err := t.send(map[string]string{"type": "ready"}); err != nil {
+			return err
+		}
+		select {
+		case task := <-t.tasks:
+			processTask(work, t, task)
+		case <-t.closed:
+			return t.err
+		case <-ctx.Done():
+			// оркестратор мог успеть ответить на ready задачей
+			select {
+			case task := <-t.tasks:
+				releaseTask(ctx, t, task.ID)
+			default:
+			}
+		}
+	}
+	return nil
+}
+
+// readLoop разбирает сообщения оркестратора, пока соединение не оборвётся
+func (t *wsTransport) readLoop() {
+	for {
+		var msg wsMessage
+		if err := t.conn.ReadJSON(&msg); err != nil {
+			t.err = err
+			close(t.closed)
+			return
+		}
+
+		switch msg.Type {
+		case "task":
+			t.tasks <- msg.Task
+		case "lease", "result":
+			t.mu.Lock()
+			reply := t.replies[msg.Type+":"+msg.ID]
+			delete(t.replies, msg.Type+":"+msg.ID)
+			t.mu.Unlock()
+			if reply != nil {
+				reply <- msg
+			}
+		default:
+			log.Printf("Unexpected message from orchestrator: %+v", msg)
+		}
+	}
+}
+
+func (t *wsTransport) send(data interface{}) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	return t.conn.WriteJSON(data)
+}
+
+// request отправляет сообщение msg типа msgType о задаче taskID и ждёт ответа на него
+func (t *wsTransport) request(ctx context.Context, msgType, taskID string, msg interface{}) (wsMessage, error) {
+	key := msgType + ":" + taskID
+	reply := make(chan wsMessage, 1)
+	t.mu.Lock()
+	t.replies[key] = reply
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.replies, key)
+		t.mu.Unlock()
+	}()
+
+	if err := t.send(msg); err != nil {
+		return wsMessage{}, err
+	}
+
+	select {
+	case msg := <-reply:
+		return msg, nil
+	case <-t.closed:
+		return wsMessage{}, t.err
+	case <-ctx.Done():
+		return wsMessage{}, ctx.Err()
+	case <-time.After(wsReplyTimeout):
+		return wsMessage{}, errors.New("no reply from orchestrator")
+	}
+}
+
+func (t *wsTransport) renewLease(ctx context.Context, taskID string) (time.Time, error) {
+	msg, err := t.request(ctx, "lease", taskID, map[string]string{"type": "lease", "id": taskID})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := statusError(msg.Code); err != nil {
+		return time.Time{}, err
+	}
+	return msg.LeaseExpiresAt, nil
+}
+
+func (t *wsTransport) submit(ctx context.Context, res models.TaskResult) error {
+	msg, err := t.request(ctx, "result", res.ID, struct {
+		Type string `json:"type"`
+		models.TaskResult
+	}{"result", res})
+	if err != nil {
+		return err
+	}
+	return statusError(msg.Code)
+}
@@ -2,12 +2,14 @@ package worker
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"strconv"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/zalhui/calc_golang/config"
@@ -15,205 +17,366 @@ import (
 	"github.com/zalhui/calc_golang/pkg/calculation"
 )
 
-var cfg = config.LoadConfig()
+// settings - настройки агента: задаются Setup и меняются при перезагрузке (ApplyConfig)
+var settings atomic.Pointer[config.Config]
 
-//httpClient = &http.Client{Timeout: 30 * time.Second}
+func init() {
+	settings.Store(&config.Config{})
+}
 
-type TaskResponse struct {
-	Task models.Task `json:"task"`
+// cfg возвращает текущие настройки агента
+func cfg() *config.Config {
+	return settings.Load()
 }
 
-func StartWorker() {
-	for {
-		resp, err := http.Get("http://localhost:8080/internal/task")
-		if err != nil {
-			log.Printf("Error getting task: %v", err)
-			time.Sleep(time.Second)
-			continue
-		}
+// minRenewInterval - не продлеваем аренду чаще, даже если до её конца осталось мало
+const minRenewInterval = 100 * time.Millisecond
 
-		if resp.StatusCode == http.StatusOK {
-			var response TaskResponse
-			if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-				log.Printf("Error decoding task response: %v", err)
-				continue
-			}
-			task := response.Task
-			log.Printf("Received task: ID=%s, ExpressionID=%s, Arg1=%s, Arg2=%s, Operation=%s, Status=%s",
-				task.ID, task.ExpressionID, task.Arg1, task.Arg2, task.Operation, task.Status)
+// releaseTimeout - сколько останавливающийся агент ждёт оркестратора, возвращая ему задачу
+const releaseTimeout = 5 * time.Second
 
-			if task.ID == "" || task.Operation == "" || task.Arg1 == "" || task.Arg2 == "" {
-				log.Printf("Received invalid task with empty fields: %+v", task)
-				continue
-			}
+var (
+	// errLeaseLost - оркестратор ответил, что задача уже не числится за агентом
+	errLeaseLost = errors.New("task lease lost")
+	// errTaskCancelled - пользователь отменил выражение, результат задачи не нужен
+	errTaskCancelled = errors.New("task cancelled")
+)
 
-			arg1, err := resolveArg(task.Arg1)
-			if err != nil {
-				log.Printf("Error resolving arg1 for task %s: %v", task.ID, err)
-				submitError(task.ID, err.Error())
-				continue
-			}
-			log.Printf("Resolved arg1 for task %s: %f", task.ID, arg1)
+// transport - то, как агент говорит с оркестратором после получения задачи:
+// отдельными HTTP-запросами или по постоянному соединению WebSocket
+type transport interface {
+	// renewLease продлевает аренду задачи и возвращает её новый срок
+	renewLease(ctx context.Context, taskID string) (time.Time, error)
+	// submit отправляет результат или ошибку задачи
+	submit(ctx context.Context, res models.TaskResult) error
+}
 
-			arg2, err := resolveArg(task.Arg2)
-			if err != nil {
-				log.Printf("Error resolving arg2 for task %s: %v", task.ID, err)
-				submitError(task.ID, err.Error())
-				continue
-			}
-			log.Printf("Resolved arg2 for task %s: %f", task.ID, arg2)
+// poller - транспорт, по которому агент сам запрашивает задачи
+type poller interface {
+	transport
+	// fetchTask запрашивает задачу, ожидая её до cfg().TaskWait. Нет задачи - nil.
+	fetchTask(ctx context.Context) (*models.Task, error)
+}
 
-			result, err := performOperation(arg1, arg2, task.Operation)
-			if err != nil {
-				log.Printf("Error performing operation for task %s: %v", task.ID, err)
-				submitError(task.ID, err.Error())
-			} else {
-				log.Printf("Operation completed for task %s: %s %f %s %f = %f",
-					task.ID, task.Arg1, arg1, task.Operation, arg2, result)
-				submitResult(task.ID, result)
-			}
-		} else if resp.StatusCode == http.StatusNotFound {
-			log.Println("No tasks found, waiting for 1 second...")
-			time.Sleep(time.Second)
-		} else {
-			log.Printf("Unexpected status code: %d", resp.StatusCode)
-			time.Sleep(time.Second)
-		}
+// StartWorker запускает cfg().ComputingPower воркеров, которые получают задачи
+// от оркестратора и считают их. AGENT_TRANSPORT=websocket переключает агента
+// на постоянные соединения, grpc и grpc-stream - на gRPC, у каждого воркера
+// своё. По умолчанию задачи для всех воркеров запрашиваются одним долгим
+// опросом GET /internal/tasks?limit=...&wait=...
+//
+// Когда ctx отменяют, агент перестаёт брать задачи и досчитывает начатые,
+// но не дольше cfg().ShutdownTimeout. Задачи, которые он не успел досчитать
+// или получил, но не начал, он возвращает оркестратору. StartWorker
+// возвращается, когда остановились все воркеры.
+func StartWorker(ctx context.Context) {
+	work, cancel := drainContext(ctx)
+	defer cancel()
+
+	switch cfg().AgentTransport {
+	case "websocket":
+		startPool(ctx, work, runWebSocket)
+	case "grpc", "grpc-stream":
+		startPool(ctx, work, runGRPC)
+	default:
+		runBatches(ctx, work, httpTransport{agentID: agentID})
 	}
 }
 
-func resolveArg(arg string) (float64, error) {
-	if isPlaceholder(arg) {
-		taskID := strings.TrimSuffix(strings.TrimPrefix(arg, "task_"), "_result")
-		log.Printf("Resolving placeholder %s for task %s", arg, taskID)
-		result, err := waitForTaskResult(taskID)
-		if err != nil {
-			log.Printf("Failed to resolve placeholder %s: %v", arg, err)
-			return 0, err
-		}
-		return result, nil
+// drainContext возвращает контекст, в котором считаются задачи: его отменяют
+// через cfg().ShutdownTimeout после ctx, и задачи, которые не успели, прерываются
+func drainContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	work, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, func() {
+		log.Printf("Stopping agent, waiting up to %s for running tasks...", cfg().ShutdownTimeout)
+		time.AfterFunc(cfg().ShutdownTimeout, cancel)
+	})
+	return work, func() {
+		stop()
+		cancel()
 	}
+}
 
-	result, err := strconv.ParseFloat(arg, 64)
-	if err != nil {
-		log.Printf("Failed to parse argument %s as float64: %v", arg, err)
-		return 0, err
+// startPool запускает cfg().ComputingPower воркеров run и ждёт их
+func startPool(ctx, work context.Context, run func(ctx, work context.Context)) {
+	var wg sync.WaitGroup
+	for i := 0; i < cfg().ComputingPower; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run(ctx, work)
+		}()
 	}
-	return result, nil
+	wg.Wait()
 }
 
-func isPlaceholder(arg string) bool {
-	return strings.HasPrefix(arg, "task_") && strings.HasSuffix(arg, "_result")
+// sleep ждёт d и возвращает false, если раньше отменили ctx
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
 }
-func waitForTaskResult(taskID string) (float64, error) {
-	for {
-		resp, err := http.Get("http://localhost:8080/internal/task/result?id=" + taskID)
+
+// pollTasks запрашивает задачи по одной, пока не отменят ctx, и считает их в work
+func pollTasks(ctx, work context.Context, t poller) {
+	for ctx.Err() == nil {
+		task, err := t.fetchTask(ctx)
 		if err != nil {
-			log.Printf("Error getting task result: %v\n", err)
-			time.Sleep(500 * time.Millisecond)
+			if ctx.Err() == nil {
+				log.Printf("Error getting task: %v", err)
+				sleep(ctx, cfg().PollInterval)
+			}
 			continue
 		}
-
-		if resp.StatusCode == http.StatusOK {
-			var resultData struct {
-				Result struct {
-					Float64 float64 `json:"Float64"`
-					Valid   bool    `json:"Valid"`
-				} `json:"result"`
-			}
-			err := json.NewDecoder(resp.Body).Decode(&resultData)
-			resp.Body.Close()
-			if err != nil {
-				log.Printf("Error decoding result: %v\n", err)
-				return 0, err
-			}
-			if !resultData.Result.Valid {
-				return 0, fmt.Errorf("result is not valid")
+		if task == nil {
+			if cfg().TaskWait <= 0 {
+				log.Printf("No tasks found, waiting for %s...", cfg().PollInterval)
+				sleep(ctx, cfg().PollInterval)
 			}
-			return resultData.Result.Float64, nil
-		} else if resp.StatusCode == http.StatusNotFound {
-			log.Printf("Task %s result not ready, waiting...\n", taskID)
-			time.Sleep(500 * time.Millisecond)
-		} else {
-			log.Printf("Unexpected status code when getting result: %d\n", resp.StatusCode)
-			time.Sleep(500 * time.Millisecond)
+			continue
+		}
+		if ctx.Err() != nil {
+			// задача пришла, когда агент уже останавливался
+			releaseTask(ctx, t, task.ID)
+			return
 		}
+		processTask(work, t, *task)
 	}
 }
 
-func performOperation(arg1, arg2 float64, operation string) (float64, error) {
-	var result float64
-	var err error
-
-	switch operation {
-	case "+":
-		result = arg1 + arg2
-		<-time.After(cfg.TimeAddition)
-	case "-":
-		result = arg2 - arg1
-		<-time.After(cfg.TimeSubtraction)
-	case "*":
-		result = arg1 * arg2
-		<-time.After(cfg.TimeMultiplication)
-	case "/":
-		if arg1 == 0 {
-			return 0, calculation.ErrDivisionByZero
-		}
-		result = arg2 / arg1
-		<-time.After(cfg.TimeDivision)
+// processTask считает задачу, пока продлевает её аренду, и отправляет результат.
+// Если ctx отменили раньше, чем задача посчитана, возвращает её оркестратору.
+func processTask(ctx context.Context, t transport, task models.Task) {
+	log.Printf("Received task: ID=%s, ExpressionID=%s, Args=%v, Operation=%s, Attempt=%d",
+		task.ID, task.ExpressionID, task.Args, task.Operation, task.Attempts)
+
+	if task.ID == "" || task.Operation == "" || len(task.Args) == 0 {
+		log.Printf("Received invalid task with empty fields: %+v", task)
+		return
+	}
+
+	leaseCtx, stopLease := context.WithCancel(ctx)
+	lost := keepLease(leaseCtx, t, task)
+	result, err := computeTask(ctx, task)
+	stopLease()
+
+	select {
+	case err := <-lost:
+		log.Printf("Dropping result of task %s: %v", task.ID, err)
+		return
 	default:
-		return 0, calculation.ErrAllowed
 	}
 
-	return result, err
+	if err != nil && ctx.Err() != nil {
+		log.Printf("Task %s is not finished before shutdown", task.ID)
+		releaseTask(ctx, t, task.ID)
+	} else if err != nil {
+		log.Printf("Error performing operation for task %s: %v", task.ID, err)
+		submitError(ctx, t, task.ID, err)
+	} else {
+		submitResult(ctx, t, task.ID, result)
+	}
 }
 
-func submitResult(taskID string, result float64) {
-	data := map[string]interface{}{
-		"id":     taskID,
-		"result": result,
+// computeTask считает задачу в её режиме
+func computeTask(ctx context.Context, task models.Task) (string, error) {
+	mode, err := calculation.ParseMode(task.Mode)
+	if err != nil {
+		return "", err
 	}
-	jsonData, err := json.Marshal(data)
+
+	values, err := resolveArgs(task.ID, task.Args)
 	if err != nil {
-		log.Printf("Error marshaling result: %v", err)
-		return
+		return "", err
 	}
 
-	resp, err := http.Post("http://localhost:8080/internal/task/result", "application/json", bytes.NewBuffer(jsonData))
+	result, err := performOperation(ctx, mode, task.Operation, values)
 	if err != nil {
-		log.Printf("Error submitting result for task %s: %v", taskID, err)
-		return
+		return "", err
+	}
+	log.Printf("Operation completed for task %s: %s%v = %s (%s)",
+		task.ID, task.Operation, values, result, mode)
+	return result, nil
+}
+
+// keepLease продлевает аренду задачи, пока не отменят ctx: каждый раз, когда
+// проходит половина оставшегося срока. В возвращаемый канал приходит
+// errLeaseLost, если оркестратор уже отдал задачу другому агенту,
+// или errTaskCancelled, если пользователь отменил выражение.
+func keepLease(ctx context.Context, t transport, task models.Task) <-chan error {
+	lost := make(chan error, 1)
+	if task.LeaseExpiresAt.IsZero() {
+		// оркестратор не выдаёт задачи в аренду
+		return lost
+	}
+
+	go func() {
+		expiresAt := task.LeaseExpiresAt
+		for {
+			wait := time.Until(expiresAt) / 2
+			if wait < minRenewInterval {
+				wait = minRenewInterval
+			}
+			if !sleep(ctx, wait) {
+				return
+			}
+
+			next, err := t.renewLease(ctx, task.ID)
+			if ctx.Err() != nil {
+				return
+			}
+			if errors.Is(err, errLeaseLost) || errors.Is(err, errTaskCancelled) {
+				lost <- err
+				return
+			}
+			if err != nil {
+				log.Printf("Error renewing lease of task %s: %v", task.ID, err)
+				continue
+			}
+			expiresAt = next
+		}
+	}()
+	return lost
+}
+
+// statusError переводит код ответа оркестратора на продление аренды или результат в ошибку
+func statusError(code int) error {
+	switch code {
+	case http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		return errLeaseLost
+	case http.StatusGone:
+		return errTaskCancelled
+	}
+	return fmt.Errorf("unexpected status code: %d", code)
+}
+
+// httpTransport ходит к оркестратору отдельными HTTP-запросами
+type httpTransport struct {
+	agentID string
+}
+
+func (t httpTransport) renewLease(ctx context.Context, taskID string) (time.Time, error) {
+	resp, err := t.post(ctx, "/internal/task/lease", map[string]interface{}{"id": taskID})
+	if err != nil {
+		return time.Time{}, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("Failed to submit result for task %s, status code: %d", taskID, resp.StatusCode)
-	} else {
-		log.Printf("Successfully submitted result for task %s: %f", taskID, result)
+	if err := statusError(resp.StatusCode); err != nil {
+		return time.Time{}, err
 	}
+
+	var response struct {
+		LeaseExpiresAt time.Time `json:"lease_expires_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return time.Time{}, fmt.Errorf("error decoding lease response: %w", err)
+	}
+	return response.LeaseExpiresAt, nil
 }
 
-func submitError(taskID string, errorMsg string) {
-	data := map[string]interface{}{
-		"id":    taskID,
-		"error": errorMsg,
+func (t httpTransport) submit(ctx context.Context, res models.TaskResult) error {
+	resp, err := t.post(ctx, "/internal/task/result", res)
+	if err != nil {
+		return err
 	}
+	resp.Body.Close()
+	return statusError(resp.StatusCode)
+}
+
+// post отправляет data оркестратору от имени агента
+func (t httpTransport) post(ctx context.Context, path string, data interface{}) (*http.Response, error) {
 	jsonData, err := json.Marshal(data)
 	if err != nil {
-		log.Printf("Error marshaling error: %v", err)
-		return
+		return nil, fmt.Errorf("error marshaling request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg().OrchestratorURL+path, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
 	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", authorization())
+	return httpClient.Do(req)
+}
 
-	resp, err := http.Post("http://localhost:8080/internal/task/result", "application/json", bytes.NewBuffer(jsonData))
+// resolveArgs возвращает операнды задачи строками, чтобы не терять точность
+// режимов decimal и rational. Разбирает их уже calculation.ApplyMode.
+// Оркестратор отдаёт задачу, когда её зависимости посчитаны, и сам подставляет
+// их результаты, поэтому ссылка на другую задачу здесь - ошибка.
+func resolveArgs(taskID string, args []models.Operand) ([]string, error) {
+	values := make([]string, 0, len(args))
+	for i, arg := range args {
+		if arg.IsRef() {
+			log.Printf("Unresolved arg%d for task %s: result of task %s", i+1, taskID, arg.TaskID)
+			return nil, fmt.Errorf("operand %s is not resolved", arg)
+		}
+		values = append(values, arg.Value)
+	}
+	return values, nil
+}
+
+// performOperation считает операцию так же, как calculation.Evaluate,
+// и выдерживает заданное в конфигурации время операции, если раньше не отменят ctx
+func performOperation(ctx context.Context, mode calculation.Mode, operation string, args []string) (string, error) {
+	result, err := calculation.ApplyMode(mode, operation, args)
 	if err != nil {
-		log.Printf("Error submitting error for task %s: %v", taskID, err)
-		return
+		return "", err
 	}
-	defer resp.Body.Close()
+	if !sleep(ctx, calculation.OperationTime(cfg(), operation)) {
+		return "", ctx.Err()
+	}
+	return result, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("Failed to submit error for task %s, status code: %d", taskID, resp.StatusCode)
+// submitResult отправляет результат и как число, и в точной записи режима задачи
+func submitResult(ctx context.Context, t transport, taskID string, exactResult string) {
+	result, err := calculation.ToFloat(exactResult)
+	if err != nil {
+		// например, 10^1000 в режиме decimal: в float64 не помещается, остаётся только exact_result
+		log.Printf("Error converting result %s of task %s: %v", exactResult, taskID, err)
+	}
+	err = t.submit(ctx, models.TaskResult{ID: taskID, Result: result, ExactResult: exactResult})
+	if errors.Is(err, errTaskCancelled) {
+		log.Printf("Task %s was cancelled, result %s is dropped", taskID, exactResult)
+	} else if err != nil {
+		log.Printf("Failed to submit result for task %s: %v", taskID, err)
+	} else {
+		log.Printf("Successfully submitted result for task %s: %s", taskID, exactResult)
+	}
+}
+
+// submitError отправляет ошибку задачи и её класс: ошибки вычисления вроде
+// деления на ноль повторять бессмысленно, остальные оркестратор повторит позже
+func submitError(ctx context.Context, t transport, taskID string, taskErr error) {
+	errorClass := models.ErrorClassTransient
+	if calculation.IsDeterministic(taskErr) {
+		errorClass = models.ErrorClassDeterministic
+	}
+	errorMsg := taskErr.Error()
+
+	if err := t.submit(ctx, models.TaskResult{ID: taskID, Error: errorMsg, ErrorClass: errorClass}); err != nil {
+		log.Printf("Failed to submit error for task %s: %v", taskID, err)
 	} else {
 		log.Printf("Successfully submitted error for task %s: %s", taskID, errorMsg)
 	}
 }
+
+// releaseTask возвращает оркестратору задачу, которую останавливающийся агент
+// не начал или не успел досчитать, чтобы её сразу получил другой агент, а не
+// после конца аренды. Ждёт оркестратора не дольше releaseTimeout, даже если
+// ctx уже отменён.
+func releaseTask(ctx context.Context, t transport, taskID string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), releaseTimeout)
+	defer cancel()
+
+	res := models.TaskResult{ID: taskID, Error: "agent is shutting down", ErrorClass: models.ErrorClassReleased}
+	if err := t.submit(ctx, res); err != nil {
+		log.Printf("Failed to release task %s: %v", taskID, err)
+	} else {
+		log.Printf("Released task %s back to orchestrator", taskID)
+	}
+}
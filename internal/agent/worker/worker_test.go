@@ -1,11 +1,32 @@
 package worker
 
 import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/zalhui/calc_golang/config"
+	"github.com/zalhui/calc_golang/internal/common/models"
 	"github.com/zalhui/calc_golang/pkg/calculation"
+	"google.golang.org/grpc/codes"
 )
 
+// performFloat вызывает performOperation в режиме float для аргументов-чисел
+func performFloat(operation string, args []float64) (float64, error) {
+	values := make([]string, len(args))
+	for i, arg := range args {
+		values[i] = calculation.FormatFloat(arg)
+	}
+	result, err := performOperation(context.Background(), calculation.ModeFloat, operation, values)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(result, 64)
+}
+
 func TestPerformOperation(t *testing.T) {
 	tests := []struct {
 		arg1      float64
@@ -19,12 +40,252 @@ func TestPerformOperation(t *testing.T) {
 		{4, 2, "*", 8, nil},
 		{6, 3, "/", 2, nil},
 		{6, 0, "/", 0, calculation.ErrDivisionByZero},
+		{2, 10, "^", 1024, nil},
+		{4, 0.5, "^", 2, nil},
+		{2, -1, "^", 0.5, nil},
+		{0, -1, "^", 0, calculation.ErrPowerDomain},
+		{-8, 0.5, "^", 0, calculation.ErrPowerDomain},
+		{10, 400, "^", 0, calculation.ErrOverflow},
+		{7, 3, "%", 1, nil},
+		{-7, 3, "%", 2, nil},
+		{7, -3, "%", -2, nil},
+		{7, 0, "%", 0, calculation.ErrModuloByZero},
+		{7, 2, "//", 3, nil},
+		{-7, 2, "//", -4, nil},
+		{7, 0, "//", 0, calculation.ErrDivisionByZero},
+		{3, 0, calculation.OpNegate, -3, nil},
+		{-3, 0, calculation.OpNegate, 3, nil},
 	}
 
 	for _, tt := range tests {
-		result, err := performOperation(tt.arg1, tt.arg2, tt.operation)
+		args := []float64{tt.arg1, tt.arg2}
+		if tt.operation == calculation.OpNegate {
+			args = args[:1]
+		}
+		result, err := performFloat(tt.operation, args)
 		if result != tt.expected || err != tt.err {
 			t.Errorf("performOperation(%v, %v, %q) = %v, %v; want %v, %v", tt.arg1, tt.arg2, tt.operation, result, err, tt.expected, tt.err)
 		}
 	}
 }
+
+func TestPerformFunction(t *testing.T) {
+	tests := []struct {
+		operation string
+		args      []float64
+		expected  float64
+		err       error
+	}{
+		{"sqrt", []float64{16}, 4, nil},
+		{"sqrt", []float64{-1}, 0, calculation.ErrFunctionDomain},
+		{"abs", []float64{-2.5}, 2.5, nil},
+		{"sin", []float64{0}, 0, nil},
+		{"cos", []float64{0}, 1, nil},
+		{"log", []float64{1}, 0, nil},
+		{"log", []float64{100, 10}, 2, nil},
+		{"log", []float64{0}, 0, calculation.ErrFunctionDomain},
+		{"log", []float64{8, 1}, 0, calculation.ErrFunctionDomain},
+		{"min", []float64{3, -1, 2}, -1, nil},
+		{"max", []float64{3, 4, 5}, 5, nil},
+		{"max", []float64{7}, 7, nil},
+	}
+
+	for _, tt := range tests {
+		result, err := performFloat(tt.operation, tt.args)
+		if result != tt.expected || err != tt.err {
+			t.Errorf("performOperation(%q, %v) = %v, %v; want %v, %v", tt.operation, tt.args, result, err, tt.expected, tt.err)
+		}
+	}
+
+	if _, err := performFloat("sqrt", []float64{1, 2}); !errors.Is(err, calculation.ErrArity) {
+		t.Errorf("performOperation(\"sqrt\", [1 2]) error = %v; want %v", err, calculation.ErrArity)
+	}
+}
+
+func TestPerformOperationExact(t *testing.T) {
+	tests := []struct {
+		mode      calculation.Mode
+		operation string
+		args      []string
+		expected  string
+		err       error
+	}{
+		{calculation.ModeDecimal, "+", []string{"0.1", "0.2"}, "0.3", nil},
+		{calculation.ModeDecimal, "-", []string{"1", "0.9"}, "0.1", nil},
+		{calculation.ModeDecimal, "*", []string{"1.1", "1.1"}, "1.21", nil},
+		{calculation.ModeDecimal, "/", []string{"1", "3"}, "0.3333333333333333333333333333", nil},
+		{calculation.ModeDecimal, "/", []string{"1", "0"}, "", calculation.ErrDivisionByZero},
+		{calculation.ModeDecimal, "^", []string{"10", "30"}, "1000000000000000000000000000000", nil},
+		{calculation.ModeDecimal, "%", []string{"-7.5", "2"}, "0.5", nil},
+		{calculation.ModeDecimal, "max", []string{"0.1", "0.30", "0.2"}, "0.3", nil},
+		{calculation.ModeRational, "+", []string{"1/3", "1/6"}, "1/2", nil},
+		{calculation.ModeRational, "/", []string{"0.1", "3"}, "1/30", nil},
+		{calculation.ModeRational, "^", []string{"2/3", "-2"}, "9/4", nil},
+		{calculation.ModeRational, "sqrt", []string{"4/9"}, "2/3", nil},
+		{calculation.ModeRational, "sqrt", []string{"2"}, "", calculation.ErrInexact},
+	}
+
+	for _, tt := range tests {
+		result, err := performOperation(context.Background(), tt.mode, tt.operation, tt.args)
+		if result != tt.expected || !errors.Is(err, tt.err) {
+			t.Errorf("performOperation(%s, %q, %v) = %q, %v; want %q, %v", tt.mode, tt.operation, tt.args, result, err, tt.expected, tt.err)
+		}
+	}
+}
+
+// TestPerformOperationMatchesEvaluate прогоняет задачи выражения через агента
+// и сравнивает результат с calculation.Evaluate
+func TestPerformOperationMatchesEvaluate(t *testing.T) {
+	saved := cfg()
+	defer settings.Store(saved)
+	settings.Store(&config.Config{})
+
+	expressions := []string{
+		"2+2*2",
+		"(2+3)*(4-1)/7",
+		"-(2.5+3.5)^2",
+		"2^3^2 - 10 // 3 + 10 % 3",
+		"sqrt(2)*max(3, 4, 5)+log(100, 10)",
+		"abs(min(1, -2, 3)) - sin(1)*cos(1)/tan(1)",
+		"1/(3-3)",
+		"0^-1",
+		"log(-1)",
+	}
+
+	for _, expression := range expressions {
+		root, err := calculation.Parse(expression)
+		if err != nil {
+			t.Fatalf("Parse(%q) error = %v", expression, err)
+		}
+		tasks, err := calculation.Lower(root, "expr")
+		if err != nil {
+			t.Fatalf("Lower(%q) error = %v", expression, err)
+		}
+
+		results := make(map[string]float64)
+		var agentResult float64
+		var agentErr error
+		for _, task := range tasks {
+			args := make([]float64, len(task.Args))
+			for i, arg := range task.Args {
+				if arg.IsRef() {
+					args[i] = results[arg.TaskID]
+				} else if args[i], err = strconv.ParseFloat(arg.Value, 64); err != nil {
+					t.Fatalf("task %s: bad operand %q", task.ID, arg.Value)
+				}
+			}
+			agentResult, agentErr = performFloat(task.Operation, args)
+			if agentErr != nil {
+				break
+			}
+			results[task.ID] = agentResult
+		}
+
+		for _, workers := range []int{1, 4} {
+			localResult, localErr := calculation.Evaluate(expression, calculation.WithWorkers(workers))
+			if localResult != agentResult || !errors.Is(localErr, agentErr) {
+				t.Errorf("%q: agent = %v, %v; Evaluate(WithWorkers(%d)) = %v, %v",
+					expression, agentResult, agentErr, workers, localResult, localErr)
+			}
+		}
+	}
+}
+
+func TestResolveArgs(t *testing.T) {
+	values, err := resolveArgs("task", []models.Operand{{Value: "2"}, {Value: "1/3"}})
+	if err != nil || len(values) != 2 || values[0] != "2" || values[1] != "1/3" {
+		t.Errorf("resolveArgs() = %v, %v; want [2 1/3]", values, err)
+	}
+
+	// оркестратор подставляет результаты зависимостей сам, ссылка - ошибка
+	if _, err := resolveArgs("task", []models.Operand{{Value: "2"}, {TaskID: "other"}}); err == nil {
+		t.Error("resolveArgs() with unresolved ref: want error")
+	}
+}
+
+func TestCodeError(t *testing.T) {
+	other := errors.New("unavailable")
+	tests := []struct {
+		code     codes.Code
+		expected error
+	}{
+		{codes.OK, nil},
+		{codes.Aborted, errLeaseLost},
+		{codes.FailedPrecondition, errTaskCancelled},
+		{codes.Unavailable, other},
+	}
+
+	for _, tt := range tests {
+		if err := codeError(tt.code, other); err != tt.expected {
+			t.Errorf("codeError(%s) = %v; want %v", tt.code, err, tt.expected)
+		}
+	}
+}
+
+// fakeTransport запоминает, что агент отправил оркестратору
+type fakeTransport struct {
+	mu      sync.Mutex
+	results []models.TaskResult
+}
+
+func (t *fakeTransport) renewLease(ctx context.Context, taskID string) (time.Time, error) {
+	return time.Now().Add(time.Minute), nil
+}
+
+func (t *fakeTransport) submit(ctx context.Context, res models.TaskResult) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.results = append(t.results, res)
+	return nil
+}
+
+func TestProcessTaskShutdown(t *testing.T) {
+	saved := cfg()
+	defer settings.Store(saved)
+
+	task := models.Task{ID: "task", Operation: "+", Args: []models.Operand{{Value: "2"}, {Value: "2"}}}
+	tests := []struct {
+		name     string
+		opTime   time.Duration
+		expected models.TaskResult
+	}{
+		{"finished", 0, models.TaskResult{ID: "task", Result: 4, ExactResult: "4"}},
+		// задача не успела досчитаться до отмены и возвращается оркестратору
+		{"interrupted", time.Hour, models.TaskResult{ID: "task", Error: "agent is shutting down", ErrorClass: models.ErrorClassReleased}},
+	}
+
+	for _, tt := range tests {
+		settings.Store(&config.Config{TimeAddition: tt.opTime})
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		tr := &fakeTransport{}
+		processTask(ctx, tr, task)
+		cancel()
+
+		if len(tr.results) != 1 || tr.results[0] != tt.expected {
+			t.Errorf("%s: submitted %+v; want %+v", tt.name, tr.results, tt.expected)
+		}
+	}
+}
+
+func TestDrainContext(t *testing.T) {
+	saved := cfg()
+	defer settings.Store(saved)
+	settings.Store(&config.Config{ShutdownTimeout: 50 * time.Millisecond})
+
+	ctx, stop := context.WithCancel(context.Background())
+	work, cancel := drainContext(ctx)
+	defer cancel()
+
+	stop()
+	// начатые задачи досчитываются ещё ShutdownTimeout
+	select {
+	case <-work.Done():
+		t.Fatal("work context is cancelled together with ctx")
+	case <-time.After(10 * time.Millisecond):
+	}
+	select {
+	case <-work.Done():
+	case <-time.After(time.Second):
+		t.Fatal("work context is not cancelled after ShutdownTimeout")
+	}
+}
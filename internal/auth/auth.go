@@ -2,12 +2,12 @@ package auth
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
-	"github.com/zalhui/calc_golang/config"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -17,7 +17,13 @@ type User struct {
 	PasswordHash string
 }
 
-var jwtSecret = []byte(config.LoadConfig().JWTSecret)
+// jwtSecret - ключ, которым оркестратор подписывает токены, задаётся SetSecret при запуске
+var jwtSecret []byte
+
+// SetSecret задаёт ключ подписи токенов, JWT_SECRET из настроек
+func SetSecret(secret string) {
+	jwtSecret = []byte(secret)
+}
 
 func RegisterUser(db *sql.DB, login, password string) (string, error) {
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
@@ -67,3 +73,72 @@ func GenerateToken(userID string) (string, error) {
 	}
 	return tokenString, nil
 }
+
+// ErrInvalidToken - токен пользователя не подписан оркестратором, истёк или выдан не пользователю
+var ErrInvalidToken = errors.New("invalid token")
+
+// ParseUserToken проверяет токен пользователя и возвращает id пользователя из него
+func ParseUserToken(tokenString string) (string, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil || !token.Valid {
+		return "", ErrInvalidToken
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return "", ErrInvalidToken
+	}
+	userID, ok := claims["user_id"].(string)
+	if !ok || userID == "" {
+		return "", ErrInvalidToken
+	}
+	return userID, nil
+}
+
+// AgentScope - scope токенов агентов. Токен пользователя не пускает
+// к /internal, а токен агента - к API пользователей.
+const AgentScope = "agent"
+
+// ErrInvalidAgentToken - токен не подписан оркестратором, истёк или выдан не агенту
+var ErrInvalidAgentToken = errors.New("invalid agent token")
+
+// GenerateAgentToken выдаёт агенту agentID токен для /internal.
+// ttl == 0 - токен бессрочный.
+func GenerateAgentToken(agentID string, ttl time.Duration) (string, error) {
+	claims := jwt.MapClaims{
+		"agent_id": agentID,
+		"scope":    AgentScope,
+		"iat":      time.Now().Unix(),
+	}
+	if ttl > 0 {
+		claims["exp"] = time.Now().Add(ttl).Unix()
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	tokenString, err := token.SignedString(jwtSecret)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign token: %w", err)
+	}
+	return tokenString, nil
+}
+
+// ParseAgentToken проверяет токен агента и возвращает id агента из него
+func ParseAgentToken(tokenString string) (string, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil || !token.Valid {
+		return "", ErrInvalidAgentToken
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["scope"] != AgentScope {
+		return "", ErrInvalidAgentToken
+	}
+	agentID, ok := claims["agent_id"].(string)
+	if !ok || agentID == "" {
+		return "", ErrInvalidAgentToken
+	}
+	return agentID, nil
+}
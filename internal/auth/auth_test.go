@@ -2,11 +2,20 @@ package auth
 
 import (
 	"database/sql"
+	"errors"
+	"os"
 	"testing"
+	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	_ "github.com/mattn/go-sqlite3"
 )
 
+func TestMain(m *testing.M) {
+	SetSecret("test secret")
+	os.Exit(m.Run())
+}
+
 func TestRegisterAndLoginUser(t *testing.T) {
 	db, err := sql.Open("sqlite3", ":memory:")
 	if err != nil {
@@ -55,3 +64,69 @@ func TestRegisterAndLoginUser(t *testing.T) {
 		}
 	})
 }
+
+func TestAgentToken(t *testing.T) {
+	token, err := GenerateAgentToken("agent-1", time.Hour)
+	if err != nil {
+		t.Fatalf("GenerateAgentToken() error = %v", err)
+	}
+	if id, err := ParseAgentToken(token); err != nil || id != "agent-1" {
+		t.Errorf("ParseAgentToken() = %q, %v; want agent-1", id, err)
+	}
+
+	userToken, _ := GenerateToken("user-1")
+	expired, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"agent_id": "agent-1", "scope": AgentScope, "exp": time.Now().Add(-time.Hour).Unix(),
+	}).SignedString(jwtSecret)
+	forged, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"agent_id": "agent-1", "scope": AgentScope,
+	}).SignedString([]byte("another secret"))
+	anonymous, _ := GenerateAgentToken("", time.Hour)
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"user token", userToken},
+		{"expired token", expired},
+		{"forged signature", forged},
+		{"garbage", "not-a-token"},
+		{"empty agent id", anonymous},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseAgentToken(tt.token); !errors.Is(err, ErrInvalidAgentToken) {
+				t.Errorf("ParseAgentToken() error = %v; want ErrInvalidAgentToken", err)
+			}
+		})
+	}
+}
+
+func TestUserToken(t *testing.T) {
+	userToken, err := GenerateToken("user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentToken, err := GenerateAgentToken("agent-1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantID  string
+		wantErr error
+	}{
+		{"User token", userToken, "user-1", nil},
+		{"Agent token", agentToken, "", ErrInvalidToken},
+		{"Garbage", "not-a-token", "", ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userID, err := ParseUserToken(tt.token)
+			if userID != tt.wantID || !errors.Is(err, tt.wantErr) {
+				t.Errorf("ParseUserToken() = %q, %v; want %q, %v", userID, err, tt.wantID, tt.wantErr)
+			}
+		})
+	}
+}
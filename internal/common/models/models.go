@@ -2,49 +2,127 @@ package models
 
 import (
 	"database/sql"
+	"slices"
 	"time"
 )
 
 type Expression struct {
-	ID         string          `json:"id"`
-	UserID     string          `json:"user_id"`
-	Expression string          `json:"expression"`
-	Status     string          `json:"status"`
-	Result     sql.NullFloat64 `json:"result,omitempty"`
-	CreatedAt  time.Time       `json:"created_at"`
-	FinishedAt time.Time       `json:"finished_at,omitempty"`
-	Tasks      []*Task         `json:"tasks,omitempty"`
+	ID          string            `json:"id"`
+	UserID      string            `json:"user_id"`
+	Expression  string            `json:"expression"`
+	Variables   map[string]string `json:"variables,omitempty"` // значения переменных выражения
+	Mode        string            `json:"mode"`
+	Status      string            `json:"status"`
+	Result      sql.NullFloat64   `json:"result,omitempty"`
+	ExactResult sql.NullString    `json:"exact_result,omitempty"` // результат в записи режима Mode, без округления до float64
+	RootTaskID  string            `json:"root_task_id,omitempty"` // задача, результат которой - результат выражения
+	CreatedAt   time.Time         `json:"created_at"`
+	FinishedAt  time.Time         `json:"finished_at,omitempty"`
+	Tasks       []*Task           `json:"tasks,omitempty"`
 }
 
 type Task struct {
-	ID            string          `json:"id"`
-	ExpressionID  string          `json:"expression_id"`
-	Arg1          string          `json:"arg1"`
-	Arg2          string          `json:"arg2"`
-	Operation     string          `json:"operation"`
-	OperationTime time.Duration   `json:"operation_time"`
-	Status        string          `json:"status"`
-	Result        sql.NullFloat64 `json:"result,omitempty"`
-	Dependencies  []string        `json:"dependencies"`
-	CreatedAt     time.Time       `json:"created_at"`
-	StartedAt     time.Time       `json:"started_at,omitempty"`
-	FinishedAt    time.Time       `json:"finished_at,omitempty"`
-}
-type ExpressionResponse struct {
-	ID         string    `json:"id"`
-	Expression string    `json:"expression"`
-	Status     string    `json:"status"`
-	Result     *float64  `json:"result,omitempty"`
-	CreatedAt  time.Time `json:"created_at"`
-	FinishedAt time.Time `json:"finished_at,omitempty"`
-}
-type TaskResponse struct {
-	ID           string    `json:"id"`
-	ExpressionID string    `json:"expression_id"`
-	Operation    string    `json:"operation"`
-	Status       string    `json:"status"`
-	Result       *float64  `json:"result,omitempty"`
-	CreatedAt    time.Time `json:"created_at"`
+	ID             string          `json:"id"`
+	ExpressionID   string          `json:"expression_id"`
+	Args           []Operand       `json:"args"` // операнды по порядку, у функций их может быть сколько угодно
+	Operation      string          `json:"operation"`
+	Mode           string          `json:"mode,omitempty"`
+	OperationTime  time.Duration   `json:"operation_time"`
+	Status         string          `json:"status"`
+	Result         sql.NullFloat64 `json:"result,omitempty"`
+	ExactResult    sql.NullString  `json:"exact_result,omitempty"`
+	Dependencies   []string        `json:"dependencies"`
+	LeaseOwner     string          `json:"lease_owner,omitempty"`      // агент, который сейчас считает задачу
+	LeaseExpiresAt time.Time       `json:"lease_expires_at,omitempty"` // после этого задача вернётся в очередь
+	Attempts       int             `json:"attempts"`                   // сколько раз задачу выдавали агентам
+	NotBefore      time.Time       `json:"not_before,omitempty"`       // до этого момента задачу не выдают: пауза перед повтором
+	LastError      string          `json:"last_error,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	StartedAt      time.Time       `json:"started_at,omitempty"`
+	FinishedAt     time.Time       `json:"finished_at,omitempty"`
+}
+
+// Agent - агент, зарегистрированный у оркестратора
+type Agent struct {
+	ID             string `json:"id"`
+	Hostname       string `json:"hostname"`
+	Version        string `json:"version"`
+	ComputingPower int    `json:"computing_power"` // сколько задач агент считает одновременно
+	Capabilities
+	Status         string    `json:"status"` // online или offline, если агент перестал присылать heartbeat
+	TasksInFlight  int       `json:"tasks_in_flight"`
+	CompletedTasks int       `json:"completed_tasks"`
+	RegisteredAt   time.Time `json:"registered_at"`
+	LastSeenAt     time.Time `json:"last_seen_at"`
+}
+
+// Capabilities - какие задачи агент умеет считать.
+// Пустой список или нулевой размер - без ограничений.
+type Capabilities struct {
+	Operations     []string `json:"operations"`       // операции и функции
+	Modes          []string `json:"modes"`            // числовые режимы
+	MaxOperandSize int      `json:"max_operand_size"` // наибольшая длина операнда в символах
+}
+
+// Supports сообщает, может ли агент посчитать задачу. Операнды задачи
+// должны быть уже подставлены, иначе их размер не проверить.
+func (c Capabilities) Supports(task *Task) bool {
+	if len(c.Operations) > 0 && !slices.Contains(c.Operations, task.Operation) {
+		return false
+	}
+	mode := task.Mode
+	if mode == "" {
+		mode = "float"
+	}
+	if len(c.Modes) > 0 && !slices.Contains(c.Modes, mode) {
+		return false
+	}
+	if c.MaxOperandSize > 0 {
+		for _, arg := range task.Args {
+			if len(arg.Value) > c.MaxOperandSize {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// TaskResult - результат или ошибка задачи, которые агент присылает оркестратору
+type TaskResult struct {
+	ID          string  `json:"id"`
+	Result      float64 `json:"result,omitempty"`
+	ExactResult string  `json:"exact_result,omitempty"`
+	Error       string  `json:"error,omitempty"`
+	ErrorClass  string  `json:"error_class,omitempty"` // transient, deterministic или released
+}
+
+// Классы ошибок, которые агент сообщает вместе с ошибкой задачи
+const (
+	// ErrorClassDeterministic - повтор даст ту же ошибку, например деление на ноль
+	ErrorClassDeterministic = "deterministic"
+	// ErrorClassTransient - задачу стоит повторить позже
+	ErrorClassTransient = "transient"
+	// ErrorClassReleased - агент останавливается и возвращает задачу, не досчитав
+	// её: она сразу уходит другим агентам, попытка не считается
+	ErrorClassReleased = "released"
+)
+
+// Operand - аргумент задачи: либо число, либо результат другой задачи
+type Operand struct {
+	Value  string `json:"value,omitempty"`
+	TaskID string `json:"task_id,omitempty"`
+}
+
+// IsRef сообщает, что операнд ссылается на результат задачи TaskID
+func (o Operand) IsRef() bool {
+	return o.TaskID != ""
+}
+
+func (o Operand) String() string {
+	if o.IsRef() {
+		return "$" + o.TaskID
+	}
+	return o.Value
 }
 
 type UserResponse struct {
@@ -40,8 +40,12 @@ CREATE TABLE IF NOT EXISTS expressions (
     id TEXT PRIMARY KEY,
     user_id TEXT NOT NULL,
     expression TEXT NOT NULL,
+    variables TEXT DEFAULT NULL,
+    mode TEXT NOT NULL DEFAULT 'float',
     status TEXT NOT NULL,
     result REAL DEFAULT NULL,
+    exact_result TEXT DEFAULT NULL,
+    root_task_id TEXT DEFAULT NULL,
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
     FOREIGN KEY (user_id) REFERENCES users(id)
 );
@@ -52,18 +56,100 @@ CREATE TABLE IF NOT EXISTS tasks (
     arg1 TEXT NOT NULL,
     arg2 TEXT NOT NULL,
     operation TEXT NOT NULL,
+    args TEXT,
+    mode TEXT NOT NULL DEFAULT 'float',
     status TEXT NOT NULL,
     result REAL,
+    exact_result TEXT,
     dependencies TEXT,
+    lease_owner TEXT,
+    lease_expires_at DATETIME,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    not_before DATETIME,
+    last_error TEXT,
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
     FOREIGN KEY (expression_id) REFERENCES expressions(id)
+);
+
+CREATE TABLE IF NOT EXISTS agents (
+    id TEXT PRIMARY KEY,
+    hostname TEXT NOT NULL DEFAULT '',
+    version TEXT NOT NULL DEFAULT '',
+    computing_power INTEGER NOT NULL DEFAULT 1,
+    operations TEXT,
+    modes TEXT,
+    max_operand_size INTEGER NOT NULL DEFAULT 0,
+    status TEXT NOT NULL DEFAULT 'online',
+    completed_tasks INTEGER NOT NULL DEFAULT 0,
+    registered_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at DATETIME
 );`
 
 	_, err := db.Exec(schema)
 	if err != nil {
 		return fmt.Errorf("failed to create schema: %w", err)
 	}
-	return err
+
+	for _, c := range addedColumns {
+		if err := addColumnIfMissing(db, c.table, c.column, c.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addedColumns - колонки, появившиеся после первой версии схемы.
+// CREATE TABLE IF NOT EXISTS не трогает уже созданные таблицы,
+// поэтому в старые базы их нужно добавить вручную.
+var addedColumns = []struct {
+	table, column, definition string
+}{
+	{"tasks", "args", "TEXT"},
+	{"expressions", "mode", "TEXT NOT NULL DEFAULT 'float'"},
+	{"expressions", "exact_result", "TEXT"},
+	{"expressions", "variables", "TEXT"},
+	{"expressions", "root_task_id", "TEXT"},
+	{"tasks", "mode", "TEXT NOT NULL DEFAULT 'float'"},
+	{"tasks", "exact_result", "TEXT"},
+	{"tasks", "lease_owner", "TEXT"},
+	{"tasks", "lease_expires_at", "DATETIME"},
+	{"tasks", "attempts", "INTEGER NOT NULL DEFAULT 0"},
+	{"tasks", "not_before", "DATETIME"},
+	{"tasks", "last_error", "TEXT"},
+	{"agents", "modes", "TEXT"},
+	{"agents", "max_operand_size", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to read columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, typ        string
+			defaultValue     sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &defaultValue, &pk); err != nil {
+			return fmt.Errorf("failed to scan column of %s: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read columns of %s: %w", table, err)
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
+	return nil
 }
 
 func CloseDB(db *DB) error {
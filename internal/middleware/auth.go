@@ -2,11 +2,12 @@ package middleware
 
 import (
 	"context"
+	"crypto/subtle"
 	"net/http"
 	"strings"
 
-	"github.com/golang-jwt/jwt/v5"
-	"github.com/zalhui/calc_golang/config"
+	"github.com/zalhui/calc_golang/internal/auth"
+	"github.com/zalhui/calc_golang/internal/mtls"
 )
 
 func JWTAuthMiddleware(next http.Handler) http.Handler {
@@ -17,29 +18,63 @@ func JWTAuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			return []byte(config.LoadConfig().JWTSecret), nil
+		userID, err := auth.ParseUserToken(strings.TrimPrefix(authHeader, "Bearer "))
+		if err != nil {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "userID", userID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// AdminAuth пускает только запросы с токеном adminToken, ADMIN_TOKEN из настроек.
+// Если токен не задан, админские эндпоинты недоступны.
+func AdminAuth(adminToken string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if adminToken == "" {
+				http.Error(w, "Admin API is disabled", http.StatusForbidden)
+				return
+			}
+
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+				http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r)
 		})
+	}
+}
 
-		if err != nil || !token.Valid {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
+// AgentAuthMiddleware пускает к /internal только агентов с токеном,
+// выданным командой admin agent-token, и передаёт дальше id агента из токена.
+// На listener'е mTLS агента узнают по CN его сертификата, токен не нужен.
+func AgentAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if agentID := mtls.PeerAgentID(r.TLS); agentID != "" {
+			ctx := context.WithValue(r.Context(), "agentID", agentID)
+			next.ServeHTTP(w, r.WithContext(ctx))
 			return
 		}
 
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			http.Error(w, "Invalid token claims", http.StatusUnauthorized)
+		authHeader := r.Header.Get("Authorization")
+		if authHeader == "" {
+			http.Error(w, "Missing authorization header", http.StatusUnauthorized)
 			return
 		}
 
-		userID, ok := claims["user_id"].(string)
-		if !ok {
-			http.Error(w, "Invalid user ID in token", http.StatusUnauthorized)
+		// задачи числятся за id агента, поэтому без id агента /internal закрыт
+		agentID, err := auth.ParseAgentToken(strings.TrimPrefix(authHeader, "Bearer "))
+		if err != nil || agentID == "" {
+			http.Error(w, "Invalid agent token", http.StatusUnauthorized)
 			return
 		}
 
-		ctx := context.WithValue(r.Context(), "userID", userID)
+		ctx := context.WithValue(r.Context(), "agentID", agentID)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"context"
+	"strings"
+
+	"github.com/zalhui/calc_golang/internal/auth"
+	"github.com/zalhui/calc_golang/internal/mtls"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// AgentAuthUnaryInterceptor - AgentAuthMiddleware для вызовов gRPC.
+// Токен приходит в метаданных authorization, как заголовок по HTTP.
+func AgentAuthUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := agentContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// AgentAuthStreamInterceptor - AgentAuthMiddleware для потоков gRPC
+func AgentAuthStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := agentContext(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &agentStream{ServerStream: ss, ctx: ctx})
+}
+
+// agentContext проверяет токен агента и добавляет в ctx id агента из него.
+// При mTLS id агента берётся из его сертификата.
+func agentContext(ctx context.Context) (context.Context, error) {
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			if agentID := mtls.PeerAgentID(&info.State); agentID != "" {
+				return context.WithValue(ctx, "agentID", agentID), nil
+			}
+		}
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	tokens := md.Get("authorization")
+	if len(tokens) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "Missing authorization metadata")
+	}
+
+	agentID, err := auth.ParseAgentToken(strings.TrimPrefix(tokens[0], "Bearer "))
+	if err != nil || agentID == "" {
+		return nil, status.Error(codes.Unauthenticated, "Invalid agent token")
+	}
+	return context.WithValue(ctx, "agentID", agentID), nil
+}
+
+// agentStream - поток, контекст которого знает id агента
+type agentStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *agentStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,87 @@
+// Package mtls - взаимная TLS-аутентификация оркестратора и агентов:
+// оба предъявляют сертификаты, выпущенные одним CA, и агент известен
+// оркестратору под CN своего сертификата.
+package mtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrNoAgentID - в сертификате агента не указан CN
+var ErrNoAgentID = errors.New("certificate has no common name")
+
+// ServerConfig - настройки TLS оркестратора: свой сертификат и обязательный
+// сертификат клиента, подписанный CA из caFile
+func ServerConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	pool, cert, err := load(caFile, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// ClientConfig - настройки TLS агента: свой сертификат и доверие только
+// сертификатам оркестратора, подписанным CA из caFile
+func ClientConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	pool, cert, err := load(caFile, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+func load(caFile, certFile, keyFile string) (*x509.CertPool, tls.Certificate, error) {
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, tls.Certificate{}, fmt.Errorf("error reading CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, tls.Certificate{}, fmt.Errorf("no certificates in %s", caFile)
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, tls.Certificate{}, fmt.Errorf("error loading certificate: %w", err)
+	}
+	return pool, cert, nil
+}
+
+// PeerAgentID возвращает id агента - CN проверенного сертификата клиента.
+// Пустая строка - клиент не предъявил сертификат или он не проверен.
+func PeerAgentID(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
+
+// CertAgentID возвращает CN собственного сертификата агента, под которым
+// его узнает оркестратор
+func CertAgentID(certFile string) (string, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return "", fmt.Errorf("error reading certificate: %w", err)
+	}
+	cert, err := parseCertificate(certPEM)
+	if err != nil {
+		return "", err
+	}
+	if cert.Subject.CommonName == "" {
+		return "", ErrNoAgentID
+	}
+	return cert.Subject.CommonName, nil
+}
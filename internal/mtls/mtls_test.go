@@ -0,0 +1,153 @@
+package mtls
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeFiles пишет сертификат и ключ в dir и возвращает пути к ним
+func writeFiles(t *testing.T, dir, name string, certPEM, keyPEM []byte) (string, string) {
+	t.Helper()
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	if err := os.WriteFile(certFile, certPEM, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+
+	ca, err := NewAuthority("test CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile, _ := writeFiles(t, dir, "ca", ca.CertPEM, ca.KeyPEM)
+
+	certPEM, keyPEM, err := ca.IssueServer("orchestrator", []string{"localhost", "127.0.0.1"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, serverKey := writeFiles(t, dir, "orchestrator", certPEM, keyPEM)
+
+	certPEM, keyPEM, err = ca.IssueAgent("agent-1", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentCert, agentKey := writeFiles(t, dir, "agent-1", certPEM, keyPEM)
+
+	// сертификат агента от чужого CA
+	otherCA, err := NewAuthority("other CA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM, err = otherCA.IssueAgent("intruder", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intruderCert, intruderKey := writeFiles(t, dir, "intruder", certPEM, keyPEM)
+
+	serverTLS, err := ServerConfig(caFile, serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, PeerAgentID(r.TLS))
+	}))
+	server.TLS = serverTLS
+	server.StartTLS()
+	defer server.Close()
+
+	t.Run("Agent id from certificate", func(t *testing.T) {
+		id, err := CertAgentID(agentCert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != "agent-1" {
+			t.Errorf("Expected agent-1, got %q", id)
+		}
+	})
+
+	tests := []struct {
+		name     string
+		certFile string
+		keyFile  string
+		wantErr  bool
+	}{
+		{"Agent certificate", agentCert, agentKey, false},
+		{"Certificate from another CA", intruderCert, intruderKey, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientTLS, err := ClientConfig(caFile, tt.certFile, tt.keyFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+			resp, err := client.Get(server.URL)
+			if tt.wantErr {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("Expected handshake error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != "agent-1" {
+				t.Errorf("Expected agent-1, got %q", body)
+			}
+		})
+	}
+
+	t.Run("No client certificate", func(t *testing.T) {
+		clientTLS, err := ClientConfig(caFile, agentCert, agentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientTLS.Certificates = nil
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+		if resp, err := client.Get(server.URL); err == nil {
+			resp.Body.Close()
+			t.Fatal("Expected handshake error")
+		}
+	})
+
+	t.Run("Reload authority", func(t *testing.T) {
+		loaded, err := LoadAuthority(ca.CertPEM, ca.KeyPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certPEM, keyPEM, err := loaded.IssueAgent("agent-2", time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certFile, keyFile := writeFiles(t, dir, "agent-2", certPEM, keyPEM)
+		clientTLS, err := ClientConfig(caFile, certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != "agent-2" {
+			t.Errorf("Expected agent-2, got %q", body)
+		}
+	})
+}
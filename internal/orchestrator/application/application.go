@@ -1,12 +1,15 @@
 package application
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/zalhui/calc_golang/config"
 	"github.com/zalhui/calc_golang/internal/auth"
 	"github.com/zalhui/calc_golang/internal/common/models"
 	"github.com/zalhui/calc_golang/internal/orchestrator/repository"
@@ -16,12 +19,72 @@ import (
 type Application struct {
 	repository *repository.Repository
 	db         *sql.DB
+	lease      time.Duration // аренда задачи агентом
+	reapEvery  time.Duration
+	lostAfter  time.Duration                 // сколько ждать heartbeat агента, прежде чем забрать его задачи
+	settings   atomic.Pointer[config.Config] // время операций и политики повторов, меняются при перезагрузке настроек
+	notifier   *readyNotifier                // будит агентов, которые ждут задачи
 }
 
-func New(db *sql.DB) *Application {
-	return &Application{
-		repository: repository.NewRepository(db),
+func New(db *sql.DB, cfg *config.Config) *Application {
+	repo := repository.NewRepository(db)
+	// задачи из старых версий ждут в pending, даже если их уже можно считать
+	if err := repo.PromoteReadyTasks(); err != nil {
+		log.Printf("Failed to promote ready tasks: %v", err)
+	}
+	a := &Application{
+		repository: repo,
 		db:         db,
+		lease:      cfg.TaskLease,
+		reapEvery:  cfg.LeaseReapInterval,
+		lostAfter:  cfg.AgentTimeout,
+		notifier:   newReadyNotifier(),
+	}
+	a.settings.Store(cfg)
+	return a
+}
+
+// ApplyConfig подписывается на перезагрузку настроек: новые время операций
+// и политики повторов действуют для следующих задач
+func (a *Application) ApplyConfig(cfg *config.Config) {
+	a.settings.Store(cfg)
+}
+
+// StartLeaseReaper каждые LeaseReapInterval возвращает в очередь задачи,
+// агенты которых не продлили аренду или пропали, не присылая heartbeat,
+// и отмечает выражения, которые некому посчитать, пока не отменят ctx.
+// Истёкшая аренда - временная ошибка: когда попытки кончаются, задача уходит в dead.
+func (a *Application) StartLeaseReaper(ctx context.Context) {
+	ticker := time.NewTicker(a.reapEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			lost, err := a.repository.ReleaseLostAgents(now.Add(-a.lostAfter))
+			if err != nil {
+				log.Printf("Failed to release tasks of lost agents: %v", err)
+			} else if lost > 0 {
+				log.Printf("%d agents missed heartbeats for %s, releasing their tasks", lost, a.lostAfter)
+			}
+			a.updateBlocked("")
+
+			maxAttempts := retryPolicies(a.settings.Load())[models.ErrorClassTransient].MaxAttempts
+			requeued, killed, err := a.repository.ReapExpiredLeases(now, maxAttempts)
+			if err != nil {
+				log.Printf("Failed to reap expired leases: %v", err)
+				continue
+			}
+			if requeued > 0 {
+				log.Printf("Requeued %d tasks with expired leases", requeued)
+				a.notifier.notify()
+			}
+			if killed > 0 {
+				log.Printf("%d tasks with expired leases are dead after %d attempts", killed, maxAttempts)
+			}
+		}
 	}
 }
 
@@ -65,144 +128,129 @@ func (a *Application) AuthenticateUser(login, password string) (*models.AuthResp
 	}, nil
 }
 
-// AddExpression добавляет новое выражение для вычисления
-func (a *Application) AddExpression(expression string, userID string) (string, error) {
+// AddExpression добавляет новое выражение для вычисления в режиме mode.
+// variables - значения переменных выражения, сохраняются вместе с ним.
+// Выражение без операций возвращается уже посчитанным.
+func (a *Application) AddExpression(expression string, userID string, mode calculation.Mode, variables map[string]string) (*models.Expression, error) {
 	expressionID := uuid.New().String()
 
 	log.Printf("Creating expression %s for user %s", expressionID, userID)
 
-	tasks, err := calculation.ParseExpression(expression, expressionID)
+	plan, err := calculation.ParseExpression(expression, expressionID, variables)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	cfg := a.settings.Load()
+	for _, task := range plan.Tasks {
+		task.Mode = string(mode)
+		task.OperationTime = calculation.OperationTime(cfg, task.Operation)
 	}
 
 	expr := &models.Expression{
 		ID:         expressionID,
 		UserID:     userID,
 		Expression: expression,
+		Variables:  variables,
+		Mode:       string(mode),
 		Status:     "pending",
-		Tasks:      tasks,
+		Tasks:      plan.Tasks,
+		RootTaskID: plan.RootTaskID,
 		CreatedAt:  time.Now(),
 	}
 
-	if err := a.repository.AddExpression(expr); err != nil {
-		log.Printf("Failed to save expression: %v", err)
-		return "", fmt.Errorf("failed to save expression")
+	if len(plan.Tasks) == 0 {
+		// считать нечего: выражение - одно число, результат готов сразу
+		exact, err := calculation.FormatMode(mode, plan.Value)
+		if err != nil {
+			return nil, err
+		}
+		expr.Status = "completed"
+		expr.ExactResult = sql.NullString{String: exact, Valid: true}
+		if result, err := calculation.ToFloat(exact); err == nil {
+			expr.Result = sql.NullFloat64{Float64: result, Valid: true}
+		}
 	}
 
-	log.Printf("Successfully created expression %s", expressionID)
-	return expressionID, nil
-}
-
-// GetExpressionByID возвращает выражение по ID
-func (a *Application) GetExpressionByID(expressionID, userID string) (*models.ExpressionResponse, error) {
-	expr, exists := a.repository.GetExpressionByID(expressionID, userID)
-	if !exists {
-		return nil, fmt.Errorf("expression with ID %s not found", expressionID)
+	if err := a.repository.AddExpression(expr); err != nil {
+		log.Printf("Failed to save expression: %v", err)
+		return nil, fmt.Errorf("failed to save expression")
 	}
 
-	var result *float64
-	if expr.Status == "completed" {
-		result = &expr.Result.Float64
-	}
-	return &models.ExpressionResponse{
-		ID:         expr.ID,
-		Expression: expr.Expression,
-		Status:     expr.Status,
-		Result:     result,
-		CreatedAt:  expr.CreatedAt,
-		FinishedAt: expr.FinishedAt,
-	}, nil
-}
-
-// GetAllExpressions возвращает все выражения пользователя
-func (a *Application) GetAllExpressions(userID string) ([]*models.ExpressionResponse, error) {
-	expressions := a.repository.GetAllExpressions(userID)
-	response := make([]*models.ExpressionResponse, 0, len(expressions))
-
-	for _, expr := range expressions {
-		var result *float64
-		if expr.Status == "completed" {
-			result = &expr.Result.Float64
+	if len(plan.Tasks) > 0 {
+		// выражение, которое не может посчитать ни один агент на связи,
+		// сразу становится blocked, не дожидаясь проверки по таймеру
+		a.updateBlocked(expressionID)
+		if saved, found := a.repository.GetExpressionByID(expressionID, userID); found {
+			expr.Status = saved.Status
 		}
-
-		response = append(response, &models.ExpressionResponse{
-			ID:         expr.ID,
-			Expression: expr.Expression,
-			Status:     expr.Status,
-			Result:     result,
-			CreatedAt:  expr.CreatedAt,
-			FinishedAt: expr.FinishedAt,
-		})
+		a.notifier.notify()
 	}
 
-	return response, nil
+	log.Printf("Successfully created expression %s", expressionID)
+	return expr, nil
 }
 
-// GetPendingTask возвращает следующую задачу для вычисления
-func (a *Application) GetPendingTask() (*models.TaskResponse, error) {
-	task, exists := a.repository.GetPendingTask()
-	if !exists {
-		return nil, fmt.Errorf("no pending tasks")
+// decimalApproximation записывает результат выражения в режиме rational
+// десятичной дробью с digits знаками. Для других режимов возвращает nil.
+func decimalApproximation(expr *models.Expression, digits int) *string {
+	if expr.Status != "completed" || expr.Mode != string(calculation.ModeRational) || !expr.ExactResult.Valid {
+		return nil
 	}
-
-	return &models.TaskResponse{
-		ID:           task.ID,
-		ExpressionID: task.ExpressionID,
-		Operation:    task.Operation,
-		Status:       task.Status,
-		CreatedAt:    task.CreatedAt,
-	}, nil
+	decimal, err := calculation.Approximate(expr.ExactResult.String, digits)
+	if err != nil {
+		log.Printf("Error approximating result of expression %s: %v", expr.ID, err)
+		return nil
+	}
+	return &decimal
 }
 
-// UpdateTaskResult обновляет результат выполнения задачи
-func (a *Application) UpdateTaskResult(taskID string, result float64, errMsg string) error {
-	if errMsg != "" {
-		a.repository.UpdateTaskStatus(taskID, "error", 0)
-		return fmt.Errorf("task %s failed: %s", taskID, errMsg)
+// RegisterAgent сохраняет агента в реестре. Агент, не сообщивший, сколько
+// задач считает одновременно, считается однопоточным.
+func (a *Application) RegisterAgent(agent *models.Agent) error {
+	if agent.ComputingPower == 0 {
+		agent.ComputingPower = 1
 	}
-
-	a.repository.UpdateTaskStatus(taskID, "completed", result)
+	if err := a.repository.RegisterAgent(agent); err != nil {
+		return err
+	}
+	log.Printf("Agent %s registered: host=%s, version=%s, computing power=%d, operations=%v, modes=%v, max operand size=%d",
+		agent.ID, agent.Hostname, agent.Version, agent.ComputingPower, agent.Operations, agent.Modes, agent.MaxOperandSize)
+	// новый агент может посчитать то, что не могли остальные
+	a.updateBlocked("")
+	// запросы агента, которые уже ждут задачу, проверят её с новыми возможностями
+	a.notifier.notify()
 	return nil
 }
 
-// GetUserHistory возвращает историю вычислений пользователя
-func (a *Application) GetUserHistory(userID string) ([]*models.ExpressionResponse, error) {
-	history, err := a.repository.GetUserHistory(userID)
+// updateBlocked помечает blocked выражения, которые не может посчитать ни один
+// агент в сети, и снимает пометку, когда такой агент появился. Пока агентов
+// нет совсем, статусы не меняются: выражения просто ждут первого агента.
+// Непустой expressionID ограничивает проверку одним выражением.
+func (a *Application) updateBlocked(expressionID string) {
+	agents, err := a.repository.GetAgents()
 	if err != nil {
-		return nil, err
+		log.Printf("Failed to get agents: %v", err)
+		return
 	}
-
-	response := make([]*models.ExpressionResponse, 0, len(history))
-	for _, expr := range history {
-		var result *float64
-		if expr.Status == "completed" {
-			result = &expr.Result.Float64
+	var online []models.Capabilities
+	for _, agent := range agents {
+		if agent.Status == "online" {
+			online = append(online, agent.Capabilities)
 		}
-
-		response = append(response, &models.ExpressionResponse{
-			ID:         expr.ID,
-			Expression: expr.Expression,
-			Status:     expr.Status,
-			Result:     result,
-			CreatedAt:  expr.CreatedAt,
-			FinishedAt: expr.FinishedAt,
-		})
 	}
-
-	return response, nil
-}
-
-// GetTaskResult возвращает результат выполнения задачи
-func (a *Application) GetTaskResult(taskID string) (*float64, error) {
-	task, exists := a.repository.GetTaskByID(taskID)
-	if !exists {
-		return nil, fmt.Errorf("task with ID %s not found", taskID)
+	if len(online) == 0 {
+		return
 	}
 
-	if task.Status != "completed" {
-		return nil, fmt.Errorf("task with ID %s is not completed", taskID)
+	blocked, unblocked, err := a.repository.UpdateBlockedExpressions(online, expressionID)
+	if err != nil {
+		log.Printf("Failed to update blocked expressions: %v", err)
+		return
+	}
+	if blocked > 0 {
+		log.Printf("%d expressions are blocked: no online agent supports their tasks", blocked)
+	}
+	if unblocked > 0 {
+		log.Printf("%d expressions are unblocked", unblocked)
 	}
-
-	return &task.Result.Float64, nil
 }
@@ -0,0 +1,180 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zalhui/calc_golang/internal/common/models"
+	"github.com/zalhui/calc_golang/internal/orchestrator/repository"
+	"github.com/zalhui/calc_golang/pkg/calculation"
+)
+
+// maxTaskWait - дольше агент не может ждать задачу в одном запросе
+const maxTaskWait = time.Minute
+
+// maxTaskBatch - больше задач агент не может взять или сдать одним запросом
+const maxTaskBatch = 100
+
+// readyNotifier будит всех, кто ждёт задачи, когда появляются новые готовые задачи
+type readyNotifier struct {
+	mu    sync.Mutex
+	ready chan struct{}
+}
+
+func newReadyNotifier() *readyNotifier {
+	return &readyNotifier{ready: make(chan struct{})}
+}
+
+// wait возвращает канал, который закроется при следующем notify
+func (n *readyNotifier) wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.ready
+}
+
+func (n *readyNotifier) notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	close(n.ready)
+	n.ready = make(chan struct{})
+}
+
+// WaitForTask выдаёт агенту owner задачу, которую он умеет считать, а если
+// таких нет, ждёт их не дольше wait. Возможности агента перечитываются перед
+// каждой попыткой: агент мог зарегистрироваться, пока ждал. Возвращает false,
+// если задача так и не появилась или отменили ctx.
+func (a *Application) WaitForTask(ctx context.Context, owner string, wait time.Duration) (*models.Task, bool) {
+	tasks := a.WaitForTasks(ctx, owner, 1, wait)
+	if len(tasks) == 0 {
+		return nil, false
+	}
+	return tasks[0], true
+}
+
+// WaitForTasks выдаёт агенту owner до limit задач, как WaitForTask:
+// ждёт, пока появится хотя бы одна, и берёт все готовые на этот момент.
+// Очередь проверяется заново по notify и когда кончается пауза перед
+// повтором у одной из задач: без уведомления доступной становится только она.
+func (a *Application) WaitForTasks(ctx context.Context, owner string, limit int, wait time.Duration) []*models.Task {
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+
+	for {
+		// канал берётся до проверки очереди, чтобы не пропустить уведомление между ними
+		ready := a.notifier.wait()
+		now := time.Now()
+		if tasks := a.repository.ClaimTasks(owner, a.lease, a.agentCapabilities(owner), limit); len(tasks) > 0 {
+			return tasks
+		}
+
+		var retry <-chan time.Time
+		if next, ok := a.repository.NextRetryAt(now); ok {
+			retry = time.After(time.Until(next))
+		}
+
+		select {
+		case <-ready:
+		case <-retry:
+		case <-deadline.C:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// agentCapabilities - что агент owner объявил при регистрации.
+// Агенты, которые не регистрировались, получают любые задачи.
+func (a *Application) agentCapabilities(owner string) *models.Capabilities {
+	caps, err := a.repository.GetAgentCapabilities(owner)
+	if err != nil {
+		log.Printf("Failed to get capabilities of agent %s: %v", owner, err)
+		return nil
+	}
+	return caps
+}
+
+// SubmitTaskResult сохраняет результат или ошибку задачи, которую считал агент owner,
+// и будит агентов, которые ждут задачи: после неё могли стать готовыми следующие
+func (a *Application) SubmitTaskResult(taskID, owner string, result float64, exactResult, errMsg, errClass string) error {
+	var err error
+	if errMsg != "" {
+		err = a.FailTask(taskID, owner, errClass, errMsg)
+	} else {
+		// агенты без поддержки режимов присылают только result
+		if exactResult == "" {
+			exactResult = calculation.FormatFloat(result)
+		}
+		err = a.repository.UpdateTaskStatus(taskID, owner, "completed", result, exactResult)
+	}
+	if err == nil {
+		a.notifier.notify()
+	}
+	return err
+}
+
+// SubmitTaskResults сохраняет результаты задач агента owner. Посчитанные
+// задачи сохраняются одной транзакцией, ошибки - по одной, как у SubmitTaskResult.
+// Возвращает ошибку для каждого результата, nil - результат принят.
+func (a *Application) SubmitTaskResults(owner string, results []models.TaskResult) []error {
+	errs := make([]error, len(results))
+	var updates []repository.TaskUpdate
+	var updated []int // индексы results, которые вошли в updates
+	for i, res := range results {
+		if res.Error != "" {
+			errs[i] = a.FailTask(res.ID, owner, res.ErrorClass, res.Error)
+			continue
+		}
+		exactResult := res.ExactResult
+		if exactResult == "" {
+			exactResult = calculation.FormatFloat(res.Result)
+		}
+		updates = append(updates, repository.TaskUpdate{ID: res.ID, Status: "completed", Result: res.Result, ExactResult: exactResult})
+		updated = append(updated, i)
+	}
+
+	if len(updates) > 0 {
+		updateErrs, err := a.repository.UpdateTaskStatuses(owner, updates)
+		for j, i := range updated {
+			if err != nil {
+				errs[i] = err
+			} else {
+				errs[i] = updateErrs[j]
+			}
+		}
+		if err != nil {
+			log.Printf("Failed to save results of %d tasks: %v", len(updates), err)
+		}
+	}
+
+	a.notifier.notify()
+	return errs
+}
+
+// taskErrorStatus - код ответа агенту на ошибку сохранения результата или продления аренды
+func taskErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, repository.ErrTaskCancelled):
+		return http.StatusGone
+	case errors.Is(err, repository.ErrLeaseLost):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// taskPayload - задача в том виде, в котором её получает агент
+func taskPayload(task *models.Task) map[string]interface{} {
+	return map[string]interface{}{
+		"id":               task.ID,
+		"expression_id":    task.ExpressionID,
+		"args":             task.Args,
+		"operation":        task.Operation,
+		"mode":             task.Mode,
+		"lease_expires_at": task.LeaseExpiresAt,
+		"attempts":         task.Attempts,
+	}
+}
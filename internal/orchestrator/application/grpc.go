@@ -0,0 +1,202 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/zalhui/calc_golang/internal/common/agentpb"
+	"github.com/zalhui/calc_golang/internal/common/models"
+	"github.com/zalhui/calc_golang/internal/orchestrator/repository"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// agentServer - то же, что внутренние эндпоинты /internal, только по gRPC
+type agentServer struct {
+	agentpb.UnimplementedAgentServer
+	app *Application
+}
+
+// RegisterAgentServer добавляет к gRPC-серверу сервис для агентов
+func (a *Application) RegisterAgentServer(s *grpc.Server) {
+	agentpb.RegisterAgentServer(s, &agentServer{app: a})
+}
+
+func (s *agentServer) GetTask(ctx context.Context, req *agentpb.GetTaskRequest) (*agentpb.GetTaskResponse, error) {
+	wait := req.GetWait().AsDuration()
+	if wait < 0 || wait > maxTaskWait {
+		return nil, status.Errorf(codes.InvalidArgument, "wait must be a duration from 0s to %s", maxTaskWait)
+	}
+
+	task, exists := s.app.WaitForTask(ctx, grpcAgentID(ctx), wait)
+	if !exists {
+		return nil, status.Error(codes.NotFound, "No tasks available")
+	}
+	return &agentpb.GetTaskResponse{Task: taskMessage(task)}, nil
+}
+
+func (s *agentServer) SubmitResult(ctx context.Context, req *agentpb.SubmitResultRequest) (*agentpb.SubmitResultResponse, error) {
+	if req.GetTaskId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Missing task ID")
+	}
+
+	err := s.app.SubmitTaskResult(req.GetTaskId(), grpcAgentID(ctx), req.GetResult(), req.GetExactResult(), req.GetError(), req.GetErrorClass())
+	if err != nil {
+		return nil, status.Error(taskErrorCode(err), err.Error())
+	}
+	return &agentpb.SubmitResultResponse{}, nil
+}
+
+func (s *agentServer) Heartbeat(ctx context.Context, req *agentpb.HeartbeatRequest) (*agentpb.HeartbeatResponse, error) {
+	if req.GetTaskId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Missing task ID")
+	}
+
+	expiresAt, err := s.app.repository.RenewLease(req.GetTaskId(), grpcAgentID(ctx), s.app.lease)
+	if err != nil {
+		return nil, status.Error(taskErrorCode(err), err.Error())
+	}
+	return &agentpb.HeartbeatResponse{LeaseExpiresAt: timestamppb.New(expiresAt)}, nil
+}
+
+// TaskStream работает как AgentWebSocketHandler: задачи уходят агенту, как только
+// готовы, а ответы на heartbeat и result несут код ошибки вместо статуса вызова
+func (s *agentServer) TaskStream(stream agentpb.Agent_TaskStreamServer) error {
+	ctx := stream.Context()
+	owner := grpcAgentID(ctx)
+	log.Printf("Agent %s connected over gRPC stream", owner)
+
+	// Send нельзя вызывать после выхода из обработчика, поэтому ждём pushTasks
+	var pushing sync.WaitGroup
+	defer pushing.Wait()
+
+	var sendMu sync.Mutex
+	send := func(msg *agentpb.OrchestratorMessage) error {
+		sendMu.Lock()
+		defer sendMu.Unlock()
+		return stream.Send(msg)
+	}
+	var demand taskDemand
+
+	for {
+		msg, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			log.Printf("Agent %s disconnected", owner)
+			return nil
+		}
+		if err != nil {
+			log.Printf("Agent %s disconnected: %v", owner, err)
+			return err
+		}
+
+		switch kind := msg.Kind.(type) {
+		case *agentpb.AgentMessage_Ready:
+			if !demand.add() {
+				continue
+			}
+			pushing.Add(1)
+			go func() {
+				defer pushing.Done()
+				s.app.pushTasks(ctx, owner, &demand, func(task *models.Task) error {
+					return send(&agentpb.OrchestratorMessage{Kind: &agentpb.OrchestratorMessage_Task{Task: taskMessage(task)}})
+				})
+			}()
+		case *agentpb.AgentMessage_Heartbeat:
+			reply := &agentpb.Reply{TaskId: kind.Heartbeat.GetTaskId()}
+			expiresAt, err := s.app.repository.RenewLease(reply.TaskId, owner, s.app.lease)
+			if err != nil {
+				reply.Code, reply.Error = int32(taskErrorCode(err)), err.Error()
+			} else {
+				reply.LeaseExpiresAt = timestamppb.New(expiresAt)
+			}
+			send(&agentpb.OrchestratorMessage{Kind: &agentpb.OrchestratorMessage_Heartbeat{Heartbeat: reply}})
+		case *agentpb.AgentMessage_Result:
+			res := kind.Result
+			reply := &agentpb.Reply{TaskId: res.GetTaskId()}
+			err := s.app.SubmitTaskResult(res.GetTaskId(), owner, res.GetResult(), res.GetExactResult(), res.GetError(), res.GetErrorClass())
+			if err != nil {
+				reply.Code, reply.Error = int32(taskErrorCode(err)), err.Error()
+			}
+			send(&agentpb.OrchestratorMessage{Kind: &agentpb.OrchestratorMessage_Result{Result: reply}})
+		default:
+			return status.Error(codes.InvalidArgument, "unknown message")
+		}
+	}
+}
+
+func (s *agentServer) Register(ctx context.Context, req *agentpb.RegisterRequest) (*agentpb.RegisterResponse, error) {
+	if req.GetComputingPower() < 0 || req.GetMaxOperandSize() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "computing_power and max_operand_size must not be negative")
+	}
+
+	agent := &models.Agent{
+		ID:             grpcAgentID(ctx),
+		Hostname:       req.GetHostname(),
+		Version:        req.GetVersion(),
+		ComputingPower: int(req.GetComputingPower()),
+		Capabilities: models.Capabilities{
+			Operations:     req.GetOperations(),
+			Modes:          req.GetModes(),
+			MaxOperandSize: int(req.GetMaxOperandSize()),
+		},
+	}
+	if err := s.app.RegisterAgent(agent); err != nil {
+		return nil, status.Error(codes.Internal, "Failed to register agent")
+	}
+	return &agentpb.RegisterResponse{}, nil
+}
+
+func (s *agentServer) AgentHeartbeat(ctx context.Context, req *agentpb.AgentHeartbeatRequest) (*agentpb.AgentHeartbeatResponse, error) {
+	err := s.app.repository.AgentHeartbeat(grpcAgentID(ctx), time.Now())
+	if errors.Is(err, repository.ErrAgentNotFound) {
+		return nil, status.Error(codes.NotFound, "Agent not registered")
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Failed to save heartbeat")
+	}
+	return &agentpb.AgentHeartbeatResponse{}, nil
+}
+
+// grpcAgentID - id агента из его токена, как agentID у HTTP.
+// Его кладут в контекст перехватчики middleware.AgentAuth*Interceptor.
+func grpcAgentID(ctx context.Context) string {
+	id, _ := ctx.Value("agentID").(string)
+	return id
+}
+
+// taskErrorCode - код gRPC для ошибки сохранения результата или продления аренды
+func taskErrorCode(err error) codes.Code {
+	switch {
+	case errors.Is(err, repository.ErrTaskCancelled):
+		return codes.FailedPrecondition
+	case errors.Is(err, repository.ErrLeaseLost):
+		return codes.Aborted
+	}
+	return codes.Internal
+}
+
+// taskMessage - задача в том виде, в котором её получает агент по gRPC
+func taskMessage(task *models.Task) *agentpb.Task {
+	args := make([]*agentpb.Operand, 0, len(task.Args))
+	for _, arg := range task.Args {
+		args = append(args, &agentpb.Operand{Value: arg.Value, TaskId: arg.TaskID})
+	}
+	msg := &agentpb.Task{
+		Id:           task.ID,
+		ExpressionId: task.ExpressionID,
+		Args:         args,
+		Operation:    task.Operation,
+		Mode:         task.Mode,
+		Attempts:     int32(task.Attempts),
+	}
+	if !task.LeaseExpiresAt.IsZero() {
+		msg.LeaseExpiresAt = timestamppb.New(task.LeaseExpiresAt)
+	}
+	return msg
+}
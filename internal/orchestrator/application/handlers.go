@@ -1,11 +1,19 @@
 package application
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/zalhui/calc_golang/internal/auth"
+	"github.com/zalhui/calc_golang/internal/common/models"
+	"github.com/zalhui/calc_golang/internal/orchestrator/repository"
+	"github.com/zalhui/calc_golang/pkg/calculation"
 )
 
 func (a *Application) RegisterHandler(w http.ResponseWriter, r *http.Request) {
@@ -63,7 +71,9 @@ func (a *Application) AddExpressionHandler(w http.ResponseWriter, r *http.Reques
 	}
 
 	var req struct {
-		Expression string `json:"expression"`
+		Expression string                 `json:"expression"`
+		Variables  map[string]json.Number `json:"variables"`
+		Mode       string                 `json:"mode"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -71,20 +81,78 @@ func (a *Application) AddExpressionHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	expressionID, err := a.AddExpression(req.Expression, userID)
+	mode, err := calculation.ParseMode(req.Mode)
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// json.Number хранит число так, как его записал клиент, без потерь float64
+	var variables map[string]string
+	if len(req.Variables) > 0 {
+		variables = make(map[string]string, len(req.Variables))
+		for name, value := range req.Variables {
+			variables[name] = value.String()
+		}
+	}
+
+	expr, err := a.AddExpression(req.Expression, userID, mode, variables)
+	if err != nil {
+		var parseErr *calculation.ParseError
+		if errors.As(err, &parseErr) {
+			writeParseError(w, parseErr)
+			return
+		}
+		var unboundErr *calculation.UnboundError
+		if errors.As(err, &unboundErr) {
+			writeUnboundError(w, unboundErr)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
 		return
 	}
 
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]string{
-		"id":      expressionID,
-		"status":  "pending",
+		"id":      expr.ID,
+		"status":  expr.Status,
 		"message": "Expression accepted for processing",
 	})
 }
 
+// writeParseError отвечает 422 с описанием места ошибки в выражении
+func writeParseError(w http.ResponseWriter, err *calculation.ParseError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":   err.Error(),
+		"code":    err.Code,
+		"offset":  err.Offset,
+		"length":  err.Length,
+		"token":   err.Token,
+		"snippet": err.Snippet(),
+	})
+}
+
+// writeUnboundError отвечает 422 со списком переменных без значений и их позициями
+func writeUnboundError(w http.ResponseWriter, err *calculation.UnboundError) {
+	variables := make([]map[string]interface{}, 0, len(err.Variables))
+	for _, v := range err.Variables {
+		variables = append(variables, map[string]interface{}{
+			"name":   v.Name,
+			"offset": v.Pos(),
+			"length": v.End() - v.Pos(),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":     err.Error(),
+		"code":      calculation.CodeUnbound,
+		"variables": variables,
+	})
+}
+
 func (a *Application) GetExpressionByIDHandler(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value("userID").(string)
 	if !ok {
@@ -99,25 +167,91 @@ func (a *Application) GetExpressionByIDHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	digits, err := parseDigits(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	expression, exists := a.repository.GetExpressionByID(expressionID, userID)
 	if !exists {
 		http.Error(w, "Expression not found", http.StatusNotFound)
 		return
 	}
-	var result interface{}
-	if expression.Result.Valid {
-		result = expression.Result.Float64
-	} else {
-		result = nil
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(expressionPayload(expression, digits))
+}
+
+// expressionPayload - выражение в ответах API: результат числом и строкой
+// или null, пока его нет. digits - знаки в приближении дроби режима rational.
+func expressionPayload(expr *models.Expression, digits int) map[string]interface{} {
+	var result, exactResult interface{}
+	if expr.Result.Valid {
+		result = expr.Result.Float64
+	}
+	if expr.ExactResult.Valid {
+		exactResult = expr.ExactResult.String
+	}
+	payload := map[string]interface{}{
+		"id":           expr.ID,
+		"expression":   expr.Expression,
+		"variables":    expr.Variables,
+		"mode":         expr.Mode,
+		"status":       expr.Status,
+		"result":       result,
+		"exact_result": exactResult,
+		"created":      expr.CreatedAt,
+	}
+	if decimal := decimalApproximation(expr, digits); decimal != nil {
+		payload["decimal"] = *decimal
 	}
+	return payload
+}
+
+// CancelExpressionHandler отменяет выражение, которое ещё считается
+func (a *Application) CancelExpressionHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value("userID").(string)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	expressionID := mux.Vars(r)["id"]
+	err := a.repository.CancelExpression(expressionID, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Expression not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, repository.ErrNotCancellable) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to cancel expression", http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"id":         expression.ID,
-		"expression": expression.Expression,
-		"status":     expression.Status,
-		"result":     result,
-		"created":    expression.CreatedAt,
-	})
+	json.NewEncoder(w).Encode(map[string]string{"id": expressionID, "status": "cancelled"})
+}
+
+// defaultDigits и maxDigits - знаки после запятой в приближении дроби режима rational
+const (
+	defaultDigits = 10
+	maxDigits     = 1000
+)
+
+// parseDigits читает параметр запроса digits, без него возвращает defaultDigits
+func parseDigits(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("digits")
+	if value == "" {
+		return defaultDigits, nil
+	}
+	digits, err := strconv.Atoi(value)
+	if err != nil || digits < 0 || digits > maxDigits {
+		return 0, fmt.Errorf("digits must be an integer from 0 to %d", maxDigits)
+	}
+	return digits, nil
 }
 
 func (a *Application) GetAllExpressionsHandler(w http.ResponseWriter, r *http.Request) {
@@ -127,39 +261,109 @@ func (a *Application) GetAllExpressionsHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	digits, err := parseDigits(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	expressions := a.repository.GetAllExpressions(userID)
 
 	w.Header().Set("Content-Type", "application/json")
 	response := make([]map[string]interface{}, 0, len(expressions))
 	for _, expr := range expressions {
-		response = append(response, map[string]interface{}{
-			"id":         expr.ID,
-			"expression": expr.Expression,
-			"status":     expr.Status,
-			"result":     expr.Result,
-			"created":    expr.CreatedAt,
-		})
+		response = append(response, expressionPayload(expr, digits))
 	}
 	json.NewEncoder(w).Encode(map[string]interface{}{"expressions": response})
 }
 
+// GetPendingTaskHandler выдаёт агенту задачу. С параметром wait, например
+// ?wait=30s, ждёт появления задачи до ответа 404, а не отвечает сразу.
 func (a *Application) GetPendingTaskHandler(w http.ResponseWriter, r *http.Request) {
-	task, exists := a.repository.GetPendingTask()
+	wait, ok := taskWait(w, r)
+	if !ok {
+		return
+	}
+
+	task, exists := a.WaitForTask(r.Context(), agentID(r), wait)
 	if !exists {
 		http.Error(w, "No tasks available", http.StatusNotFound)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"task": map[string]interface{}{
-			"id":            task.ID,
-			"expression_id": task.ExpressionID,
-			"arg1":          task.Arg1,
-			"arg2":          task.Arg2,
-			"operation":     task.Operation,
-		},
-	})
+	json.NewEncoder(w).Encode(map[string]interface{}{"task": taskPayload(task)})
+}
+
+// GetPendingTasksHandler выдаёт агенту до limit задач одним ответом, например
+// GET /internal/tasks?limit=4&wait=30s. Нет задач - пустой список.
+func (a *Application) GetPendingTasksHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 1
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxTaskBatch {
+			http.Error(w, fmt.Sprintf("limit must be a number from 1 to %d", maxTaskBatch), http.StatusBadRequest)
+			return
+		}
+	}
+	wait, ok := taskWait(w, r)
+	if !ok {
+		return
+	}
+
+	tasks := a.WaitForTasks(r.Context(), agentID(r), limit, wait)
+	response := make([]map[string]interface{}, 0, len(tasks))
+	for _, task := range tasks {
+		response = append(response, taskPayload(task))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"tasks": response})
+}
+
+// taskWait разбирает параметр wait запроса задач. Если он неверный,
+// отвечает 400 и возвращает false.
+func taskWait(w http.ResponseWriter, r *http.Request) (time.Duration, bool) {
+	value := r.URL.Query().Get("wait")
+	if value == "" {
+		return 0, true
+	}
+	wait, err := time.ParseDuration(value)
+	if err != nil || wait < 0 || wait > maxTaskWait {
+		http.Error(w, fmt.Sprintf("wait must be a duration from 0s to %s", maxTaskWait), http.StatusBadRequest)
+		return 0, false
+	}
+	// ожидание не должно упираться в WriteTimeout сервера
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(wait + 5*time.Second))
+	return wait, true
+}
+
+// RenewLeaseHandler продлевает аренду задачи, которую агент ещё считает
+func (a *Application) RenewLeaseHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID string `json:"id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == "" {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	expiresAt, err := a.repository.RenewLease(req.ID, agentID(r), a.lease)
+	if err != nil {
+		http.Error(w, err.Error(), taskErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"lease_expires_at": expiresAt})
+}
+
+// agentID возвращает id агента из его токена, его кладёт AgentAuthMiddleware
+func agentID(r *http.Request) string {
+	id, _ := r.Context().Value("agentID").(string)
+	return id
 }
 
 func (a *Application) SubmitTaskResultHandler(w http.ResponseWriter, r *http.Request) {
@@ -177,15 +381,18 @@ func (a *Application) SubmitTaskResultHandler(w http.ResponseWriter, r *http.Req
 		}
 
 		json.NewEncoder(w).Encode(map[string]interface{}{
-			"result": task.Result,
+			"result":       task.Result,
+			"exact_result": task.ExactResult.String,
 		})
 		return
 	}
 
 	var req struct {
-		ID     string  `json:"id"`
-		Result float64 `json:"result,omitempty"`
-		Error  string  `json:"error,omitempty"`
+		ID          string  `json:"id"`
+		Result      float64 `json:"result,omitempty"`
+		ExactResult string  `json:"exact_result,omitempty"`
+		Error       string  `json:"error,omitempty"`
+		ErrorClass  string  `json:"error_class,omitempty"` // transient, deterministic или released
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -193,16 +400,52 @@ func (a *Application) SubmitTaskResultHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	if req.Error != "" {
-		a.repository.UpdateTaskStatus(req.ID, "error", 0)
-	} else {
-		a.repository.UpdateTaskStatus(req.ID, "completed", req.Result)
+	// результат принимается только от агента, за которым числится задача
+	err := a.SubmitTaskResult(req.ID, agentID(r), req.Result, req.ExactResult, req.Error, req.ErrorClass)
+	if err != nil {
+		http.Error(w, err.Error(), taskErrorStatus(err))
+		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
 }
 
+// SubmitTaskResultsHandler принимает результаты нескольких задач одним запросом:
+// {"results": [{"id": ..., "result": ...}, ...]}. Посчитанные задачи сохраняются
+// одной транзакцией. Для каждого результата ответ содержит код, как у
+// /internal/task/result: 200 - принят, 409 - аренда потеряна, 410 - выражение отменено.
+func (a *Application) SubmitTaskResultsHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Results []models.TaskResult `json:"results"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Results) > maxTaskBatch {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	for _, res := range req.Results {
+		if res.ID == "" {
+			http.Error(w, "Missing task ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	errs := a.SubmitTaskResults(agentID(r), req.Results)
+
+	response := make([]map[string]interface{}, 0, len(errs))
+	for i, err := range errs {
+		item := map[string]interface{}{"id": req.Results[i].ID, "code": http.StatusOK}
+		if err != nil {
+			item["code"], item["error"] = taskErrorStatus(err), err.Error()
+		}
+		response = append(response, item)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": response})
+}
+
 func (a *Application) GetUserHistoryHandler(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value("userID").(string)
 	if !ok {
@@ -210,13 +453,173 @@ func (a *Application) GetUserHistoryHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	digits, err := parseDigits(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	history, err := a.repository.GetUserHistory(userID)
 	if err != nil {
 		http.Error(w, "Failed to get history", http.StatusInternalServerError)
 		return
 	}
 
+	response := make([]map[string]interface{}, 0, len(history))
+	for _, expr := range history {
+		response = append(response, expressionPayload(expr, digits))
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{"history": history})
+	json.NewEncoder(w).Encode(map[string]interface{}{"history": response})
+}
+
+// GetDeadTasksHandler показывает задачи, у которых кончились попытки
+func (a *Application) GetDeadTasksHandler(w http.ResponseWriter, r *http.Request) {
+	tasks, err := a.repository.GetDeadTasks()
+	if err != nil {
+		http.Error(w, "Failed to get dead tasks", http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]map[string]interface{}, 0, len(tasks))
+	for _, task := range tasks {
+		response = append(response, map[string]interface{}{
+			"id":            task.ID,
+			"expression_id": task.ExpressionID,
+			"operation":     task.Operation,
+			"mode":          task.Mode,
+			"attempts":      task.Attempts,
+			"last_error":    task.LastError,
+			"created":       task.CreatedAt,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"tasks": response})
+}
+
+// RedriveTaskHandler возвращает задачу из dead в очередь
+func (a *Application) RedriveTaskHandler(w http.ResponseWriter, r *http.Request) {
+	taskID := mux.Vars(r)["id"]
+
+	err := a.repository.RedriveTask(taskID)
+	if errors.Is(err, repository.ErrNotDead) {
+		http.Error(w, "Task not found or not dead", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to redrive task", http.StatusInternalServerError)
+		return
+	}
+	a.notifier.notify()
 
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"id": taskID, "status": "ready"})
+}
+
+// RegisterAgentHandler добавляет агента в реестр. Агент передаёт, какие операции,
+// режимы и операнды умеет считать и сколько задач одновременно, и дальше присылает heartbeat.
+func (a *Application) RegisterAgentHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID             string `json:"id"`
+		Hostname       string `json:"hostname"`
+		Version        string `json:"version"`
+		ComputingPower int    `json:"computing_power"`
+		models.Capabilities
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ComputingPower < 0 || req.MaxOperandSize < 0 {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	// агент регистрируется только под id из своего токена
+	if req.ID == "" {
+		req.ID = agentID(r)
+	}
+	if req.ID != agentID(r) {
+		http.Error(w, "Agent ID does not match the token", http.StatusForbidden)
+		return
+	}
+
+	agent := &models.Agent{
+		ID:             req.ID,
+		Hostname:       req.Hostname,
+		Version:        req.Version,
+		ComputingPower: req.ComputingPower,
+		Capabilities:   req.Capabilities,
+	}
+	if err := a.RegisterAgent(agent); err != nil {
+		http.Error(w, "Failed to register agent", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": agent.ID, "status": agent.Status})
+}
+
+// AgentHeartbeatHandler отмечает, что агент жив. Агент, которого нет
+// в реестре, получает 404 и должен зарегистрироваться снова.
+func (a *Application) AgentHeartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if id != agentID(r) {
+		http.Error(w, "Agent ID does not match the token", http.StatusForbidden)
+		return
+	}
+
+	err := a.repository.AgentHeartbeat(id, time.Now())
+	if errors.Is(err, repository.ErrAgentNotFound) {
+		http.Error(w, "Agent not registered", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to save heartbeat", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"id": id, "status": "online"})
+}
+
+// GetAgentsHandler возвращает агентов, которые сейчас на связи, и их возможности
+func (a *Application) GetAgentsHandler(w http.ResponseWriter, r *http.Request) {
+	agents, err := a.repository.GetAgents()
+	if err != nil {
+		http.Error(w, "Failed to get agents", http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]map[string]interface{}, 0, len(agents))
+	for _, agent := range agents {
+		if agent.Status != "online" {
+			continue
+		}
+		response = append(response, map[string]interface{}{
+			"id":               agent.ID,
+			"hostname":         agent.Hostname,
+			"version":          agent.Version,
+			"computing_power":  agent.ComputingPower,
+			"operations":       agent.Operations,
+			"modes":            agent.Modes,
+			"max_operand_size": agent.MaxOperandSize,
+			"last_seen_at":     agent.LastSeenAt,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"agents": response})
+}
+
+// GetAgentStatsHandler показывает операторам все агенты реестра, включая
+// потерянные, с числом задач, которые они считают сейчас и уже посчитали
+func (a *Application) GetAgentStatsHandler(w http.ResponseWriter, r *http.Request) {
+	agents, err := a.repository.GetAgents()
+	if err != nil {
+		http.Error(w, "Failed to get agents", http.StatusInternalServerError)
+		return
+	}
+	if agents == nil {
+		agents = []*models.Agent{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"agents": agents})
 }
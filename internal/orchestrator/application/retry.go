@@ -0,0 +1,83 @@
+package application
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/zalhui/calc_golang/config"
+	"github.com/zalhui/calc_golang/internal/common/models"
+)
+
+// RetryPolicy - сколько раз запускать задачу и сколько ждать перед повтором
+type RetryPolicy struct {
+	MaxAttempts int           // сколько всего раз задачу можно выдать агентам
+	BaseDelay   time.Duration // пауза перед вторым запуском, дальше удваивается
+	MaxDelay    time.Duration
+}
+
+// Backoff возвращает паузу перед запуском после attempt неудачных попыток
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		return p.MaxDelay
+	}
+	return delay
+}
+
+// retryPolicies собирает политики повторов по классам ошибок из конфигурации
+func retryPolicies(cfg *config.Config) map[string]RetryPolicy {
+	return map[string]RetryPolicy{
+		models.ErrorClassTransient: {
+			MaxAttempts: cfg.RetryMaxAttempts,
+			BaseDelay:   cfg.RetryBaseDelay,
+			MaxDelay:    cfg.RetryMaxDelay,
+		},
+		models.ErrorClassDeterministic: {
+			MaxAttempts: cfg.ErrorMaxAttempts,
+			BaseDelay:   cfg.RetryBaseDelay,
+			MaxDelay:    cfg.RetryMaxDelay,
+		},
+	}
+}
+
+// FailTask обрабатывает ошибку errMsg класса class, которую прислал агент owner.
+// Пока попытки не кончились, задача возвращается в очередь с паузой по политике класса.
+// Когда кончились, ошибка вроде деления на ноль завершает выражение, как раньше,
+// а задача с временными ошибками уходит в dead, откуда её можно запустить снова.
+// Задачу, которую вернул останавливающийся агент, сразу получат другие.
+func (a *Application) FailTask(taskID, owner, class, errMsg string) error {
+	if class == models.ErrorClassReleased {
+		log.Printf("Task %s released by agent %s: %s", taskID, owner, errMsg)
+		return a.repository.ReleaseTask(taskID, owner)
+	}
+
+	policies := retryPolicies(a.settings.Load())
+	policy, ok := policies[class]
+	if !ok {
+		// агенты без классов ошибок присылают только ошибки вычисления
+		class = models.ErrorClassDeterministic
+		policy = policies[class]
+	}
+
+	task, exists := a.repository.GetTaskByID(taskID)
+	if !exists {
+		return fmt.Errorf("task with ID %s not found", taskID)
+	}
+
+	if task.Attempts < policy.MaxAttempts {
+		notBefore := time.Now().Add(policy.Backoff(task.Attempts))
+		log.Printf("Task %s failed on attempt %d (%s), retrying after %s: %s",
+			taskID, task.Attempts, class, notBefore.Format(time.RFC3339), errMsg)
+		return a.repository.RetryTask(taskID, owner, errMsg, notBefore)
+	}
+
+	if class == models.ErrorClassDeterministic {
+		return a.repository.UpdateTaskStatus(taskID, owner, "error", 0, "")
+	}
+	log.Printf("Task %s is dead after %d attempts: %s", taskID, task.Attempts, errMsg)
+	return a.repository.KillTask(taskID, owner, errMsg)
+}
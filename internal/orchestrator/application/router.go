@@ -0,0 +1,55 @@
+package application
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/zalhui/calc_golang/config"
+	"github.com/zalhui/calc_golang/internal/middleware"
+)
+
+// NewRouter собирает маршруты оркестратора: API пользователей, /internal для
+// агентов и /admin для операторов. В режиме mTLS /internal нет в router, он
+// в отдельном internal для listener'а с сертификатами, иначе internal == router.
+func NewRouter(app *Application, cfg *config.Config) (router, internal *mux.Router) {
+	router = mux.NewRouter()
+
+	// Публичные эндпоинты
+	publicRouter := router.PathPrefix("/api/v1").Subrouter()
+	publicRouter.HandleFunc("/register", app.RegisterHandler).Methods("POST")
+	publicRouter.HandleFunc("/login", app.LoginHandler).Methods("POST")
+
+	// Защищенные эндпоинты
+	protectedRouter := router.PathPrefix("/api/v1").Subrouter()
+	protectedRouter.Use(middleware.JWTAuthMiddleware)
+
+	protectedRouter.HandleFunc("/calculate", app.AddExpressionHandler).Methods("POST")
+	protectedRouter.HandleFunc("/expressions", app.GetAllExpressionsHandler).Methods("GET")
+	protectedRouter.HandleFunc("/expressions/{id}", app.GetExpressionByIDHandler).Methods("GET")
+	protectedRouter.HandleFunc("/expressions/{id}/cancel", app.CancelExpressionHandler).Methods("POST")
+	protectedRouter.HandleFunc("/history", app.GetUserHistoryHandler).Methods("GET")
+
+	// Внутренние эндпоинты для агентов
+	internal = router
+	if cfg.MTLSEnabled() {
+		internal = mux.NewRouter()
+	}
+	internalRouter := internal.PathPrefix("/internal").Subrouter()
+	internalRouter.Use(middleware.AgentAuthMiddleware)
+	internalRouter.HandleFunc("/task", app.GetPendingTaskHandler).Methods("GET")
+	internalRouter.HandleFunc("/task/result", app.SubmitTaskResultHandler).Methods("POST", "GET")
+	internalRouter.HandleFunc("/task/lease", app.RenewLeaseHandler).Methods("POST")
+	internalRouter.HandleFunc("/tasks", app.GetPendingTasksHandler).Methods("GET")
+	internalRouter.HandleFunc("/tasks/results", app.SubmitTaskResultsHandler).Methods("POST")
+	internalRouter.HandleFunc("/ws", app.AgentWebSocketHandler).Methods("GET")
+	internalRouter.HandleFunc("/agents", app.RegisterAgentHandler).Methods("POST")
+	internalRouter.HandleFunc("/agents", app.GetAgentsHandler).Methods("GET")
+	internalRouter.HandleFunc("/agents/{id}/heartbeat", app.AgentHeartbeatHandler).Methods("POST")
+
+	// Эндпоинты для операторов
+	adminRouter := router.PathPrefix("/admin").Subrouter()
+	adminRouter.Use(middleware.AdminAuth(cfg.AdminToken))
+	adminRouter.HandleFunc("/tasks/dead", app.GetDeadTasksHandler).Methods("GET")
+	adminRouter.HandleFunc("/tasks/{id}/redrive", app.RedriveTaskHandler).Methods("POST")
+	adminRouter.HandleFunc("/agents", app.GetAgentStatsHandler).Methods("GET")
+
+	return router, internal
+}
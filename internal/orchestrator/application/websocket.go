@@ -0,0 +1,157 @@
+package application
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/zalhui/calc_golang/internal/common/models"
+)
+
+var upgrader = websocket.Upgrader{
+	// агенты не браузеры, Origin не проверяем
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// agentMessage - сообщение агента по WebSocket:
+//
+//	{"type": "ready"} - агент готов взять ещё одну задачу;
+//	{"type": "lease", "id": ...} - продлить аренду задачи;
+//	{"type": "result", "id": ..., "exact_result": ...} или с "error" - результат задачи.
+//
+// Оркестратор отвечает {"type": "task", "task": {...}} на каждый ready, когда
+// задача появится, и {"type": "lease"|"result", "id": ..., "code": ...} с кодом
+// HTTP на lease и result: 409 - аренда потеряна, 410 - выражение отменено.
+type agentMessage struct {
+	Type        string  `json:"type"`
+	ID          string  `json:"id"`
+	Result      float64 `json:"result"`
+	ExactResult string  `json:"exact_result"`
+	Error       string  `json:"error"`
+	ErrorClass  string  `json:"error_class"`
+}
+
+// AgentWebSocketHandler держит постоянное соединение с агентом: оркестратор сам
+// отправляет ему задачи, как только они готовы, а агент присылает по нему же
+// результаты и продлевает аренду
+func (a *Application) AgentWebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	owner := agentID(r)
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Error upgrading agent %s connection: %v", owner, err)
+		return
+	}
+	defer conn.Close()
+	log.Printf("Agent %s connected over WebSocket", owner)
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	var writeMu sync.Mutex
+	send := func(msg map[string]interface{}) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return conn.WriteJSON(msg)
+	}
+	var demand taskDemand
+
+	for {
+		var msg agentMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			log.Printf("Agent %s disconnected: %v", owner, err)
+			return
+		}
+
+		switch msg.Type {
+		case "ready":
+			if demand.add() {
+				go a.pushTasks(ctx, owner, &demand, func(task *models.Task) error {
+					return send(map[string]interface{}{"type": "task", "task": taskPayload(task)})
+				})
+			}
+		case "lease":
+			reply := map[string]interface{}{"type": "lease", "id": msg.ID, "code": http.StatusOK}
+			expiresAt, err := a.repository.RenewLease(msg.ID, owner, a.lease)
+			if err != nil {
+				reply["code"], reply["error"] = taskErrorStatus(err), err.Error()
+			} else {
+				reply["lease_expires_at"] = expiresAt
+			}
+			send(reply)
+		case "result":
+			reply := map[string]interface{}{"type": "result", "id": msg.ID, "code": http.StatusOK}
+			if err := a.SubmitTaskResult(msg.ID, owner, msg.Result, msg.ExactResult, msg.Error, msg.ErrorClass); err != nil {
+				reply["code"], reply["error"] = taskErrorStatus(err), err.Error()
+			}
+			send(reply)
+		default:
+			send(map[string]interface{}{"type": "error", "code": http.StatusBadRequest, "error": "unknown message type " + msg.Type})
+		}
+	}
+}
+
+// taskDemand - сколько задач агент запросил по соединению и ещё не получил.
+// Задачи для соединения берёт один pushTasks за раз, сколько бы ready ни пришло.
+type taskDemand struct {
+	mu      sync.Mutex
+	wanted  int
+	pushing bool
+}
+
+// add учитывает ещё один ready. Возвращает true, если pushTasks для
+// соединения не запущен и его нужно запустить.
+func (d *taskDemand) add() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.wanted++
+	if d.pushing {
+		return false
+	}
+	d.pushing = true
+	return true
+}
+
+// pending - сколько задач агент ещё ждёт
+func (d *taskDemand) pending() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.wanted
+}
+
+// sent учитывает n отправленных задач. Возвращает false, если агент больше
+// ничего не ждёт и pushTasks должен остановиться.
+func (d *taskDemand) sent(n int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.wanted -= n
+	if d.wanted > 0 {
+		return true
+	}
+	d.pushing = false
+	return false
+}
+
+// pushTasks ждёт готовые задачи и отправляет их агенту, пока он их ждёт и
+// соединение открыто. Задачи, которые не удалось отправить, сразу
+// возвращаются в очередь, как задачи остановившегося агента.
+func (a *Application) pushTasks(ctx context.Context, owner string, demand *taskDemand, send func(*models.Task) error) {
+	for ctx.Err() == nil {
+		tasks := a.WaitForTasks(ctx, owner, min(demand.pending(), maxTaskBatch), maxTaskWait)
+		for i, task := range tasks {
+			if err := send(task); err != nil {
+				log.Printf("Error sending task %s to agent %s: %v", task.ID, owner, err)
+				for _, unsent := range tasks[i:] {
+					if err := a.SubmitTaskResult(unsent.ID, owner, 0, "", "not delivered to agent", models.ErrorClassReleased); err != nil {
+						log.Printf("Failed to release task %s: %v", unsent.ID, err)
+					}
+				}
+				return
+			}
+		}
+		if !demand.sent(len(tasks)) {
+			return
+		}
+	}
+}
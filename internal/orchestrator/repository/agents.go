@@ -0,0 +1,303 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/zalhui/calc_golang/internal/common/models"
+)
+
+// ErrAgentNotFound - агент не регистрировался, ему нужно зарегистрироваться заново
+var ErrAgentNotFound = errors.New("agent not found")
+
+// RegisterAgent добавляет агента в реестр. Агент, который перерегистрируется
+// с тем же id, например после перезапуска оркестратора, снова становится online.
+func (r *Repository) RegisterAgent(agent *models.Agent) error {
+	now := time.Now().UTC()
+	_, err := r.db.Exec(
+		`INSERT INTO agents (id, hostname, version, computing_power, operations,
+		modes, max_operand_size, status, registered_at, last_seen_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, 'online', ?, ?)
+		ON CONFLICT(id) DO UPDATE SET hostname = excluded.hostname,
+		version = excluded.version, computing_power = excluded.computing_power,
+		operations = excluded.operations, modes = excluded.modes,
+		max_operand_size = excluded.max_operand_size,
+		status = 'online', last_seen_at = excluded.last_seen_at`,
+		agent.ID, agent.Hostname, agent.Version, agent.ComputingPower,
+		strings.Join(agent.Operations, ","), strings.Join(agent.Modes, ","),
+		agent.MaxOperandSize, now, now,
+	)
+	if err != nil {
+		log.Printf("Error registering agent %s: %v", agent.ID, err)
+		return err
+	}
+
+	agent.Status = "online"
+	agent.LastSeenAt = now
+	return nil
+}
+
+// AgentHeartbeat отмечает, что агент жив
+func (r *Repository) AgentHeartbeat(agentID string, now time.Time) error {
+	res, err := r.db.Exec(
+		"UPDATE agents SET status = 'online', last_seen_at = ? WHERE id = ?",
+		now.UTC(), agentID,
+	)
+	if err != nil {
+		log.Printf("Error updating heartbeat of agent %s: %v", agentID, err)
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrAgentNotFound
+	}
+	return nil
+}
+
+// GetAgents возвращает все агенты реестра со счётчиками задач
+func (r *Repository) GetAgents() ([]*models.Agent, error) {
+	rows, err := r.db.Query(
+		`SELECT id, hostname, version, computing_power, operations, modes,
+		max_operand_size, status, completed_tasks, registered_at, last_seen_at,
+		(SELECT COUNT(*) FROM tasks WHERE tasks.lease_owner = agents.id AND tasks.status = 'running')
+		FROM agents ORDER BY registered_at`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var agents []*models.Agent
+	for rows.Next() {
+		var agent models.Agent
+		var operations, modes sql.NullString
+		var registeredAt, lastSeenAt sql.NullTime
+		err := rows.Scan(
+			&agent.ID,
+			&agent.Hostname,
+			&agent.Version,
+			&agent.ComputingPower,
+			&operations,
+			&modes,
+			&agent.MaxOperandSize,
+			&agent.Status,
+			&agent.CompletedTasks,
+			&registeredAt,
+			&lastSeenAt,
+			&agent.TasksInFlight,
+		)
+		if err != nil {
+			return nil, err
+		}
+		agent.Operations = splitList(operations.String)
+		agent.Modes = splitList(modes.String)
+		agent.RegisteredAt = registeredAt.Time
+		agent.LastSeenAt = lastSeenAt.Time
+		agents = append(agents, &agent)
+	}
+	return agents, rows.Err()
+}
+
+// GetAgentCapabilities возвращает возможности агента из реестра.
+// Агент, который не регистрировался, получает nil: ему выдаются любые задачи.
+func (r *Repository) GetAgentCapabilities(agentID string) (*models.Capabilities, error) {
+	var caps models.Capabilities
+	var operations, modes sql.NullString
+	err := r.db.QueryRow(
+		"SELECT operations, modes, max_operand_size FROM agents WHERE id = ?",
+		agentID,
+	).Scan(&operations, &modes, &caps.MaxOperandSize)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	caps.Operations = splitList(operations.String)
+	caps.Modes = splitList(modes.String)
+	return &caps, nil
+}
+
+// ReleaseLostAgents переводит в offline агентов, от которых не было heartbeat
+// с lostBefore, и обрывает аренду их задач, не дожидаясь её конца:
+// ReapExpiredLeases вернёт эти задачи в очередь. Возвращает число потерянных агентов.
+func (r *Repository) ReleaseLostAgents(lostBefore time.Time) (int, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		"UPDATE agents SET status = 'offline' WHERE status = 'online' AND last_seen_at < ?",
+		lostBefore.UTC(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to mark lost agents: %w", err)
+	}
+	lost, _ := res.RowsAffected()
+
+	_, err = tx.Exec(
+		`UPDATE tasks SET lease_expires_at = ?
+		WHERE status = 'running' AND lease_expires_at > ?
+		AND lease_owner IN (SELECT id FROM agents WHERE status = 'offline')`,
+		lostBefore.UTC(), lostBefore.UTC(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to release tasks of lost agents: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit lost agents: %w", err)
+	}
+	return int(lost), nil
+}
+
+// UpdateBlockedExpressions переводит в blocked выражения, задачу которых в
+// ready, в том числе ждущую повтора после ошибки, не умеет считать ни один из
+// агентов agents, и возвращает в pending те, что снова может кто-то посчитать.
+// Возвращает число заблокированных и разблокированных выражений. Непустой
+// expressionID ограничивает проверку одним выражением, например только что созданным.
+func (r *Repository) UpdateBlockedExpressions(agents []models.Capabilities, expressionID string) (blocked, unblocked int, err error) {
+	// операцию и режим проверяет сам запрос: читаются только задачи, которые
+	// не умеет считать ни один агент без ограничения на размер операндов
+	filter, filterArgs := unservedFilter(agents)
+	query := `SELECT id, expression_id, arg1, arg2, args, 
+		operation, mode, dependencies, attempts FROM tasks 
+		WHERE status = 'ready' AND (? = '' OR expression_id = ?) 
+		AND expression_id IN (SELECT id FROM expressions WHERE status IN ('pending', 'blocked')) 
+		AND ` + filter + ` ORDER BY created_at, rowid LIMIT ? OFFSET ?`
+
+	unserved := make(map[string]bool)
+	for offset := 0; ; offset += readyPageSize {
+		args := append([]interface{}{expressionID, expressionID}, filterArgs...)
+		rows, err := r.db.Query(query, append(args, readyPageSize, offset)...)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to query ready tasks: %w", err)
+		}
+		tasks, err := scanTasks(rows)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to read ready tasks: %w", err)
+		}
+
+		for _, task := range tasks {
+			if unserved[task.ExpressionID] {
+				continue
+			}
+			if err := resolveOperands(r.db, task); err != nil {
+				log.Printf("Error resolving operands of task %s: %v", task.ID, err)
+				continue
+			}
+			served := false
+			for _, caps := range agents {
+				if caps.Supports(task) {
+					served = true
+					break
+				}
+			}
+			if !served {
+				unserved[task.ExpressionID] = true
+			}
+		}
+
+		if len(tasks) < readyPageSize {
+			break
+		}
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(
+		"SELECT id, status FROM expressions WHERE status IN ('pending', 'blocked') AND (? = '' OR id = ?)",
+		expressionID, expressionID,
+	)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to query pending expressions: %w", err)
+	}
+	var toBlock, toUnblock []string
+	for rows.Next() {
+		var id, status string
+		if err := rows.Scan(&id, &status); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		switch {
+		case status == "pending" && unserved[id]:
+			toBlock = append(toBlock, id)
+		case status == "blocked" && !unserved[id]:
+			toUnblock = append(toUnblock, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range toBlock {
+		if _, err := tx.Exec("UPDATE expressions SET status = 'blocked' WHERE id = ? AND status = 'pending'", id); err != nil {
+			return 0, 0, fmt.Errorf("failed to block expression %s: %w", id, err)
+		}
+	}
+	for _, id := range toUnblock {
+		if _, err := tx.Exec("UPDATE expressions SET status = 'pending' WHERE id = ? AND status = 'blocked'", id); err != nil {
+			return 0, 0, fmt.Errorf("failed to unblock expression %s: %w", id, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, fmt.Errorf("failed to commit blocked expressions: %w", err)
+	}
+	return len(toBlock), len(toUnblock), nil
+}
+
+// unservedFilter возвращает условие SQL на задачи, операцию или режим которых
+// не умеет считать ни один из агентов agents без ограничения на размер
+// операндов. Размер операндов проверяется уже после их подстановки.
+func unservedFilter(agents []models.Capabilities) (string, []interface{}) {
+	var served []string
+	var args []interface{}
+	for _, caps := range agents {
+		if caps.MaxOperandSize > 0 {
+			continue
+		}
+		var conds []string
+		if len(caps.Operations) > 0 {
+			conds = append(conds, "operation IN ("+placeholders(len(caps.Operations))+")")
+			for _, operation := range caps.Operations {
+				args = append(args, operation)
+			}
+		}
+		if len(caps.Modes) > 0 {
+			conds = append(conds, "mode IN ("+placeholders(len(caps.Modes))+")")
+			for _, mode := range caps.Modes {
+				args = append(args, mode)
+			}
+		}
+		if len(conds) == 0 {
+			// агент считает всё
+			return "0", nil
+		}
+		served = append(served, "("+strings.Join(conds, " AND ")+")")
+	}
+	if len(served) == 0 {
+		return "1", nil
+	}
+	return "NOT (" + strings.Join(served, " OR ") + ")", args
+}
+
+// placeholders возвращает n параметров запроса через запятую
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// splitList разбирает список, сохранённый через запятую. Операции и режимы запятых не содержат.
+func splitList(list string) []string {
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
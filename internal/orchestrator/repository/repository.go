@@ -2,8 +2,11 @@ package repository
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
 	"strings"
 	"time"
 
@@ -24,9 +27,17 @@ func (r *Repository) AddExpression(expr *models.Expression) error {
 		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
 
+	variables, err := encodeVariables(expr.Variables)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	rootTaskID := sql.NullString{String: expr.RootTaskID, Valid: expr.RootTaskID != ""}
 	_, err = tx.Exec(
-		"INSERT INTO expressions (id, user_id, expression, status, created_at) VALUES (?, ?, ?, ?, ?)",
-		expr.ID, expr.UserID, expr.Expression, expr.Status, time.Now(),
+		`INSERT INTO expressions (id, user_id, expression, variables, mode, status, 
+		result, exact_result, root_task_id, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		expr.ID, expr.UserID, expr.Expression, variables, modeOrDefault(expr.Mode), expr.Status,
+		expr.Result, expr.ExactResult, rootTaskID, time.Now(),
 	)
 	if err != nil {
 		tx.Rollback()
@@ -35,10 +46,19 @@ func (r *Repository) AddExpression(expr *models.Expression) error {
 
 	// Вставляем задачи
 	for _, task := range expr.Tasks {
+		// задачи без зависимостей можно отдавать агентам сразу
+		if task.Status == "pending" && len(task.Dependencies) == 0 {
+			task.Status = "ready"
+		}
 		deps := strings.Join(task.Dependencies, ",")
+		args, err := json.Marshal(task.Args)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to encode task args: %w", err)
+		}
 		_, err = tx.Exec(
-			"INSERT INTO tasks (id, expression_id, arg1, arg2, operation, status, dependencies, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
-			task.ID, expr.ID, task.Arg1, task.Arg2, task.Operation, task.Status, deps, time.Now(),
+			"INSERT INTO tasks (id, expression_id, arg1, arg2, args, operation, mode, status, dependencies, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			task.ID, expr.ID, legacyArg(task.Args, 0), legacyArg(task.Args, 1), string(args), task.Operation, modeOrDefault(task.Mode), task.Status, deps, time.Now(),
 		)
 		if err != nil {
 			tx.Rollback()
@@ -51,20 +71,25 @@ func (r *Repository) AddExpression(expr *models.Expression) error {
 
 func (r *Repository) GetExpressionByID(expressionID, userID string) (*models.Expression, bool) {
 	row := r.db.QueryRow(
-		`SELECT id, user_id, expression, 
-		status, result, created_at FROM 
+		`SELECT id, user_id, expression, variables, mode, 
+		status, result, exact_result, root_task_id, created_at FROM 
 		expressions WHERE id = ? AND user_id = ?`,
 		expressionID, userID,
 	)
 
 	var expr models.Expression
 	var createdAt time.Time
+	var variables, rootTaskID sql.NullString
 	err := row.Scan(
 		&expr.ID,
 		&expr.UserID,
 		&expr.Expression,
+		&variables,
+		&expr.Mode,
 		&expr.Status,
 		&expr.Result,
+		&expr.ExactResult,
+		&rootTaskID,
 		&createdAt,
 	)
 	if err != nil {
@@ -75,6 +100,8 @@ func (r *Repository) GetExpressionByID(expressionID, userID string) (*models.Exp
 		return nil, false
 	}
 	expr.CreatedAt = createdAt
+	expr.Variables = decodeVariables(variables)
+	expr.RootTaskID = rootTaskID.String
 
 	// Получаем связанные задачи
 	tasks, err := r.getTasksForExpression(expr.ID)
@@ -89,8 +116,8 @@ func (r *Repository) GetExpressionByID(expressionID, userID string) (*models.Exp
 
 func (r *Repository) GetAllExpressions(userID string) []*models.Expression {
 	rows, err := r.db.Query(
-		`SELECT id, expression, status, result, 
-		created_at FROM expressions WHERE user_id = ?
+		`SELECT id, expression, variables, mode, status, result, 
+		exact_result, created_at FROM expressions WHERE user_id = ?
 		 ORDER BY created_at DESC`,
 		userID,
 	)
@@ -104,11 +131,15 @@ func (r *Repository) GetAllExpressions(userID string) []*models.Expression {
 	for rows.Next() {
 		var expr models.Expression
 		var createdAt time.Time
+		var variables sql.NullString
 		err := rows.Scan(
 			&expr.ID,
 			&expr.Expression,
+			&variables,
+			&expr.Mode,
 			&expr.Status,
 			&expr.Result,
+			&expr.ExactResult,
 			&createdAt,
 		)
 		if err != nil {
@@ -117,6 +148,7 @@ func (r *Repository) GetAllExpressions(userID string) []*models.Expression {
 		}
 		expr.UserID = userID
 		expr.CreatedAt = createdAt
+		expr.Variables = decodeVariables(variables)
 		expressions = append(expressions, &expr)
 	}
 
@@ -125,23 +157,35 @@ func (r *Repository) GetAllExpressions(userID string) []*models.Expression {
 
 func (r *Repository) GetTaskByID(taskID string) (*models.Task, bool) {
 	row := r.db.QueryRow(
-		`SELECT id, expression_id, arg1, arg2, 
-		operation, status, result, dependencies 
+		`SELECT id, expression_id, arg1, arg2, args, 
+		operation, mode, status, result, exact_result, dependencies, 
+		lease_owner, lease_expires_at, attempts, not_before, last_error 
 		FROM tasks WHERE id = ?`,
 		taskID,
 	)
 
 	var task models.Task
 	var deps string
+	var arg1, arg2 string
+	var args, leaseOwner, lastError sql.NullString
+	var leaseExpiresAt, notBefore sql.NullTime
 	err := row.Scan(
 		&task.ID,
 		&task.ExpressionID,
-		&task.Arg1,
-		&task.Arg2,
+		&arg1,
+		&arg2,
+		&args,
 		&task.Operation,
+		&task.Mode,
 		&task.Status,
 		&task.Result,
+		&task.ExactResult,
 		&deps,
+		&leaseOwner,
+		&leaseExpiresAt,
+		&task.Attempts,
+		&notBefore,
+		&lastError,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -151,79 +195,608 @@ func (r *Repository) GetTaskByID(taskID string) (*models.Task, bool) {
 		return nil, false
 	}
 
-	task.Dependencies = strings.Split(deps, ",")
+	task.Dependencies = splitDependencies(deps)
+	task.Args = decodeArgs(args, arg1, arg2)
+	task.LeaseOwner = leaseOwner.String
+	task.LeaseExpiresAt = leaseExpiresAt.Time
+	task.NotBefore = notBefore.Time
+	task.LastError = lastError.String
 	return &task, true
 }
 
-func (r *Repository) GetPendingTask() (*models.Task, bool) {
-	rows, err := r.db.Query(
-		`SELECT id, expression_id, arg1, arg2, 
-		operation, dependencies FROM tasks 
-		WHERE status = 'pending'`,
+// ErrLeaseLost - задача уже не числится за агентом: аренда истекла и задачу
+// забрал другой агент, или выражение завершилось без неё
+var ErrLeaseLost = errors.New("task lease lost")
+
+// ErrTaskCancelled - пользователь отменил выражение, результат задачи не нужен
+var ErrTaskCancelled = errors.New("task cancelled")
+
+// queryRower - *sql.DB или *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// querier - *sql.DB или *sql.Tx, когда нужны несколько строк
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// leaseError объясняет, почему задача taskID уже не числится за агентом
+func leaseError(q queryRower, taskID string) error {
+	var status string
+	if err := q.QueryRow("SELECT status FROM tasks WHERE id = ?", taskID).Scan(&status); err == nil && status == "cancelled" {
+		return ErrTaskCancelled
+	}
+	return ErrLeaseLost
+}
+
+// ClaimTask выдаёт агенту owner задачу в статусе ready: все её зависимости уже
+// посчитаны, и вместо ссылок на них в Args подставлены их результаты.
+// Задачи, которые ждут повтора после ошибки, выдаются только после not_before.
+// Задача переходит в running и числится за агентом до истечения аренды lease.
+// Если caps не nil, выдаются только задачи, которые агент умеет считать.
+func (r *Repository) ClaimTask(owner string, lease time.Duration, caps *models.Capabilities) (*models.Task, bool) {
+	tasks := r.ClaimTasks(owner, lease, caps, 1)
+	if len(tasks) == 0 {
+		return nil, false
+	}
+	return tasks[0], true
+}
+
+// readyPageSize - сколько задач в ready ClaimTasks читает за раз, если агент
+// просит меньше: часть задач может не подойти агенту по возможностям.
+// Столько же задач за раз проверяет UpdateBlockedExpressions.
+const readyPageSize = 32
+
+// ClaimTasks выдаёт агенту owner до limit задач, как ClaimTask.
+// Все задачи берутся в аренду одной транзакцией. Задачи в ready читаются
+// страницами, пока не наберётся limit подходящих агенту.
+func (r *Repository) ClaimTasks(owner string, lease time.Duration, caps *models.Capabilities, limit int) []*models.Task {
+	tx, err := r.db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction: %v", err)
+		return nil
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	expiresAt := now.UTC().Add(lease)
+	pageSize := max(limit, readyPageSize)
+	var claimed []*models.Task
+	// выданные задачи уходят из ready, а пропущенные остаются в начале
+	// очереди, поэтому следующая страница начинается после них
+	skipped := 0
+	for len(claimed) < limit {
+		tasks, err := readyTasks(tx, now, "", skipped, pageSize)
+		if err != nil {
+			log.Printf("Error querying ready tasks: %v", err)
+			return nil
+		}
+
+		for _, task := range tasks {
+			if len(claimed) == limit {
+				break
+			}
+			if err := resolveOperands(tx, task); err != nil {
+				log.Printf("Error resolving operands of task %s: %v", task.ID, err)
+				skipped++
+				continue
+			}
+			if caps != nil && !caps.Supports(task) {
+				skipped++
+				continue
+			}
+
+			// задачу мог уже забрать другой агент, поэтому статус проверяется в том же UPDATE
+			res, err := tx.Exec(
+				`UPDATE tasks SET status = 'running', lease_owner = ?, 
+				lease_expires_at = ?, attempts = attempts + 1 
+				WHERE id = ? AND status = 'ready'`,
+				owner, expiresAt, task.ID,
+			)
+			if err != nil {
+				log.Printf("Error claiming task %s: %v", task.ID, err)
+				return nil
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				continue
+			}
+
+			task.Status = "running"
+			task.LeaseOwner = owner
+			task.LeaseExpiresAt = expiresAt
+			task.Attempts++
+			claimed = append(claimed, task)
+		}
+
+		if len(tasks) < pageSize {
+			break
+		}
+	}
+
+	if len(claimed) == 0 {
+		return nil
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing claimed tasks: %v", err)
+		return nil
+	}
+	return claimed
+}
+
+// NextRetryAt возвращает, когда после now первая из задач, которые ждут
+// повтора после ошибки, снова станет доступна агентам. false - таких задач нет.
+func (r *Repository) NextRetryAt(now time.Time) (time.Time, bool) {
+	var notBefore time.Time
+	err := r.db.QueryRow(
+		`SELECT not_before FROM tasks WHERE status = 'ready' AND not_before > ? 
+		ORDER BY not_before LIMIT 1`,
+		now.UTC(),
+	).Scan(&notBefore)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("Error querying next retry: %v", err)
+		}
+		return time.Time{}, false
+	}
+	return notBefore, true
+}
+
+// readyTasks возвращает задачи в ready, которые можно выдать в момент now,
+// в порядке создания: не больше limit, начиная с offset-й, limit < 0 - все.
+// Непустой expressionID оставляет только задачи этого выражения.
+// Операнды-ссылки в задачах ещё не подставлены.
+func readyTasks(q querier, now time.Time, expressionID string, offset, limit int) ([]*models.Task, error) {
+	rows, err := q.Query(
+		`SELECT id, expression_id, arg1, arg2, args, 
+		operation, mode, dependencies, attempts FROM tasks 
+		WHERE status = 'ready' AND (not_before IS NULL OR not_before <= ?) 
+		AND (? = '' OR expression_id = ?) 
+		ORDER BY created_at, rowid LIMIT ? OFFSET ?`,
+		now.UTC(), expressionID, expressionID, limit, offset,
 	)
 	if err != nil {
-		log.Printf("Error querying pending tasks: %v", err)
-		return nil, false
+		return nil, err
 	}
+	return scanTasks(rows)
+}
+
+// scanTasks читает задачи из выборки колонок id, expression_id, arg1, arg2,
+// args, operation, mode, dependencies, attempts и закрывает rows
+func scanTasks(rows *sql.Rows) ([]*models.Task, error) {
 	defer rows.Close()
 
+	var tasks []*models.Task
 	for rows.Next() {
 		var task models.Task
 		var deps string
+		var arg1, arg2 string
+		var args sql.NullString
 		err := rows.Scan(
 			&task.ID,
 			&task.ExpressionID,
-			&task.Arg1,
-			&task.Arg2,
+			&arg1,
+			&arg2,
+			&args,
 			&task.Operation,
+			&task.Mode,
 			&deps,
+			&task.Attempts,
 		)
 		if err != nil {
 			log.Printf("Error scanning task: %v", err)
 			continue
 		}
-		task.Dependencies = strings.Split(deps, ",")
-		task.Status = "pending"
+		task.Dependencies = splitDependencies(deps)
+		task.Args = decodeArgs(args, arg1, arg2)
+		tasks = append(tasks, &task)
+	}
+	return tasks, rows.Err()
+}
+
+// RenewLease продлевает аренду задачи агентом owner на lease от текущего момента.
+// Возвращает ErrLeaseLost, если задача уже не числится за этим агентом,
+// и ErrTaskCancelled, если её выражение отменили.
+func (r *Repository) RenewLease(taskID, owner string, lease time.Duration) (time.Time, error) {
+	expiresAt := time.Now().UTC().Add(lease)
+	res, err := r.db.Exec(
+		`UPDATE tasks SET lease_expires_at = ? 
+		WHERE id = ? AND status = 'running' AND lease_owner = ?`,
+		expiresAt, taskID, owner,
+	)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to renew lease: %w", err)
+	}
+	if renewed, _ := res.RowsAffected(); renewed == 0 {
+		return time.Time{}, leaseError(r.db, taskID)
+	}
+	return expiresAt, nil
+}
+
+// ReapExpiredLeases возвращает в очередь задачи, аренда которых истекла к моменту now:
+// агент, скорее всего, упал. Задачи, которые выдавали уже maxAttempts раз,
+// вместо этого переходят в dead. Возвращает число задач в очереди и в dead.
+func (r *Repository) ReapExpiredLeases(now time.Time, maxAttempts int) (requeued, killed int, err error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(
+		`UPDATE tasks SET status = 'dead', lease_owner = NULL, lease_expires_at = NULL, 
+		last_error = 'lease expired' 
+		WHERE status = 'running' AND lease_expires_at < ? AND attempts >= ? 
+		RETURNING expression_id`,
+		now.UTC(), maxAttempts,
+	)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to kill expired tasks: %w", err)
+	}
+	var failed []string
+	for rows.Next() {
+		var expressionID string
+		if err := rows.Scan(&expressionID); err != nil {
+			rows.Close()
+			return 0, 0, fmt.Errorf("failed to kill expired tasks: %w", err)
+		}
+		failed = append(failed, expressionID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, fmt.Errorf("failed to kill expired tasks: %w", err)
+	}
+	killed = len(failed)
+	if err := failExpressions(tx, failed); err != nil {
+		return 0, 0, err
+	}
 
-		//if r.allDependenciesCompleted(task.Dependencies) {
-		return &task, true
-		//}
+	res, err := tx.Exec(
+		`UPDATE tasks SET status = 'ready', lease_owner = NULL, lease_expires_at = NULL 
+		WHERE status = 'running' AND lease_expires_at < ?`,
+		now.UTC(),
+	)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to reap expired leases: %w", err)
 	}
+	n, _ := res.RowsAffected()
+	requeued = int(n)
 
-	return nil, false
+	if err := tx.Commit(); err != nil {
+		return 0, 0, fmt.Errorf("failed to commit reaped leases: %w", err)
+	}
+	return requeued, killed, nil
 }
 
-func (r *Repository) allDependenciesCompleted(dependencies []string) bool {
-	for _, depID := range dependencies {
-		var status string
-		err := r.db.QueryRow(
-			"SELECT status FROM tasks WHERE id = ?",
-			depID,
-		).Scan(&status)
+// RetryTask возвращает задачу агента owner в очередь после ошибки errMsg.
+// Агентам её выдадут не раньше notBefore.
+func (r *Repository) RetryTask(taskID, owner, errMsg string, notBefore time.Time) error {
+	res, err := r.db.Exec(
+		`UPDATE tasks SET status = 'ready', lease_owner = NULL, lease_expires_at = NULL, 
+		not_before = ?, last_error = ? 
+		WHERE id = ? AND status = 'running' AND lease_owner = ?`,
+		notBefore.UTC(), errMsg, taskID, owner,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to retry task: %w", err)
+	}
+	if updated, _ := res.RowsAffected(); updated == 0 {
+		return leaseError(r.db, taskID)
+	}
+	return nil
+}
+
+// ReleaseTask возвращает в очередь задачу агента owner, которую он не досчитал,
+// потому что останавливается. Выдача задачи не считается попыткой, паузы нет.
+func (r *Repository) ReleaseTask(taskID, owner string) error {
+	res, err := r.db.Exec(
+		`UPDATE tasks SET status = 'ready', lease_owner = NULL, lease_expires_at = NULL, 
+		not_before = NULL, attempts = MAX(attempts - 1, 0) 
+		WHERE id = ? AND status = 'running' AND lease_owner = ?`,
+		taskID, owner,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to release task: %w", err)
+	}
+	if updated, _ := res.RowsAffected(); updated == 0 {
+		return leaseError(r.db, taskID)
+	}
+	return nil
+}
+
+// KillTask переводит задачу агента owner в dead: попытки кончились. Выражение
+// завершается ошибкой, но остальные задачи остаются на месте, чтобы после
+// RedriveTask вычисление продолжилось с того же места.
+func (r *Repository) KillTask(taskID, owner, errMsg string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var expressionID string
+	err = tx.QueryRow(
+		`UPDATE tasks SET status = 'dead', lease_owner = NULL, lease_expires_at = NULL, 
+		not_before = NULL, last_error = ? 
+		WHERE id = ? AND status = 'running' AND lease_owner = ? 
+		RETURNING expression_id`,
+		errMsg, taskID, owner,
+	).Scan(&expressionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return leaseError(tx, taskID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to kill task: %w", err)
+	}
+	if err := failExpressions(tx, []string{expressionID}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// failExpressions завершает ошибкой выражения expressionIDs, задачи которых
+// только что перешли в dead. Выражения, которые уже завершены или отменены,
+// не меняются.
+func failExpressions(tx *sql.Tx, expressionIDs []string) error {
+	for _, id := range expressionIDs {
+		_, err := tx.Exec(
+			`UPDATE expressions SET status = 'error', result = 0, exact_result = NULL 
+			WHERE id = ? AND status IN ('pending', 'blocked')`,
+			id,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to fail expression %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// ErrNotDead - повторно запустить можно только задачу в статусе dead
+var ErrNotDead = errors.New("task is not dead")
+
+// GetDeadTasks возвращает задачи, у которых кончились попытки, сначала старые
+func (r *Repository) GetDeadTasks() ([]*models.Task, error) {
+	rows, err := r.db.Query(
+		`SELECT id, expression_id, operation, mode, attempts, last_error, created_at 
+		FROM tasks WHERE status = 'dead' ORDER BY created_at`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tasks []*models.Task
+	for rows.Next() {
+		var task models.Task
+		var lastError sql.NullString
+		var createdAt sql.NullTime
+		err := rows.Scan(
+			&task.ID,
+			&task.ExpressionID,
+			&task.Operation,
+			&task.Mode,
+			&task.Attempts,
+			&lastError,
+			&createdAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		task.Status = "dead"
+		task.LastError = lastError.String
+		task.CreatedAt = createdAt.Time
+		tasks = append(tasks, &task)
+	}
+	return tasks, rows.Err()
+}
+
+// RedriveTask возвращает задачу из dead в очередь со сброшенным счётчиком попыток.
+// Если в выражении больше нет задач в dead, оно снова считается.
+func (r *Repository) RedriveTask(taskID string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		`UPDATE tasks SET status = 'ready', attempts = 0, not_before = NULL 
+		WHERE id = ? AND status = 'dead'`,
+		taskID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to redrive task: %w", err)
+	}
+	if updated, _ := res.RowsAffected(); updated == 0 {
+		return ErrNotDead
+	}
 
-		if err != nil || status != "completed" {
-			return false
+	// выражение снова ждёт результата, если его не завершила настоящая ошибка
+	_, err = tx.Exec(
+		`UPDATE expressions SET status = 'pending' 
+		WHERE id = (SELECT expression_id FROM tasks WHERE id = ?) 
+		AND NOT EXISTS (
+			SELECT 1 FROM tasks WHERE expression_id = expressions.id 
+			AND status IN ('dead', 'error')
+		)`,
+		taskID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to reopen expression: %w", err)
+	}
+	return tx.Commit()
+}
+
+// ErrNotCancellable - выражение уже завершилось, отменять нечего
+var ErrNotCancellable = errors.New("expression is already finished")
+
+// CancelExpression отменяет выражение пользователя userID и все его незавершённые
+// задачи. Агенты узнают об отмене, когда продлевают аренду или присылают результат.
+// Возвращает sql.ErrNoRows, если выражения нет, и ErrNotCancellable, если оно завершилось.
+func (r *Repository) CancelExpression(expressionID, userID string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var status string
+	err = tx.QueryRow(
+		"SELECT status FROM expressions WHERE id = ? AND user_id = ?",
+		expressionID, userID,
+	).Scan(&status)
+	if err != nil {
+		return err
+	}
+	if status != "pending" && status != "blocked" {
+		return fmt.Errorf("%w: %s", ErrNotCancellable, status)
+	}
+
+	_, err = tx.Exec("UPDATE expressions SET status = 'cancelled' WHERE id = ?", expressionID)
+	if err != nil {
+		return fmt.Errorf("failed to cancel expression: %w", err)
+	}
+	_, err = tx.Exec(
+		`UPDATE tasks SET status = 'cancelled', lease_owner = NULL, lease_expires_at = NULL 
+		WHERE expression_id = ? AND status IN ('pending', 'ready', 'running', 'dead')`,
+		expressionID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to cancel tasks: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// resolveOperands заменяет ссылки на задачи их результатами,
+// чтобы агенту не пришлось ждать другие задачи
+func resolveOperands(q queryRower, task *models.Task) error {
+	for i, arg := range task.Args {
+		if !arg.IsRef() {
+			continue
 		}
+		var status string
+		var result sql.NullFloat64
+		var exact sql.NullString
+		err := q.QueryRow(
+			"SELECT status, result, exact_result FROM tasks WHERE id = ?",
+			arg.TaskID,
+		).Scan(&status, &result, &exact)
+		if err != nil {
+			return fmt.Errorf("failed to get result of task %s: %w", arg.TaskID, err)
+		}
+		if status != "completed" {
+			return fmt.Errorf("task %s is %s", arg.TaskID, status)
+		}
+		value := exact.String
+		if !exact.Valid {
+			value = strconv.FormatFloat(result.Float64, 'g', -1, 64)
+		}
+		task.Args[i] = models.Operand{Value: value}
+	}
+	return nil
+}
+
+// promoteReadySQL переводит в ready задачи, у которых посчитаны все зависимости.
+// Зависимости хранятся через запятую, а id задач запятых не содержат.
+const promoteReadySQL = `UPDATE tasks SET status = 'ready'
+	WHERE status = 'pending' AND NOT EXISTS (
+		SELECT 1 FROM tasks AS dep
+		WHERE dep.expression_id = tasks.expression_id
+		AND instr(',' || tasks.dependencies || ',', ',' || dep.id || ',') > 0
+		AND dep.status != 'completed'
+	)`
+
+// PromoteReadyTasks переводит в ready все задачи, которые можно отдавать агентам.
+// Нужна для задач, созданных до появления статуса ready.
+func (r *Repository) PromoteReadyTasks() error {
+	if _, err := r.db.Exec(promoteReadySQL); err != nil {
+		return fmt.Errorf("failed to promote ready tasks: %w", err)
 	}
-	return true
+	return nil
 }
 
-func (r *Repository) UpdateTaskStatus(taskID string, status string, result float64) {
+// UpdateTaskStatus сохраняет результат задачи, которую считал агент owner.
+// exactResult - тот же результат в записи режима задачи, пустая строка означает,
+// что точного значения нет. Пустой owner принимает результат от любого агента.
+// Если задача уже не числится за агентом, возвращает ErrLeaseLost или ErrTaskCancelled.
+func (r *Repository) UpdateTaskStatus(taskID, owner, status string, result float64, exactResult string) error {
 	tx, err := r.db.Begin()
 	if err != nil {
 		log.Printf("Error starting transaction: %v", err)
-		return
+		return err
 	}
+	defer tx.Rollback()
 
-	// Обновляем статус задачи
-	_, err = tx.Exec(
-		"UPDATE tasks SET status = ?, result = ? WHERE id = ?",
-		status, result, taskID,
+	if err := updateTaskStatus(tx, TaskUpdate{taskID, status, result, exactResult}, owner); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Printf("Error committing transaction: %v", err)
+		return err
+	}
+	return nil
+}
+
+// TaskUpdate - результат задачи для UpdateTaskStatuses
+type TaskUpdate struct {
+	ID          string
+	Status      string // completed или error
+	Result      float64
+	ExactResult string
+}
+
+// UpdateTaskStatuses сохраняет результаты задач агента owner одной транзакцией,
+// как UpdateTaskStatus каждый. Возвращает ошибку для каждой задачи: nil,
+// ErrLeaseLost или ErrTaskCancelled. Задачи с такими ошибками не мешают
+// сохранить остальные, а любая другая ошибка отменяет всю транзакцию.
+func (r *Repository) UpdateTaskStatuses(owner string, updates []TaskUpdate) ([]error, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	errs := make([]error, len(updates))
+	for i, update := range updates {
+		err := updateTaskStatus(tx, update, owner)
+		if errors.Is(err, ErrLeaseLost) || errors.Is(err, ErrTaskCancelled) {
+			errs[i] = err
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit task results: %w", err)
+	}
+	return errs, nil
+}
+
+// updateTaskStatus сохраняет результат задачи в транзакции tx.
+// Если задача уже не числится за агентом, в базе ничего не меняется.
+func updateTaskStatus(tx *sql.Tx, update TaskUpdate, owner string) error {
+	taskID, status, result := update.ID, update.Status, update.Result
+	exact := sql.NullString{String: update.ExactResult, Valid: update.ExactResult != ""}
+
+	// Обновляем статус задачи, если она всё ещё у этого агента
+	res, err := tx.Exec(
+		`UPDATE tasks SET status = ?, result = ?, exact_result = ?, 
+		lease_owner = NULL, lease_expires_at = NULL 
+		WHERE id = ? AND status = 'running' AND lease_owner = ?`,
+		status, result, exact, taskID, owner,
 	)
 	if err != nil {
-		tx.Rollback()
 		log.Printf("Error updating task status: %v", err)
-		return
+		return err
+	}
+	if updated, _ := res.RowsAffected(); updated == 0 {
+		err = leaseError(tx, taskID)
+		log.Printf("Ignoring result of task %s from agent %q: %v", taskID, owner, err)
+		return err
 	}
 
 	// Получаем expression_id для обновления статуса выражения
@@ -233,69 +806,102 @@ func (r *Repository) UpdateTaskStatus(taskID string, status string, result float
 		taskID,
 	).Scan(&expressionID)
 	if err != nil {
-		tx.Rollback()
 		log.Printf("Error getting expression ID: %v", err)
-		return
+		return err
+	}
+
+	if status == "completed" {
+		// задачи, которые ждали только этот результат, можно отдавать агентам
+		_, err = tx.Exec(promoteReadySQL+" AND expression_id = ?", expressionID)
+		if err == nil && owner != "" {
+			_, err = tx.Exec("UPDATE agents SET completed_tasks = completed_tasks + 1 WHERE id = ?", owner)
+		}
+	} else {
+		// после ошибки выражение уже не посчитать, остальные задачи не нужны
+		// задачи, которые сейчас считают другие агенты, тоже: их результаты не примутся
+		_, err = tx.Exec(
+			`UPDATE tasks SET status = 'skipped', lease_owner = NULL, lease_expires_at = NULL 
+			WHERE expression_id = ? AND status IN ('pending', 'ready', 'running')`,
+			expressionID,
+		)
+	}
+	if err != nil {
+		log.Printf("Error updating dependent tasks: %v", err)
+		return err
 	}
 
 	// Проверяем все ли задачи выражения выполнены
 	var pendingTasks int
 	err = tx.QueryRow(
 		`SELECT COUNT(*) FROM tasks WHERE expression_id = ? 
-		AND status NOT IN ('completed', 'error')`,
+		AND status NOT IN ('completed', 'error', 'skipped', 'dead')`,
 		expressionID,
 	).Scan(&pendingTasks)
 
 	if err != nil {
-		tx.Rollback()
 		log.Printf("Error checking pending tasks: %v", err)
-		return
+		return err
 	}
 
 	if pendingTasks == 0 {
 		exprStatus := "completed"
 		var finalResult float64
 
-		// Проверяем наличие ошибок в задачах
+		// Проверяем наличие ошибок в задачах, dead - тоже ошибка
 		var errorTasks int
 		err = tx.QueryRow(
 			`SELECT COUNT(*) FROM tasks WHERE 
-        expression_id = ? AND status = 'error'`,
+        expression_id = ? AND status IN ('error', 'dead')`,
 			expressionID,
 		).Scan(&errorTasks)
 		if err != nil {
-			tx.Rollback()
 			log.Printf("Error checking error tasks: %v", err)
-			return
+			return err
 		}
 
+		var finalExact sql.NullString
 		if errorTasks > 0 {
 			exprStatus = "error"
 			finalResult = 0 // или другое значение по умолчанию
 		} else {
-			finalResult = result
+			// результат выражения - результат корня, а не задачи, которая завершилась последней
+			var rootResult sql.NullFloat64
+			err = tx.QueryRow(
+				`SELECT tasks.result, tasks.exact_result FROM tasks 
+				JOIN expressions ON expressions.root_task_id = tasks.id 
+				WHERE expressions.id = ?`,
+				expressionID,
+			).Scan(&rootResult, &finalExact)
+			switch {
+			case err == sql.ErrNoRows:
+				// выражения старых версий не знают свой корень, там он всегда завершается последним
+				finalResult, finalExact = result, exact
+			case err != nil:
+				log.Printf("Error getting root task result: %v", err)
+				return err
+			default:
+				finalResult = rootResult.Float64
+			}
 		}
 
 		_, err = tx.Exec(
-			"UPDATE expressions SET status = ?, result = ? WHERE id = ?",
-			exprStatus, finalResult, expressionID,
+			"UPDATE expressions SET status = ?, result = ?, exact_result = ? WHERE id = ?",
+			exprStatus, finalResult, finalExact, expressionID,
 		)
 		if err != nil {
-			tx.Rollback()
 			log.Printf("Error updating expression status: %v", err)
-			return
+			return err
 		}
 	}
 
-	if err = tx.Commit(); err != nil {
-		log.Printf("Error committing transaction: %v", err)
-	}
+	return nil
 }
 
 func (r *Repository) getTasksForExpression(expressionID string) ([]*models.Task, error) {
 	rows, err := r.db.Query(
-		`SELECT id, arg1, arg2, operation, status, 
-		result, dependencies FROM tasks WHERE expression_id = ?`,
+		`SELECT id, arg1, arg2, args, operation, mode, status, 
+		result, exact_result, dependencies, lease_owner, lease_expires_at, 
+		attempts, not_before, last_error FROM tasks WHERE expression_id = ?`,
 		expressionID,
 	)
 	if err != nil {
@@ -307,30 +913,120 @@ func (r *Repository) getTasksForExpression(expressionID string) ([]*models.Task,
 	for rows.Next() {
 		var task models.Task
 		var deps string
+		var arg1, arg2 string
+		var args, leaseOwner, lastError sql.NullString
+		var leaseExpiresAt, notBefore sql.NullTime
 		err := rows.Scan(
 			&task.ID,
-			&task.Arg1,
-			&task.Arg2,
+			&arg1,
+			&arg2,
+			&args,
 			&task.Operation,
+			&task.Mode,
 			&task.Status,
 			&task.Result,
+			&task.ExactResult,
 			&deps,
+			&leaseOwner,
+			&leaseExpiresAt,
+			&task.Attempts,
+			&notBefore,
+			&lastError,
 		)
 		if err != nil {
 			return nil, err
 		}
 		task.ExpressionID = expressionID
-		task.Dependencies = strings.Split(deps, ",")
+		task.Dependencies = splitDependencies(deps)
+		task.Args = decodeArgs(args, arg1, arg2)
+		task.LeaseOwner = leaseOwner.String
+		task.LeaseExpiresAt = leaseExpiresAt.Time
+		task.NotBefore = notBefore.Time
+		task.LastError = lastError.String
 		tasks = append(tasks, &task)
 	}
 
 	return tasks, nil
 }
 
+// splitDependencies разбирает список зависимостей, пустая строка - нет зависимостей
+func splitDependencies(deps string) []string {
+	if deps == "" {
+		return nil
+	}
+	return strings.Split(deps, ",")
+}
+
+// decodeArgs читает список операндов задачи. У задач, созданных до появления
+// колонки args, операнды есть только в arg1 и arg2.
+func decodeArgs(raw sql.NullString, arg1, arg2 string) []models.Operand {
+	var args []models.Operand
+	if raw.Valid && raw.String != "" {
+		if err := json.Unmarshal([]byte(raw.String), &args); err != nil {
+			log.Printf("Error decoding task args: %v", err)
+		}
+	}
+	if len(args) > 0 {
+		return args
+	}
+	for _, arg := range []string{arg1, arg2} {
+		if arg == "" {
+			continue
+		}
+		// старые версии хранили ссылку на задачу строкой task_<id>_result
+		if strings.HasPrefix(arg, "task_") && strings.HasSuffix(arg, "_result") {
+			args = append(args, models.Operand{TaskID: strings.TrimSuffix(strings.TrimPrefix(arg, "task_"), "_result")})
+		} else {
+			args = append(args, models.Operand{Value: arg})
+		}
+	}
+	return args
+}
+
+// encodeVariables записывает значения переменных в JSON, без переменных - NULL
+func encodeVariables(variables map[string]string) (sql.NullString, error) {
+	if len(variables) == 0 {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(variables)
+	if err != nil {
+		return sql.NullString{}, fmt.Errorf("failed to encode variables: %w", err)
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+func decodeVariables(raw sql.NullString) map[string]string {
+	if !raw.Valid || raw.String == "" {
+		return nil
+	}
+	var variables map[string]string
+	if err := json.Unmarshal([]byte(raw.String), &variables); err != nil {
+		log.Printf("Error decoding variables: %v", err)
+	}
+	return variables
+}
+
+// modeOrDefault подставляет режим float для выражений и задач, созданных без режима
+func modeOrDefault(mode string) string {
+	if mode == "" {
+		return "float"
+	}
+	return mode
+}
+
+// legacyArg возвращает i-й операнд для колонок arg1 и arg2.
+// Оркестратор их больше не читает, они остаются для наглядности при просмотре базы.
+func legacyArg(args []models.Operand, i int) string {
+	if i >= len(args) {
+		return ""
+	}
+	return args[i].String()
+}
+
 func (r *Repository) GetUserHistory(userID string) ([]*models.Expression, error) {
 	rows, err := r.db.Query(
-		`SELECT id, expression, status, result, created_at 
-		FROM expressions WHERE user_id = ? ORDER BY created_at DESC`,
+		`SELECT id, expression, variables, mode, status, result, 
+		exact_result, created_at FROM expressions WHERE user_id = ? ORDER BY created_at DESC`,
 		userID,
 	)
 	if err != nil {
@@ -342,11 +1038,15 @@ func (r *Repository) GetUserHistory(userID string) ([]*models.Expression, error)
 	for rows.Next() {
 		var expr models.Expression
 		var createdAt time.Time
+		var variables sql.NullString
 		err := rows.Scan(
 			&expr.ID,
 			&expr.Expression,
+			&variables,
+			&expr.Mode,
 			&expr.Status,
 			&expr.Result,
+			&expr.ExactResult,
 			&createdAt,
 		)
 		if err != nil {
@@ -354,6 +1054,7 @@ func (r *Repository) GetUserHistory(userID string) ([]*models.Expression, error)
 		}
 		expr.UserID = userID
 		expr.CreatedAt = createdAt
+		expr.Variables = decodeVariables(variables)
 		history = append(history, &expr)
 	}
 
@@ -2,7 +2,11 @@ package repository
 
 import (
 	"database/sql"
+	"errors"
+	"reflect"
+	"strconv"
 	"testing"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/zalhui/calc_golang/internal/common/models"
@@ -19,18 +23,45 @@ func setupTestDB(t *testing.T) *sql.DB {
 			id TEXT PRIMARY KEY,
 			user_id TEXT,
 			expression TEXT,
+			variables TEXT,
+			mode TEXT,
 			status TEXT,
-			result REAL
+			result REAL,
+			exact_result TEXT,
+			root_task_id TEXT,
+			created_at DATETIME
 		);
 		CREATE TABLE tasks (
 			id TEXT PRIMARY KEY,
 			expression_id TEXT,
 			arg1 TEXT,
 			arg2 TEXT,
+			args TEXT,
 			operation TEXT,
+			mode TEXT,
 			status TEXT,
 			result REAL,
-			dependencies TEXT
+			exact_result TEXT,
+			dependencies TEXT,
+			lease_owner TEXT,
+			lease_expires_at DATETIME,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			not_before DATETIME,
+			last_error TEXT,
+			created_at DATETIME
+		);
+		CREATE TABLE agents (
+			id TEXT PRIMARY KEY,
+			hostname TEXT NOT NULL DEFAULT '',
+			version TEXT NOT NULL DEFAULT '',
+			computing_power INTEGER NOT NULL DEFAULT 1,
+			operations TEXT,
+			modes TEXT,
+			max_operand_size INTEGER NOT NULL DEFAULT 0,
+			status TEXT NOT NULL DEFAULT 'online',
+			completed_tasks INTEGER NOT NULL DEFAULT 0,
+			registered_at DATETIME,
+			last_seen_at DATETIME
 		);
 	`)
 	if err != nil {
@@ -47,13 +78,13 @@ func TestAddAndGetExpression(t *testing.T) {
 	expr := &models.Expression{
 		ID:         "test-id",
 		UserID:     "user1",
-		Expression: "2+2",
+		Expression: "2+x",
+		Variables:  map[string]string{"x": "2"},
 		Status:     "pending",
 		Tasks: []*models.Task{
 			{
 				ID:        "task1",
-				Arg1:      "2",
-				Arg2:      "2",
+				Args:      []models.Operand{{Value: "2"}, {Value: "2"}},
 				Operation: "+",
 				Status:    "pending",
 			},
@@ -72,8 +103,570 @@ func TestAddAndGetExpression(t *testing.T) {
 		if !exists {
 			t.Error("Expression not found")
 		}
-		if found.Expression != "2+2" {
-			t.Errorf("Unexpected expression: %s", found.Expression)
+		if found.Expression != "2+x" || found.Variables["x"] != "2" {
+			t.Errorf("Unexpected expression: %s %v", found.Expression, found.Variables)
+		}
+		if found.Mode != "float" {
+			t.Errorf("Unexpected mode: %s", found.Mode)
+		}
+	})
+
+	t.Run("Update task result", func(t *testing.T) {
+		if _, ok := repo.ClaimTask("agent", time.Minute, nil); !ok {
+			t.Fatal("ClaimTask() found no task")
+		}
+		if err := repo.UpdateTaskStatus("task1", "agent", "completed", 4, "4"); err != nil {
+			t.Fatalf("UpdateTaskStatus failed: %v", err)
+		}
+
+		found, exists := repo.GetExpressionByID("test-id", "user1")
+		if !exists {
+			t.Fatal("Expression not found")
+		}
+		if found.Status != "completed" || found.Result.Float64 != 4 || found.ExactResult.String != "4" {
+			t.Errorf("Unexpected result: %s %v %v", found.Status, found.Result, found.ExactResult)
+		}
+	})
+}
+
+func TestDependencyDispatch(t *testing.T) {
+	db := setupTestDB(t)
+	repo := NewRepository(db)
+
+	// (2+3)*4: произведение ждёт сумму
+	expr := &models.Expression{
+		ID:         "expr",
+		UserID:     "user1",
+		Expression: "(2+3)*4",
+		Status:     "pending",
+		Tasks: []*models.Task{
+			{ID: "sum", Args: []models.Operand{{Value: "2"}, {Value: "3"}}, Operation: "+", Status: "pending"},
+			{ID: "product", Args: []models.Operand{{TaskID: "sum"}, {Value: "4"}}, Operation: "*", Status: "pending", Dependencies: []string{"sum"}},
+		},
+	}
+	if err := repo.AddExpression(expr); err != nil {
+		t.Fatalf("AddExpression failed: %v", err)
+	}
+
+	task, ok := repo.ClaimTask("agent", time.Minute, nil)
+	if !ok || task.ID != "sum" {
+		t.Fatalf("ClaimTask() = %v, %v; want sum", task, ok)
+	}
+	repo.UpdateTaskStatus("sum", "agent", "completed", 5, "5")
+
+	task, ok = repo.ClaimTask("agent", time.Minute, nil)
+	if !ok || task.ID != "product" {
+		t.Fatalf("ClaimTask() = %v, %v; want product", task, ok)
+	}
+	if !reflect.DeepEqual(task.Args, []models.Operand{{Value: "5"}, {Value: "4"}}) {
+		t.Errorf("product args = %v; want resolved [5 4]", task.Args)
+	}
+	repo.UpdateTaskStatus("product", "agent", "completed", 20, "20")
+
+	if task, ok := repo.ClaimTask("agent", time.Minute, nil); ok {
+		t.Errorf("ClaimTask() = %v; want no tasks", task)
+	}
+	found, _ := repo.GetExpressionByID("expr", "user1")
+	if found.Status != "completed" || found.ExactResult.String != "20" {
+		t.Errorf("expression = %s %v; want completed 20", found.Status, found.ExactResult)
+	}
+}
+
+func TestTaskLease(t *testing.T) {
+	db := setupTestDB(t)
+	repo := NewRepository(db)
+
+	expr := &models.Expression{
+		ID:         "expr",
+		UserID:     "user1",
+		Expression: "2+2",
+		Status:     "pending",
+		Tasks: []*models.Task{
+			{ID: "task", Args: []models.Operand{{Value: "2"}, {Value: "2"}}, Operation: "+", Status: "pending"},
+		},
+	}
+	if err := repo.AddExpression(expr); err != nil {
+		t.Fatalf("AddExpression failed: %v", err)
+	}
+
+	task, ok := repo.ClaimTask("first", time.Minute, nil)
+	if !ok || task.Status != "running" || task.Attempts != 1 {
+		t.Fatalf("ClaimTask() = %+v, %v; want running task, attempt 1", task, ok)
+	}
+	// пока аренда не истекла, задачу никому больше не выдают
+	if task, ok := repo.ClaimTask("second", time.Minute, nil); ok {
+		t.Fatalf("ClaimTask() = %v; task is already leased", task)
+	}
+
+	if _, err := repo.RenewLease("task", "second", time.Minute); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("RenewLease() by another agent: error = %v; want ErrLeaseLost", err)
+	}
+	if _, err := repo.RenewLease("task", "first", time.Minute); err != nil {
+		t.Errorf("RenewLease() error = %v", err)
+	}
+
+	// агент first пропал: через две минуты его аренда истекла
+	requeued, killed, err := repo.ReapExpiredLeases(time.Now().Add(2*time.Minute), 5)
+	if err != nil || requeued != 1 || killed != 0 {
+		t.Fatalf("ReapExpiredLeases() = %d, %d, %v; want 1 requeued", requeued, killed, err)
+	}
+
+	task, ok = repo.ClaimTask("second", time.Minute, nil)
+	if !ok || task.LeaseOwner != "second" || task.Attempts != 2 {
+		t.Fatalf("ClaimTask() = %+v, %v; want task leased by second, attempt 2", task, ok)
+	}
+
+	if err := repo.UpdateTaskStatus("task", "first", "completed", 4, "4"); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("UpdateTaskStatus() by expired agent: error = %v; want ErrLeaseLost", err)
+	}
+	if err := repo.UpdateTaskStatus("task", "second", "completed", 4, "4"); err != nil {
+		t.Errorf("UpdateTaskStatus() error = %v", err)
+	}
+
+	found, _ := repo.GetTaskByID("task")
+	if found.Status != "completed" || found.Attempts != 2 || found.LeaseOwner != "" {
+		t.Errorf("task = %s, attempts %d, owner %q; want completed, 2, no owner", found.Status, found.Attempts, found.LeaseOwner)
+	}
+}
+
+func TestRetryAndRedrive(t *testing.T) {
+	db := setupTestDB(t)
+	repo := NewRepository(db)
+
+	expr := &models.Expression{
+		ID:         "expr",
+		UserID:     "user1",
+		Expression: "(2+3)*4",
+		Status:     "pending",
+		Tasks: []*models.Task{
+			{ID: "sum", Args: []models.Operand{{Value: "2"}, {Value: "3"}}, Operation: "+", Status: "pending"},
+			{ID: "product", Args: []models.Operand{{TaskID: "sum"}, {Value: "4"}}, Operation: "*", Status: "pending", Dependencies: []string{"sum"}},
+		},
+	}
+	if err := repo.AddExpression(expr); err != nil {
+		t.Fatalf("AddExpression failed: %v", err)
+	}
+
+	repo.ClaimTask("agent", time.Minute, nil)
+	if err := repo.RetryTask("sum", "agent", "connection reset", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("RetryTask() error = %v", err)
+	}
+	// до not_before задачу не выдают
+	if task, ok := repo.ClaimTask("agent", time.Minute, nil); ok {
+		t.Fatalf("ClaimTask() = %v; task should wait for retry", task)
+	}
+
+	// пауза прошла, а агент снова пропал: попытки кончились
+	db.Exec("UPDATE tasks SET not_before = NULL WHERE id = 'sum'")
+	if task, ok := repo.ClaimTask("agent", time.Minute, nil); !ok || task.Attempts != 2 {
+		t.Fatalf("ClaimTask() = %+v, %v; want attempt 2", task, ok)
+	}
+	requeued, killed, err := repo.ReapExpiredLeases(time.Now().Add(2*time.Minute), 2)
+	if err != nil || requeued != 0 || killed != 1 {
+		t.Fatalf("ReapExpiredLeases() = %d, %d, %v; want 1 killed", requeued, killed, err)
+	}
+
+	dead, err := repo.GetDeadTasks()
+	if err != nil || len(dead) != 1 || dead[0].ID != "sum" || dead[0].LastError != "lease expired" {
+		t.Fatalf("GetDeadTasks() = %v, %v; want sum", dead, err)
+	}
+	found, _ := repo.GetExpressionByID("expr", "user1")
+	if found.Status != "error" {
+		t.Errorf("expression status = %s; want error", found.Status)
+	}
+
+	if err := repo.RedriveTask("product"); !errors.Is(err, ErrNotDead) {
+		t.Errorf("RedriveTask(product) error = %v; want ErrNotDead", err)
+	}
+	if err := repo.RedriveTask("sum"); err != nil {
+		t.Fatalf("RedriveTask() error = %v", err)
+	}
+	found, _ = repo.GetExpressionByID("expr", "user1")
+	if found.Status != "pending" {
+		t.Errorf("expression status after redrive = %s; want pending", found.Status)
+	}
+
+	// после повторного запуска выражение досчитывается с того же места
+	task, ok := repo.ClaimTask("agent", time.Minute, nil)
+	if !ok || task.ID != "sum" || task.Attempts != 1 {
+		t.Fatalf("ClaimTask() = %+v, %v; want sum, attempt 1", task, ok)
+	}
+	repo.UpdateTaskStatus("sum", "agent", "completed", 5, "5")
+	repo.ClaimTask("agent", time.Minute, nil)
+	repo.UpdateTaskStatus("product", "agent", "completed", 20, "20")
+
+	found, _ = repo.GetExpressionByID("expr", "user1")
+	if found.Status != "completed" || found.ExactResult.String != "20" {
+		t.Errorf("expression = %s %v; want completed 20", found.Status, found.ExactResult)
+	}
+}
+
+func TestKillTaskFailsOnlyItsExpression(t *testing.T) {
+	db := setupTestDB(t)
+	repo := NewRepository(db)
+
+	for _, id := range []string{"old", "expr"} {
+		expr := &models.Expression{
+			ID:         id,
+			UserID:     "user1",
+			Expression: "2+2",
+			Status:     "pending",
+			Tasks: []*models.Task{
+				{ID: id + "-task", Args: []models.Operand{{Value: "2"}, {Value: "2"}}, Operation: "+", Status: "pending"},
+			},
+		}
+		if err := repo.AddExpression(expr); err != nil {
+			t.Fatalf("AddExpression failed: %v", err)
+		}
+	}
+	// отменённое выражение со старой задачей в dead не должно снова стать ошибкой
+	db.Exec("UPDATE expressions SET status = 'cancelled' WHERE id = 'old'")
+	db.Exec("UPDATE tasks SET status = 'dead' WHERE id = 'old-task'")
+
+	if task, ok := repo.ClaimTask("agent", time.Minute, nil); !ok || task.ID != "expr-task" {
+		t.Fatalf("ClaimTask() = %+v, %v; want expr-task", task, ok)
+	}
+	if err := repo.KillTask("expr-task", "agent", "division by zero"); err != nil {
+		t.Fatalf("KillTask() error = %v", err)
+	}
+
+	for id, want := range map[string]string{"old": "cancelled", "expr": "error"} {
+		found, _ := repo.GetExpressionByID(id, "user1")
+		if found.Status != want {
+			t.Errorf("expression %s status = %s; want %s", id, found.Status, want)
+		}
+	}
+}
+
+func TestReleaseTask(t *testing.T) {
+	db := setupTestDB(t)
+	repo := NewRepository(db)
+
+	expr := &models.Expression{
+		ID:         "expr",
+		UserID:     "user1",
+		Expression: "2+2",
+		Status:     "pending",
+		Tasks: []*models.Task{
+			{ID: "task", Args: []models.Operand{{Value: "2"}, {Value: "2"}}, Operation: "+", Status: "pending"},
+		},
+	}
+	if err := repo.AddExpression(expr); err != nil {
+		t.Fatalf("AddExpression failed: %v", err)
+	}
+
+	repo.ClaimTask("first", time.Minute, nil)
+	if err := repo.ReleaseTask("task", "second"); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("ReleaseTask() by another agent: error = %v; want ErrLeaseLost", err)
+	}
+	if err := repo.ReleaseTask("task", "first"); err != nil {
+		t.Fatalf("ReleaseTask() error = %v", err)
+	}
+
+	// задачу сразу получает другой агент, и это снова первая попытка
+	task, ok := repo.ClaimTask("second", time.Minute, nil)
+	if !ok || task.LeaseOwner != "second" || task.Attempts != 1 {
+		t.Fatalf("ClaimTask() = %+v, %v; want task leased by second, attempt 1", task, ok)
+	}
+	if err := repo.ReleaseTask("task", "first"); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("ReleaseTask() after release: error = %v; want ErrLeaseLost", err)
+	}
+}
+
+func TestCancelExpression(t *testing.T) {
+	db := setupTestDB(t)
+	repo := NewRepository(db)
+
+	expr := &models.Expression{
+		ID:         "expr",
+		UserID:     "user1",
+		Expression: "(2+3)*(4+5)",
+		Status:     "pending",
+		Tasks: []*models.Task{
+			{ID: "left", Args: []models.Operand{{Value: "2"}, {Value: "3"}}, Operation: "+", Status: "pending"},
+			{ID: "right", Args: []models.Operand{{Value: "4"}, {Value: "5"}}, Operation: "+", Status: "pending"},
+			{ID: "product", Args: []models.Operand{{TaskID: "left"}, {TaskID: "right"}}, Operation: "*", Status: "pending", Dependencies: []string{"left", "right"}},
+		},
+	}
+	if err := repo.AddExpression(expr); err != nil {
+		t.Fatalf("AddExpression failed: %v", err)
+	}
+	repo.ClaimTask("agent", time.Minute, nil)
+
+	if err := repo.CancelExpression("expr", "user2"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("CancelExpression() by another user: error = %v; want sql.ErrNoRows", err)
+	}
+	if err := repo.CancelExpression("expr", "user1"); err != nil {
+		t.Fatalf("CancelExpression() error = %v", err)
+	}
+
+	if task, ok := repo.ClaimTask("agent", time.Minute, nil); ok {
+		t.Errorf("ClaimTask() = %v; tasks of a cancelled expression must be skipped", task)
+	}
+	if _, err := repo.RenewLease("left", "agent", time.Minute); !errors.Is(err, ErrTaskCancelled) {
+		t.Errorf("RenewLease() error = %v; want ErrTaskCancelled", err)
+	}
+	if err := repo.UpdateTaskStatus("left", "agent", "completed", 5, "5"); !errors.Is(err, ErrTaskCancelled) {
+		t.Errorf("UpdateTaskStatus() error = %v; want ErrTaskCancelled", err)
+	}
+
+	found, _ := repo.GetExpressionByID("expr", "user1")
+	if found.Status != "cancelled" {
+		t.Errorf("expression status = %s; want cancelled", found.Status)
+	}
+	for _, task := range found.Tasks {
+		if task.Status != "cancelled" {
+			t.Errorf("task %s status = %s; want cancelled", task.ID, task.Status)
 		}
+	}
+
+	if err := repo.CancelExpression("expr", "user1"); !errors.Is(err, ErrNotCancellable) {
+		t.Errorf("second CancelExpression() error = %v; want ErrNotCancellable", err)
+	}
+}
+
+func TestResultFromRootTask(t *testing.T) {
+	db := setupTestDB(t)
+	repo := NewRepository(db)
+
+	// корень - первая задача: результат выражения берётся у неё,
+	// даже если другая задача завершилась позже
+	expr := &models.Expression{
+		ID:         "expr",
+		UserID:     "user1",
+		Expression: "2+2",
+		Status:     "pending",
+		RootTaskID: "root",
+		Tasks: []*models.Task{
+			{ID: "root", Args: []models.Operand{{Value: "2"}, {Value: "2"}}, Operation: "+", Status: "pending"},
+			{ID: "other", Args: []models.Operand{{Value: "3"}, {Value: "3"}}, Operation: "*", Status: "pending"},
+		},
+	}
+	if err := repo.AddExpression(expr); err != nil {
+		t.Fatalf("AddExpression failed: %v", err)
+	}
+
+	repo.ClaimTask("agent", time.Minute, nil)
+	repo.ClaimTask("agent", time.Minute, nil)
+	repo.UpdateTaskStatus("root", "agent", "completed", 4, "4")
+	repo.UpdateTaskStatus("other", "agent", "completed", 9, "9")
+
+	found, _ := repo.GetExpressionByID("expr", "user1")
+	if found.RootTaskID != "root" || found.Status != "completed" || found.Result.Float64 != 4 || found.ExactResult.String != "4" {
+		t.Errorf("expression = root %q, %s %v %v; want root, completed 4", found.RootTaskID, found.Status, found.Result, found.ExactResult)
+	}
+}
+
+func TestAgentRegistry(t *testing.T) {
+	db := setupTestDB(t)
+	repo := NewRepository(db)
+
+	if err := repo.AgentHeartbeat("agent", time.Now()); !errors.Is(err, ErrAgentNotFound) {
+		t.Errorf("AgentHeartbeat() before registration: error = %v; want ErrAgentNotFound", err)
+	}
+	agent := &models.Agent{ID: "agent", Hostname: "host", Version: "1.0", ComputingPower: 2,
+		Capabilities: models.Capabilities{Operations: []string{"+", "*"}}}
+	if err := repo.RegisterAgent(agent); err != nil {
+		t.Fatalf("RegisterAgent() error = %v", err)
+	}
+
+	expr := &models.Expression{
+		ID:         "expr",
+		UserID:     "user1",
+		Expression: "2+2 + 3*3",
+		Status:     "pending",
+		Tasks: []*models.Task{
+			{ID: "sum", Args: []models.Operand{{Value: "2"}, {Value: "2"}}, Operation: "+", Status: "pending"},
+			{ID: "product", Args: []models.Operand{{Value: "3"}, {Value: "3"}}, Operation: "*", Status: "pending"},
+			{ID: "total", Args: []models.Operand{{TaskID: "sum"}, {TaskID: "product"}}, Operation: "+", Status: "pending"},
+		},
+	}
+	if err := repo.AddExpression(expr); err != nil {
+		t.Fatalf("AddExpression failed: %v", err)
+	}
+	repo.ClaimTask("agent", time.Hour, nil)
+	repo.ClaimTask("agent", time.Hour, nil)
+	repo.UpdateTaskStatus("sum", "agent", "completed", 4, "4")
+
+	agents, err := repo.GetAgents()
+	if err != nil || len(agents) != 1 {
+		t.Fatalf("GetAgents() = %v, %v; want one agent", agents, err)
+	}
+	got := agents[0]
+	if got.Status != "online" || got.TasksInFlight != 1 || got.CompletedTasks != 1 ||
+		!reflect.DeepEqual(got.Operations, []string{"+", "*"}) || got.LastSeenAt.IsZero() {
+		t.Errorf("GetAgents() = %+v; want online agent with 1 task in flight and 1 completed", got)
+	}
+
+	// heartbeat был только что: агент ещё жив
+	if lost, err := repo.ReleaseLostAgents(time.Now().Add(-time.Minute)); err != nil || lost != 0 {
+		t.Fatalf("ReleaseLostAgents() = %d, %v; want 0", lost, err)
+	}
+	// агент пропал: аренда его задачи обрывается сразу, а не через час
+	now := time.Now().Add(time.Minute)
+	if lost, err := repo.ReleaseLostAgents(now.Add(-time.Second)); err != nil || lost != 1 {
+		t.Fatalf("ReleaseLostAgents() = %d, %v; want 1", lost, err)
+	}
+	if requeued, _, err := repo.ReapExpiredLeases(now, 5); err != nil || requeued != 1 {
+		t.Fatalf("ReapExpiredLeases() = %d, %v; want 1 requeued", requeued, err)
+	}
+	agents, _ = repo.GetAgents()
+	if agents[0].Status != "offline" || agents[0].TasksInFlight != 0 {
+		t.Errorf("GetAgents() = %+v; want offline agent without tasks", agents[0])
+	}
+
+	// агент вернулся
+	if err := repo.AgentHeartbeat("agent", time.Now()); err != nil {
+		t.Errorf("AgentHeartbeat() error = %v", err)
+	}
+	agents, _ = repo.GetAgents()
+	if agents[0].Status != "online" {
+		t.Errorf("agent status after heartbeat = %s; want online", agents[0].Status)
+	}
+}
+
+// TestClaimTasksPaging проверяет, что задачи, которые агент не умеет считать,
+// не мешают выдать ему подходящие дальше в очереди
+func TestClaimTasksPaging(t *testing.T) {
+	db := setupTestDB(t)
+	repo := NewRepository(db)
+
+	expr := &models.Expression{ID: "expr", UserID: "user1", Expression: "...", Status: "pending"}
+	for i := 0; i < 2*readyPageSize; i++ {
+		expr.Tasks = append(expr.Tasks, &models.Task{
+			ID: "product" + strconv.Itoa(i), Args: []models.Operand{{Value: "2"}, {Value: "2"}}, Operation: "*", Status: "pending",
+		})
+	}
+	for i := 0; i < 3; i++ {
+		expr.Tasks = append(expr.Tasks, &models.Task{
+			ID: "sum" + strconv.Itoa(i), Args: []models.Operand{{Value: "2"}, {Value: "2"}}, Operation: "+", Status: "pending",
+		})
+	}
+	if err := repo.AddExpression(expr); err != nil {
+		t.Fatalf("AddExpression failed: %v", err)
+	}
+
+	adder := &models.Capabilities{Operations: []string{"+"}}
+	tasks := repo.ClaimTasks("adder", time.Minute, adder, 2)
+	if len(tasks) != 2 || tasks[0].ID != "sum0" || tasks[1].ID != "sum1" {
+		t.Fatalf("ClaimTasks(2) = %v; want sum0, sum1", tasks)
+	}
+	if tasks := repo.ClaimTasks("adder", time.Minute, adder, 5); len(tasks) != 1 || tasks[0].ID != "sum2" {
+		t.Fatalf("ClaimTasks(5) = %v; want sum2", tasks)
+	}
+	if tasks := repo.ClaimTasks("adder", time.Minute, adder, 5); len(tasks) != 0 {
+		t.Fatalf("ClaimTasks() = %v; want no tasks", tasks)
+	}
+
+	// агенту без ограничений задачи выдаются по порядку, не больше limit
+	tasks = repo.ClaimTasks("any", time.Minute, nil, readyPageSize+1)
+	if len(tasks) != readyPageSize+1 || tasks[0].ID != "product0" {
+		t.Fatalf("ClaimTasks(%d) = %d tasks; want %d from product0", readyPageSize+1, len(tasks), readyPageSize+1)
+	}
+}
+
+func TestCapabilityRouting(t *testing.T) {
+	db := setupTestDB(t)
+	repo := NewRepository(db)
+
+	expr := &models.Expression{
+		ID:         "expr",
+		UserID:     "user1",
+		Expression: "sqrt(16) + 1/3",
+		Status:     "pending",
+		Tasks: []*models.Task{
+			{ID: "sqrt", Args: []models.Operand{{Value: "16"}}, Operation: "sqrt", Status: "pending"},
+			{ID: "third", Args: []models.Operand{{Value: "1"}, {Value: "3"}}, Operation: "/", Mode: "rational", Status: "pending"},
+			{ID: "sum", Args: []models.Operand{{TaskID: "sqrt"}, {TaskID: "third"}}, Operation: "+", Mode: "rational", Status: "pending"},
+		},
+	}
+	if err := repo.AddExpression(expr); err != nil {
+		t.Fatalf("AddExpression failed: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		caps models.Capabilities
+		want string // id выданной задачи, пустой - задач нет
+	}{
+		{"no matching operation", models.Capabilities{Operations: []string{"+", "-"}}, ""},
+		{"no matching mode", models.Capabilities{Operations: []string{"/"}, Modes: []string{"float"}}, ""},
+		{"operand too long", models.Capabilities{Operations: []string{"sqrt"}, MaxOperandSize: 1}, ""},
+		{"matching mode", models.Capabilities{Operations: []string{"/"}, Modes: []string{"rational"}}, "third"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			task, ok := repo.ClaimTask("agent", time.Hour, &tt.caps)
+			if tt.want == "" && ok {
+				t.Errorf("ClaimTask() = %s; want no task", task.ID)
+			}
+			if tt.want != "" && (!ok || task.ID != tt.want) {
+				t.Errorf("ClaimTask() = %v, %v; want %s", task, ok, tt.want)
+			}
+		})
+	}
+
+	// sqrt не умеет считать ни один агент: выражение заблокировано,
+	// но проверка другого выражения его не трогает
+	basic := []models.Capabilities{{Operations: []string{"+", "-", "*", "/"}}}
+	if blocked, _, err := repo.UpdateBlockedExpressions(basic, "other"); err != nil || blocked != 0 {
+		t.Fatalf("UpdateBlockedExpressions(other) = %d, %v; want nothing blocked", blocked, err)
+	}
+	if blocked, unblocked, err := repo.UpdateBlockedExpressions(basic, ""); err != nil || blocked != 1 || unblocked != 0 {
+		t.Fatalf("UpdateBlockedExpressions() = %d, %d, %v; want 1 blocked", blocked, unblocked, err)
+	}
+	if found, _ := repo.GetExpressionByID("expr", "user1"); found.Status != "blocked" {
+		t.Errorf("expression status = %s; want blocked", found.Status)
+	}
+
+	// появился агент с функциями: выражение снова ждёт результата
+	withFunctions := append(basic, models.Capabilities{Operations: []string{"sqrt"}})
+	if blocked, unblocked, err := repo.UpdateBlockedExpressions(withFunctions, ""); err != nil || blocked != 0 || unblocked != 1 {
+		t.Fatalf("UpdateBlockedExpressions() = %d, %d, %v; want 1 unblocked", blocked, unblocked, err)
+	}
+	if found, _ := repo.GetExpressionByID("expr", "user1"); found.Status != "pending" {
+		t.Errorf("expression status = %s; want pending", found.Status)
+	}
+}
+
+func TestBlockedExpressionsInBackoff(t *testing.T) {
+	db := setupTestDB(t)
+	repo := NewRepository(db)
+
+	// единственная задача sqrt ждёт повтора после ошибки
+	waiting := &models.Expression{
+		ID: "waiting", UserID: "user1", Expression: "sqrt(16)", Status: "pending",
+		Tasks: []*models.Task{{ID: "sqrt", Args: []models.Operand{{Value: "16"}}, Operation: "sqrt", Status: "pending"}},
+	}
+	if err := repo.AddExpression(waiting); err != nil {
+		t.Fatalf("AddExpression failed: %v", err)
+	}
+	repo.ClaimTask("agent", time.Minute, nil)
+	if err := repo.RetryTask("sqrt", "agent", "connection reset", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("RetryTask() error = %v", err)
+	}
+
+	// задачу со слишком длинным операндом видно только на второй странице
+	long := &models.Expression{ID: "long", UserID: "user1", Expression: "...", Status: "pending"}
+	for i := 0; i < readyPageSize; i++ {
+		long.Tasks = append(long.Tasks, &models.Task{
+			ID: "sum" + strconv.Itoa(i), Args: []models.Operand{{Value: "2"}, {Value: "2"}}, Operation: "+", Status: "pending",
+		})
+	}
+	long.Tasks = append(long.Tasks, &models.Task{
+		ID: "big", Args: []models.Operand{{Value: "12345"}, {Value: "2"}}, Operation: "+", Status: "pending",
 	})
+	if err := repo.AddExpression(long); err != nil {
+		t.Fatalf("AddExpression failed: %v", err)
+	}
+
+	limited := []models.Capabilities{{Operations: []string{"+", "-", "*", "/"}, MaxOperandSize: 2}}
+	if blocked, unblocked, err := repo.UpdateBlockedExpressions(limited, ""); err != nil || blocked != 2 || unblocked != 0 {
+		t.Fatalf("UpdateBlockedExpressions() = %d, %d, %v; want 2 blocked", blocked, unblocked, err)
+	}
+
+	withFunctions := append(limited, models.Capabilities{Operations: []string{"+", "sqrt"}})
+	if blocked, unblocked, err := repo.UpdateBlockedExpressions(withFunctions, ""); err != nil || blocked != 0 || unblocked != 2 {
+		t.Fatalf("UpdateBlockedExpressions() = %d, %d, %v; want 2 unblocked", blocked, unblocked, err)
+	}
 }
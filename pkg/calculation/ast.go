@@ -0,0 +1,121 @@
+package calculation
+
+import "strings"
+
+// Pos - смещение в байтах от начала исходного выражения
+type Pos int
+
+// Node - узел дерева разбора выражения.
+// Pos и End задают участок исходной строки [Pos, End), из которого получен узел.
+type Node interface {
+	Pos() Pos
+	End() Pos
+	String() string
+}
+
+// Number - числовой литерал. Value - каноническая запись из scanNumber,
+// Raw - литерал как он записан в выражении: "1_000" против "1000".
+type Number struct {
+	Value    string
+	Raw      string
+	ValuePos Pos
+}
+
+// Ident - переменная. Перед вычислением Bind заменяет её значением из привязок.
+type Ident struct {
+	Name    string
+	NamePos Pos
+}
+
+// Ref - результат, который уже вычисляется отдельной задачей.
+// Парсер таких узлов не создаёт: их подставляют инструменты, которые
+// заменяют поддерево на готовую задачу, а Lower превращает их в ссылки.
+type Ref struct {
+	TaskID   string
+	From, To Pos
+}
+
+// UnaryOp - унарный минус. Унарный плюс ничего не меняет и в дерево не попадает.
+type UnaryOp struct {
+	Op    string
+	OpPos Pos
+	X     Node
+}
+
+// BinaryOp - бинарная операция X Op Y
+type BinaryOp struct {
+	Op    string
+	OpPos Pos
+	X, Y  Node
+}
+
+// Call - вызов встроенной функции
+type Call struct {
+	Name    string
+	NamePos Pos
+	Args    []Node
+	Rparen  Pos
+}
+
+func (n *Number) Pos() Pos   { return n.ValuePos }
+func (n *Ident) Pos() Pos    { return n.NamePos }
+func (n *Ref) Pos() Pos      { return n.From }
+func (n *UnaryOp) Pos() Pos  { return n.OpPos }
+func (n *BinaryOp) Pos() Pos { return n.X.Pos() }
+func (n *Call) Pos() Pos     { return n.NamePos }
+
+func (n *Number) End() Pos   { return n.ValuePos + Pos(len(n.literal())) }
+func (n *Ident) End() Pos    { return n.NamePos + Pos(len(n.Name)) }
+func (n *Ref) End() Pos      { return n.To }
+func (n *UnaryOp) End() Pos  { return n.X.End() }
+func (n *BinaryOp) End() Pos { return n.Y.End() }
+func (n *Call) End() Pos     { return n.Rparen + 1 }
+
+func (n *Number) String() string { return n.Value }
+func (n *Ident) String() string  { return n.Name }
+func (n *Ref) String() string    { return "$" + n.TaskID }
+
+// literal возвращает исходную запись числа. У узлов, созданных не парсером, её нет.
+func (n *Number) literal() string {
+	if n.Raw != "" {
+		return n.Raw
+	}
+	return n.Value
+}
+
+func (n *UnaryOp) String() string {
+	return n.Op + n.X.String()
+}
+
+// String у BinaryOp расставляет скобки вокруг каждой операции,
+// чтобы порядок вычисления был виден без знания приоритетов
+func (n *BinaryOp) String() string {
+	return "(" + n.X.String() + " " + n.Op + " " + n.Y.String() + ")"
+}
+
+func (n *Call) String() string {
+	args := make([]string, len(n.Args))
+	for i, arg := range n.Args {
+		args[i] = arg.String()
+	}
+	return n.Name + "(" + strings.Join(args, ", ") + ")"
+}
+
+// Inspect обходит дерево в глубину, начиная с node, и вызывает f для каждого узла.
+// Если f возвращает false, потомки узла пропускаются.
+func Inspect(node Node, f func(Node) bool) {
+	if node == nil || !f(node) {
+		return
+	}
+	switch n := node.(type) {
+	case *UnaryOp:
+		Inspect(n.X, f)
+	case *BinaryOp:
+		Inspect(n.X, f)
+		Inspect(n.Y, f)
+	case *Call:
+		for _, arg := range n.Args {
+			Inspect(arg, f)
+		}
+	}
+}
@@ -1,10 +1,53 @@
 package calculation
 
 import (
+	"errors"
+	"fmt"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+
+	"github.com/zalhui/calc_golang/internal/common/models"
 )
 
+// convertToRPN записывает дерево выражения в обратной польской записи.
+// Вызов функции записывается вместе с числом аргументов: "max#3".
+func convertToRPN(expression string) ([]string, error) {
+	root, err := Parse(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	var rpn []string
+	var write func(node Node)
+	write = func(node Node) {
+		switch n := node.(type) {
+		case *Number:
+			rpn = append(rpn, n.Value)
+		case *Ident:
+			rpn = append(rpn, n.Name)
+		case *Ref:
+			rpn = append(rpn, n.String())
+		case *UnaryOp:
+			write(n.X)
+			rpn = append(rpn, OpNegate)
+		case *BinaryOp:
+			write(n.X)
+			write(n.Y)
+			rpn = append(rpn, n.Op)
+		case *Call:
+			for _, arg := range n.Args {
+				write(arg)
+			}
+			rpn = append(rpn, n.Name+"#"+strconv.Itoa(len(n.Args)))
+		}
+	}
+	write(root)
+
+	return rpn, nil
+}
+
 func TestConvertToRPN(t *testing.T) {
 	tests := []struct {
 		expression string
@@ -31,24 +74,558 @@ func TestConvertToRPN(t *testing.T) {
 		{"42", []string{"42"}, nil},                                       // Одно число
 		{"((2+3))", []string{"2", "3", "+"}, nil},                         // Многоуровневые скобки
 		{"2*(3*(4+5))", []string{"2", "3", "4", "5", "+", "*", "*"}, nil}, // Вложенные скобки
+		{"2.5+3.7", []string{"2.5", "3.7", "+"}, nil},                     // Десятичные числа
+
+		// Унарные плюс и минус
+		{"-3+5", []string{"3", "neg", "5", "+"}, nil},
+		{"2*(-4)", []string{"2", "4", "neg", "*"}, nil},
+		{"2*-4", []string{"2", "4", "neg", "*"}, nil},
+		{"(-(2+3))", []string{"2", "3", "+", "neg"}, nil},
+		{"--2", []string{"2", "neg", "neg"}, nil},
+		{"+2", []string{"2"}, nil},
+		{"2++2", []string{"2", "2", "+"}, nil},
+		{"2-(-3)", []string{"2", "3", "neg", "-"}, nil},
+		{"-2*3", []string{"2", "neg", "3", "*"}, nil},
+
+		// Степень, остаток и целочисленное деление
+		{"2^3", []string{"2", "3", "^"}, nil},
+		{"2^3^2", []string{"2", "3", "2", "^", "^"}, nil},
+		{"2*3^2", []string{"2", "3", "2", "^", "*"}, nil},
+		{"-2^2", []string{"2", "2", "^", "neg"}, nil},
+		{"2^-1", []string{"2", "1", "neg", "^"}, nil},
+		{"7%3", []string{"7", "3", "%"}, nil},
+		{"7//2", []string{"7", "2", "//"}, nil},
+		{"8//2//2", []string{"8", "2", "//", "2", "//"}, nil},
+		{"1+7%3*2", []string{"1", "7", "3", "%", "2", "*", "+"}, nil},
+		{"9/3//2", []string{"9", "3", "/", "2", "//"}, nil},
+
+		// Вызовы функций
+		{"sqrt(2)", []string{"2", "sqrt#1"}, nil},
+		{"max(3, 4, 5)", []string{"3", "4", "5", "max#3"}, nil},
+		{"sqrt(2)*max(3, 4, 5)+log(100, 10)", []string{"2", "sqrt#1", "3", "4", "5", "max#3", "*", "100", "10", "log#2", "+"}, nil},
+		{"min(1+2, (3), -4)", []string{"1", "2", "+", "3", "4", "neg", "min#3"}, nil},
+		{"abs(min(1, 2)-3)", []string{"1", "2", "min#2", "3", "-", "abs#1"}, nil},
+		{"-sqrt (4)^2", []string{"4", "sqrt#1", "2", "^", "neg"}, nil},
+		{"price*(1+tax)", []string{"price", "1", "tax", "+", "*"}, nil}, // Переменные
 
 		// Ошибочные случаи
-		{"2++2", nil, ErrValues},     // Два оператора подряд
+		{"2*/2", nil, ErrValues},     // Два оператора подряд
+		{"2///2", nil, ErrValues},    // Целочисленное деление и ещё один слэш
+		{"^2", nil, ErrValues},       // Степень без основания
+		{"2-", nil, ErrValues},       // Нет правого операнда
+		{"-", nil, ErrValues},        // Унарный минус без операнда
+		{"()", nil, ErrValues},       // Пустые скобки
 		{"2+(3*4", nil, ErrBrackets}, // Несбалансированные скобки
 		{"(2+3))", nil, ErrBrackets}, // Лишняя закрывающая скобка
-		{"2+x", nil, ErrAllowed},     // Недопустимый символ
+		{"2+#", nil, ErrAllowed},     // Недопустимый символ
 		{"2 3 +", nil, ErrAllowed},   // Пробелы между числами
 		{"", nil, ErrValues},         // Пустое выражение
 		{"+", nil, ErrValues},        // Только оператор
 		{"(2+3", nil, ErrBrackets},   // Незакрытая скобка
 		{"2+3)", nil, ErrBrackets},   // Лишняя закрывающая скобка
-		{"2.5+3.7", nil, ErrAllowed}, // Десятичные числа (если не поддерживаются)
+		{"2(3)", nil, ErrAllowed},    // Скобка сразу после числа
+		{"foo(1)", nil, ErrUnknownFunction},
+		{"sqrt", nil, ErrAllowed},      // Имя функции без скобок
+		{"1, 2", nil, ErrAllowed},      // Запятая вне вызова
+		{"(1, 2)", nil, ErrAllowed},    // Запятая в обычных скобках
+		{"max(1,)", nil, ErrValues},    // Пропущенный аргумент
+		{"max(,1)", nil, ErrValues},    // Пропущенный аргумент
+		{"max(1, 2", nil, ErrBrackets}, // Незакрытый вызов
+		{"2sqrt(4)", nil, ErrAllowed},  // Функция сразу после числа
 	}
 
 	for _, tt := range tests {
 		result, err := convertToRPN(tt.expression)
-		if !reflect.DeepEqual(result, tt.expected) || err != tt.err {
+		if !reflect.DeepEqual(result, tt.expected) || !errors.Is(err, tt.err) {
 			t.Errorf("convertToRPN(%q) = %v, %v; want %v, %v", tt.expression, result, err, tt.expected, tt.err)
 		}
 	}
 }
+
+func TestScanNumber(t *testing.T) {
+	tests := []struct {
+		literal  string
+		expected string
+		err      error
+	}{
+		{"42", "42", nil},
+		{"007", "7", nil},
+		{"2.50", "2.5", nil},
+		{".5", "0.5", nil},
+		{"5.", "5", nil},
+		{"0.000", "0", nil},
+		{"1_000_000", "1000000", nil},
+		{"1e-9", "1e-9", nil},
+		{"6.02E+023", "6.02e23", nil},
+		{"1_0.0_1e1_0", "10.01e10", nil},
+		{"0e5", "0", nil},
+		{"0xFF", "255", nil},
+		{"0Xdead_BEEF", "3735928559", nil},
+		{"0b1010", "10", nil},
+		{"0x1_0000_0000_0000_0000", "18446744073709551616", nil},
+		{"1.2.3", "", ErrNumber},
+		{".", "", ErrNumber},
+		{"1_", "", ErrNumber},
+		{"1__0", "", ErrNumber},
+		{"1_.5", "", ErrNumber},
+		{"1e", "", ErrNumber},
+		{"1e+", "", ErrNumber},
+		{"0x", "", ErrNumber},
+		{"0x_1", "", ErrNumber},
+		{"0b12", "", ErrNumber},
+		{"1e99999", "", ErrNumber},
+	}
+
+	for _, tt := range tests {
+		value, end, err := scanNumber(tt.literal, 0)
+		if value != tt.expected || !errors.Is(err, tt.err) || end != len(tt.literal) {
+			t.Errorf("scanNumber(%q) = %q, %d, %v; want %q, %d, %v",
+				tt.literal, value, end, err, tt.expected, len(tt.literal), tt.err)
+		}
+	}
+
+	// литерал заканчивается там, где начинается оператор или имя функции
+	for expression, want := range map[string]int{"1e-9-1": 4, "0xFF+1": 4, "0b1)": 3, "2sqrt(4)": 1} {
+		value, end, err := scanNumber(expression, 0)
+		if err != nil || end != want {
+			t.Errorf("scanNumber(%q) = %q, %d, %v; want end %d", expression, value, end, err, want)
+		}
+	}
+}
+
+func TestConvertToRPNArity(t *testing.T) {
+	for _, expression := range []string{"sqrt()", "sqrt(1, 2)", "log(1, 2, 3)", "max()"} {
+		if _, err := convertToRPN(expression); !errors.Is(err, ErrArity) {
+			t.Errorf("convertToRPN(%q) error = %v; want %v", expression, err, ErrArity)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		expression string
+		tree       string
+		pos, end   Pos
+	}{
+		{"42", "42", 0, 2},
+		{" 2 + 3*4", "(2 + (3 * 4))", 1, 8},
+		{"-(2+3)", "-(2 + 3)", 0, 5},
+		{"2^3^2", "(2 ^ (3 ^ 2))", 0, 5},
+		{"max(1, 2+3) // 2", "(max(1, (2 + 3)) // 2)", 0, 16},
+	}
+
+	for _, tt := range tests {
+		node, err := Parse(tt.expression)
+		if err != nil {
+			t.Errorf("Parse(%q) error = %v", tt.expression, err)
+			continue
+		}
+		if node.String() != tt.tree || node.Pos() != tt.pos || node.End() != tt.end {
+			t.Errorf("Parse(%q) = %s [%d, %d); want %s [%d, %d)",
+				tt.expression, node, node.Pos(), node.End(), tt.tree, tt.pos, tt.end)
+		}
+	}
+
+	node, _ := Parse("1 + sqrt(16)")
+	call := node.(*BinaryOp).Y.(*Call)
+	if call.NamePos != 4 || call.Rparen != 11 || call.Args[0].Pos() != 9 {
+		t.Errorf("Parse(%q) call positions = %d, %d, %d; want 4, 11, 9", "1 + sqrt(16)", call.NamePos, call.Rparen, call.Args[0].Pos())
+	}
+}
+
+func TestLower(t *testing.T) {
+	root := &BinaryOp{
+		Op: "*",
+		X:  &BinaryOp{Op: "+", X: &Number{Value: "2"}, Y: &Number{Value: "3"}},
+		Y:  &Ref{TaskID: "external"},
+	}
+
+	tasks, err := Lower(root, "expr")
+	if err != nil {
+		t.Fatalf("Lower() error = %v", err)
+	}
+	if len(tasks) != 2 {
+		t.Fatalf("Lower() returned %d tasks; want 2", len(tasks))
+	}
+
+	sum, product := tasks[0], tasks[1]
+	if sum.Operation != "+" || !reflect.DeepEqual(sum.Args, []models.Operand{{Value: "2"}, {Value: "3"}}) || len(sum.Dependencies) != 0 {
+		t.Errorf("first task = %s %v deps %v; want + [2 3] without deps", sum.Operation, sum.Args, sum.Dependencies)
+	}
+	wantArgs := []models.Operand{{TaskID: sum.ID}, {TaskID: "external"}}
+	if product.Operation != "*" || !reflect.DeepEqual(product.Args, wantArgs) ||
+		!reflect.DeepEqual(product.Dependencies, []string{sum.ID, "external"}) {
+		t.Errorf("second task = %s %v deps %v; want * %v", product.Operation, product.Args, product.Dependencies, wantArgs)
+	}
+	for _, task := range tasks {
+		if task.ExpressionID != "expr" || task.Status != "pending" {
+			t.Errorf("task %s has expression %q and status %q", task.ID, task.ExpressionID, task.Status)
+		}
+	}
+
+	if tasks, err := Lower(&Number{Value: "42"}, "expr"); err != nil || len(tasks) != 0 {
+		t.Errorf("Lower(42) = %v, %v; want no tasks", tasks, err)
+	}
+}
+
+func TestParseExpressionPlan(t *testing.T) {
+	tests := []struct {
+		expression string
+		variables  map[string]string
+		tasks      int
+		root       string // операция корневой задачи
+		value      string
+	}{
+		{"(2+3)*4", nil, 2, "*", ""},
+		{"max(1, 2) + sqrt(4)", nil, 3, "+", ""},
+		{"-x", map[string]string{"x": "2"}, 1, OpNegate, ""},
+		{"42", nil, 0, "", "42"},
+		{"(1_000)", nil, 0, "", "1000"},
+		{"x", map[string]string{"x": "-0.50"}, 0, "", "-0.5"},
+	}
+
+	for _, tt := range tests {
+		plan, err := ParseExpression(tt.expression, "expr", tt.variables)
+		if err != nil {
+			t.Fatalf("ParseExpression(%q) error = %v", tt.expression, err)
+		}
+		if len(plan.Tasks) != tt.tasks || plan.Value != tt.value {
+			t.Errorf("ParseExpression(%q) = %d tasks, value %q; want %d, %q", tt.expression, len(plan.Tasks), plan.Value, tt.tasks, tt.value)
+			continue
+		}
+		var root *models.Task
+		for _, task := range plan.Tasks {
+			if task.ID == plan.RootTaskID {
+				root = task
+			}
+		}
+		if tt.tasks > 0 && (root == nil || root.Operation != tt.root) {
+			t.Errorf("ParseExpression(%q) root task = %v; want %s", tt.expression, root, tt.root)
+		}
+		if tt.tasks == 0 && plan.RootTaskID != "" {
+			t.Errorf("ParseExpression(%q) root task = %q; want none", tt.expression, plan.RootTaskID)
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		expression string
+		code       string
+		offset     int
+		token      string
+		snippet    string
+	}{
+		{"2 + (3 * 4", CodeBrackets, 4, "(", "2 + (3 * 4\n    ^"},
+		{"2+3)", CodeBrackets, 3, ")", "2+3)\n   ^"},
+		{"2 * / 2", CodeValues, 4, "/", "2 * / 2\n    ^"},
+		{"2 +", CodeValues, 3, "", "2 +\n   ^"},
+		{"1 // // 2", CodeValues, 5, "//", "1 // // 2\n     ^~"},
+		{"2 + #", CodeAllowed, 4, "#", "2 + #\n    ^"},
+		{"2 sqrt", CodeAllowed, 2, "sqrt", "2 sqrt\n  ^~~~"},
+		{"sqrt + 1", CodeAllowed, 0, "sqrt", "sqrt + 1\n^~~~"},
+		{"1 + 2 34", CodeAllowed, 6, "34", "1 + 2 34\n      ^~"},
+		{"π + 1", CodeAllowed, 0, "π", "π + 1\n^"},
+		{"1 + foo(2)", CodeUnknownFunction, 4, "foo", "1 + foo(2)\n    ^~~"},
+		{"1.2.3 + 4", CodeNumber, 0, "1.2.3", "1.2.3 + 4\n^~~~~"},
+		{"2 * 1__0", CodeNumber, 4, "1__0", "2 * 1__0\n    ^~~~"},
+		{"0b102", CodeNumber, 0, "0b102", "0b102\n^~~~~"},
+		{"sqrt(1, 2)", CodeArity, 0, "sqrt(1, 2)", "sqrt(1, 2)\n^~~~~~~~~~"},
+		{
+			"1111111111+2222222222+3333333333+4444444444+5555555555+(6",
+			CodeBrackets, 55, "(",
+			"...3333333+4444444444+5555555555+(6\n" + strings.Repeat(" ", 33) + "^",
+		},
+	}
+
+	for _, tt := range tests {
+		_, err := Parse(tt.expression)
+		var perr *ParseError
+		if !errors.As(err, &perr) {
+			t.Errorf("Parse(%q) error = %v; want *ParseError", tt.expression, err)
+			continue
+		}
+		if perr.Code != tt.code || perr.Offset != tt.offset || perr.Token != tt.token {
+			t.Errorf("Parse(%q) error = %s at %d %q; want %s at %d %q",
+				tt.expression, perr.Code, perr.Offset, perr.Token, tt.code, tt.offset, tt.token)
+		}
+		if snippet := perr.Snippet(); snippet != tt.snippet {
+			t.Errorf("Parse(%q) snippet:\n%s\nwant:\n%s", tt.expression, snippet, tt.snippet)
+		}
+	}
+
+	_, err := Parse("(1")
+	if !errors.Is(err, ErrBrackets) {
+		t.Errorf("Parse(%q) error = %v; want errors.Is(err, ErrBrackets)", "(1", err)
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		expression string
+		expected   float64
+		err        error
+	}{
+		{"42", 42, nil},
+		{"2+2*2", 6, nil},
+		{"(2+3)*(4-1)", 15, nil},
+		{"-3+5", 2, nil},
+		{"1_000 * 1e-3 + 0xFF - 0b11", 253, nil},
+		{"--2", 2, nil},
+		{"2^3^2", 512, nil},
+		{"-7 % 3", 2, nil},
+		{"-7 // 2", -4, nil},
+		{"sqrt(16)*max(3, 4, 5)+log(100, 10)", 22, nil},
+		{"min(1+2, (3), -4) * abs(-2)", -8, nil},
+		{"1/0", 0, ErrDivisionByZero},
+		{"2 + 7 % (3-3)", 0, ErrModuloByZero},
+		{"sqrt(-1) + 1", 0, ErrFunctionDomain},
+		{"2+(3", 0, ErrBrackets},
+		{"1e400 * 0", 0, ErrOverflow}, // Не помещается в float64
+		{"1e400", 0, ErrOverflow},
+		{"1e-400 + 1", 1, nil}, // Слишком малое число - ноль
+	}
+
+	for _, workers := range []int{1, 4} {
+		for _, tt := range tests {
+			result, err := Evaluate(tt.expression, WithWorkers(workers))
+			if result != tt.expected || !errors.Is(err, tt.err) {
+				t.Errorf("Evaluate(%q, WithWorkers(%d)) = %v, %v; want %v, %v",
+					tt.expression, workers, result, err, tt.expected, tt.err)
+			}
+		}
+	}
+}
+
+func TestEvaluateExactDecimal(t *testing.T) {
+	tests := []struct {
+		expression string
+		expected   string
+		err        error
+	}{
+		{"0.1+0.2", "0.3", nil},
+		{"0.10", "0.1", nil},
+		{"1.1*1.1 - 0.21", "1", nil},
+		{"1/3", "0.3333333333333333333333333333", nil},
+		{"2/3", "0.6666666666666666666666666667", nil},
+		{"-2/3", "-0.6666666666666666666666666667", nil},
+		{"2^-2", "0.25", nil},
+		{"2^100", "1267650600228229401496703205376", nil},
+		{"7 // -2 + 7.5 % 2", "-2.5", nil},
+		{"sqrt(2)", "1.4142135623730950488016887242", nil},
+		// через float64: только его значащие цифры, без двоичного хвоста
+		{"2^0.5", "1.4142135623730951", nil},
+		{"sin(1)", "0.8414709848078965", nil},
+		{"abs(-0.1) + min(0.2, 0.3)", "0.3", nil},
+		{"1/(0.1-0.1)", "", ErrDivisionByZero},
+	}
+
+	for _, workers := range []int{1, 4} {
+		for _, tt := range tests {
+			result, err := EvaluateExact(tt.expression, WithMode(ModeDecimal), WithWorkers(workers))
+			if result != tt.expected || !errors.Is(err, tt.err) {
+				t.Errorf("EvaluateExact(%q, decimal, WithWorkers(%d)) = %q, %v; want %q, %v",
+					tt.expression, workers, result, err, tt.expected, tt.err)
+			}
+		}
+	}
+}
+
+func TestRoundDecimalHalfEven(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"0.00000000000000000000000000005", "0"},
+		{"0.00000000000000000000000000015", "0.0000000000000000000000000002"},
+		{"0.00000000000000000000000000025", "0.0000000000000000000000000002"},
+		{"-0.00000000000000000000000000035", "-0.0000000000000000000000000004"},
+	}
+
+	for _, tt := range tests {
+		result, err := ApplyMode(ModeDecimal, "+", []string{tt.value, "0"})
+		if err != nil || result != tt.expected {
+			t.Errorf("ApplyMode(decimal, %s + 0) = %q, %v; want %q", tt.value, result, err, tt.expected)
+		}
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	for _, s := range []string{"", "float"} {
+		if mode, err := ParseMode(s); mode != ModeFloat || err != nil {
+			t.Errorf("ParseMode(%q) = %q, %v; want float", s, mode, err)
+		}
+	}
+	if mode, err := ParseMode("rational"); mode != ModeRational || err != nil {
+		t.Errorf("ParseMode(\"rational\") = %q, %v; want rational", mode, err)
+	}
+	if _, err := ParseMode("binary"); !errors.Is(err, ErrMode) {
+		t.Errorf("ParseMode(\"binary\") error = %v; want %v", err, ErrMode)
+	}
+}
+
+func TestEvaluateExactRational(t *testing.T) {
+	tests := []struct {
+		expression string
+		expected   string
+		err        error
+	}{
+		{"1/3+1/6", "1/2", nil},
+		{"0.1+0.2", "3/10", nil},
+		{"2/4", "1/2", nil},
+		{"(1/3)^-3 - 7", "20", nil},
+		{"-7/2 // 1 + 7/2 % 1", "-7/2", nil},
+		{"sqrt(9/16) * max(1/3, 1/4)", "1/4", nil},
+		{"sqrt(2)", "", ErrInexact},
+		{"sin(1)", "", ErrInexact},
+		{"log(-1)", "", ErrFunctionDomain},
+		{"1/(1/3-1/3)", "", ErrDivisionByZero},
+	}
+
+	for _, workers := range []int{1, 4} {
+		for _, tt := range tests {
+			result, err := EvaluateExact(tt.expression, WithMode(ModeRational), WithWorkers(workers))
+			if result != tt.expected || !errors.Is(err, tt.err) {
+				t.Errorf("EvaluateExact(%q, rational, WithWorkers(%d)) = %q, %v; want %q, %v",
+					tt.expression, workers, result, err, tt.expected, tt.err)
+			}
+		}
+	}
+
+	if result, err := Evaluate("1/4+1/4", WithMode(ModeRational)); result != 0.5 || err != nil {
+		t.Errorf("Evaluate(\"1/4+1/4\", rational) = %v, %v; want 0.5", result, err)
+	}
+}
+
+// TestExactPowerLimit проверяет, что точные режимы не возводят в степень
+// огромные основания, а считают их через float64
+func TestExactPowerLimit(t *testing.T) {
+	tests := []struct {
+		expression string
+		mode       Mode
+		expected   string
+		err        error
+	}{
+		{"(10^10000)^10000", ModeDecimal, "", ErrOverflow},
+		{"(10^10000)^10000", ModeRational, "", ErrOverflow},
+		{"((10^10000)^10000)^10000", ModeRational, "", ErrOverflow},
+		{"(1/10^10000)^10000", ModeDecimal, "0", nil},
+		{"(1/10^10000)^10000", ModeRational, "", ErrInexact},
+		// в пределах лимита степень по-прежнему точная
+		{"(2^1000)^100 - (2^100)^1000", ModeRational, "0", nil},
+	}
+
+	for _, tt := range tests {
+		result, err := EvaluateExact(tt.expression, WithMode(tt.mode))
+		if result != tt.expected || !errors.Is(err, tt.err) {
+			t.Errorf("EvaluateExact(%q, %s) = %.20q, %v; want %q, %v", tt.expression, tt.mode, result, err, tt.expected, tt.err)
+		}
+	}
+}
+
+func TestApproximate(t *testing.T) {
+	tests := []struct {
+		exact    string
+		digits   int
+		expected string
+	}{
+		{"1/3", 5, "0.33333"},
+		{"2/3", 5, "0.66667"},
+		{"-1/8", 2, "-0.13"},
+		{"7", 3, "7.000"},
+		{"22/7", 0, "3"},
+	}
+
+	for _, tt := range tests {
+		result, err := Approximate(tt.exact, tt.digits)
+		if err != nil || result != tt.expected {
+			t.Errorf("Approximate(%q, %d) = %q, %v; want %q", tt.exact, tt.digits, result, err, tt.expected)
+		}
+	}
+}
+
+func TestBind(t *testing.T) {
+	root, err := Parse("price * (1 + tax) - price")
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	bound, err := Bind(root, map[string]string{"price": "1_20", "tax": "0.20", "unused": "-1"})
+	if err != nil {
+		t.Fatalf("Bind() error = %v", err)
+	}
+	if bound.String() != "((120 * (1 + 0.2)) - 120)" || bound.End() != root.End() {
+		t.Errorf("Bind() = %s [%d, %d); want ((120 * (1 + 0.2)) - 120) [%d, %d)",
+			bound, bound.Pos(), bound.End(), root.Pos(), root.End())
+	}
+	if root.String() != "((price * (1 + tax)) - price)" {
+		t.Errorf("Bind() changed the original tree: %s", root)
+	}
+
+	_, err = Bind(root, map[string]string{"tax": "0.2"})
+	var unbound *UnboundError
+	if !errors.As(err, &unbound) || !errors.Is(err, ErrUnbound) {
+		t.Fatalf("Bind() error = %v; want *UnboundError", err)
+	}
+	var positions []Pos
+	for _, v := range unbound.Variables {
+		if v.Name != "price" {
+			t.Errorf("unbound variable %q; want price", v.Name)
+		}
+		positions = append(positions, v.NamePos)
+	}
+	if !reflect.DeepEqual(positions, []Pos{0, 20}) {
+		t.Errorf("unbound positions = %v; want [0 20]", positions)
+	}
+
+	for _, variables := range []map[string]string{{"price": "1.2.3"}, {"price": ""}, {"sqrt": "1"}, {"2x": "1"}} {
+		if _, err := Bind(root, variables); err == nil || errors.Is(err, ErrUnbound) {
+			t.Errorf("Bind(%v) error = %v; want invalid binding", variables, err)
+		}
+	}
+}
+
+func TestEvaluateVariables(t *testing.T) {
+	variables := map[string]string{"price": "120", "tax": "0.2", "discount": "-10"}
+	result, err := EvaluateExact("price * (1 + tax) + discount", WithVariables(variables), WithMode(ModeDecimal))
+	if result != "134" || err != nil {
+		t.Errorf("EvaluateExact() = %q, %v; want 134", result, err)
+	}
+	if result, err := Evaluate("x", WithVariables(map[string]string{"x": "0xFF"})); result != 255 || err != nil {
+		t.Errorf("Evaluate(x) = %v, %v; want 255", result, err)
+	}
+	if _, err := Evaluate("x + 1"); !errors.Is(err, ErrUnbound) {
+		t.Errorf("Evaluate(x + 1) error = %v; want %v", err, ErrUnbound)
+	}
+}
+
+func TestIsDeterministic(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{ErrDivisionByZero, true},
+		{fmt.Errorf("%w: sqrt", ErrInexact), true},
+		{&ParseError{Err: ErrBrackets}, true},
+		{errors.New("connection reset"), false},
+		{nil, false},
+	}
+
+	for _, tt := range tests {
+		if got := IsDeterministic(tt.err); got != tt.expected {
+			t.Errorf("IsDeterministic(%v) = %v; want %v", tt.err, got, tt.expected)
+		}
+	}
+}
+
+func TestOperations(t *testing.T) {
+	for _, op := range Operations() {
+		args := []float64{4, 2}
+		if op == OpNegate || (IsFunction(op) && CheckArity(op, 2) != nil) {
+			args = args[:1]
+		}
+		if _, err := Apply(op, args); err != nil {
+			t.Errorf("Apply(%q, %v) error = %v; every listed operation must be supported", op, args, err)
+		}
+	}
+}
@@ -1,10 +1,130 @@
 package calculation
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
 
 var (
-	ErrBrackets       = errors.New("expression is not valid. number of brackets doesn't match")
-	ErrValues         = errors.New("expression is not valid. not enough values")
-	ErrDivisionByZero = errors.New("expression is not valid. division by zero")
-	ErrAllowed        = errors.New("expression is not valid. only numbers and ( ) + - * / allowed")
+	ErrBrackets        = errors.New("expression is not valid. number of brackets doesn't match")
+	ErrValues          = errors.New("expression is not valid. not enough values")
+	ErrDivisionByZero  = errors.New("expression is not valid. division by zero")
+	ErrModuloByZero    = errors.New("expression is not valid. modulo by zero")
+	ErrPowerDomain     = errors.New("expression is not valid. power is undefined for these arguments")
+	ErrOverflow        = errors.New("expression is not valid. result is out of range")
+	ErrUnknownFunction = errors.New("expression is not valid. unknown function")
+	ErrArity           = errors.New("expression is not valid. wrong number of function arguments")
+	ErrFunctionDomain  = errors.New("expression is not valid. function argument is out of domain")
+	ErrNumber          = errors.New("expression is not valid. malformed number")
+	ErrUnbound         = errors.New("expression is not valid. unbound variable")
+	ErrMode            = errors.New("unknown numeric mode")
+	ErrInexact         = errors.New("result is not a rational number, use decimal mode")
+	ErrAllowed         = errors.New("expression is not valid. only numbers and ( ) + - * / ^ % // allowed")
+)
+
+// IsDeterministic сообщает, что ошибка следует из самих аргументов операции:
+// повторное вычисление даст ту же ошибку, поэтому повторять его бессмысленно
+func IsDeterministic(err error) bool {
+	for _, target := range []error{
+		ErrBrackets, ErrValues, ErrDivisionByZero, ErrModuloByZero, ErrPowerDomain,
+		ErrOverflow, ErrUnknownFunction, ErrArity, ErrFunctionDomain, ErrNumber,
+		ErrUnbound, ErrMode, ErrInexact, ErrAllowed,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Коды ошибок разбора, которые видит клиент API
+const (
+	CodeBrackets        = "brackets"
+	CodeValues          = "values"
+	CodeAllowed         = "allowed"
+	CodeUnknownFunction = "unknown_function"
+	CodeArity           = "arity"
+	CodeNumber          = "number"
+	CodeUnbound         = "unbound_variable"
 )
+
+// ParseError - ошибка разбора с указанием места в выражении.
+// errors.Is(err, ErrBrackets) и т.п. продолжают работать через Unwrap.
+type ParseError struct {
+	Expression string
+	Offset     int    // смещение в байтах от начала выражения
+	Length     int    // длина проблемного участка, 0 - конец выражения
+	Token      string // проблемный участок выражения
+	Code       string
+	Err        error
+}
+
+func newParseError(expression string, err error, offset, length int) *ParseError {
+	code := CodeValues
+	switch {
+	case errors.Is(err, ErrBrackets):
+		code = CodeBrackets
+	case errors.Is(err, ErrAllowed):
+		code = CodeAllowed
+	case errors.Is(err, ErrUnknownFunction):
+		code = CodeUnknownFunction
+	case errors.Is(err, ErrArity):
+		code = CodeArity
+	case errors.Is(err, ErrNumber):
+		code = CodeNumber
+	}
+	return &ParseError{
+		Expression: expression,
+		Offset:     offset,
+		Length:     length,
+		Token:      expression[offset : offset+length],
+		Code:       code,
+		Err:        err,
+	}
+}
+
+func (e *ParseError) Error() string {
+	if e.Token == "" {
+		return fmt.Sprintf("%v: at end of expression", e.Err)
+	}
+	return fmt.Sprintf("%v: %q at position %d", e.Err, e.Token, e.Offset)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// snippetContext - сколько символов выражения показывать слева и справа от ошибки
+const snippetContext = 30
+
+// Snippet возвращает фрагмент выражения и строку под ним, где ^ отмечает
+// место ошибки:
+//
+//	2 + (3 * 4
+//	    ^
+//
+// Длинные выражения обрезаются до snippetContext символов вокруг ошибки.
+func (e *ParseError) Snippet() string {
+	before := []rune(e.Expression[:e.Offset])
+	token := []rune(e.Token)
+	after := []rune(e.Expression[e.Offset+e.Length:])
+
+	prefix, suffix := "", ""
+	if len(before) > snippetContext {
+		before = before[len(before)-snippetContext:]
+		prefix = "..."
+	}
+	if len(after) > snippetContext {
+		after = after[:snippetContext]
+		suffix = "..."
+	}
+
+	marker := "^"
+	if len(token) > 1 {
+		marker += strings.Repeat("~", len(token)-1)
+	}
+	line := prefix + string(before) + string(token) + string(after) + suffix
+	caret := strings.Repeat(" ", len([]rune(prefix))+len(before)) + marker
+	return line + "\n" + caret
+}
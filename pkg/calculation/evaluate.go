@@ -0,0 +1,202 @@
+package calculation
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/zalhui/calc_golang/internal/common/models"
+)
+
+type evalOptions struct {
+	workers   int
+	mode      Mode
+	variables map[string]string
+}
+
+// Option настраивает Evaluate
+type Option func(*evalOptions)
+
+// WithWorkers вычисляет независимые задачи параллельно, не больше n одновременно.
+// При n <= 1 задачи выполняются по очереди.
+func WithWorkers(n int) Option {
+	return func(o *evalOptions) {
+		o.workers = n
+	}
+}
+
+// WithMode задаёт числовой режим вычисления, по умолчанию ModeFloat
+func WithMode(mode Mode) Option {
+	return func(o *evalOptions) {
+		o.mode = mode
+	}
+}
+
+// WithVariables задаёт значения переменных выражения
+func WithVariables(variables map[string]string) Option {
+	return func(o *evalOptions) {
+		o.variables = variables
+	}
+}
+
+// Evaluate вычисляет выражение сразу, без оркестратора и агентов.
+// Выражение разбирается в те же задачи, что и в ParseExpression,
+// а каждая задача считается через ApplyMode, как это делает агент.
+func Evaluate(expression string, opts ...Option) (float64, error) {
+	result, err := EvaluateExact(expression, opts...)
+	if err != nil {
+		return 0, err
+	}
+	return ToFloat(result)
+}
+
+// EvaluateExact работает как Evaluate, но возвращает результат строкой,
+// без потери точности в режимах ModeDecimal и ModeRational
+func EvaluateExact(expression string, opts ...Option) (string, error) {
+	options := evalOptions{workers: 1, mode: ModeFloat}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	root, err := Parse(expression)
+	if err != nil {
+		return "", err
+	}
+	if root, err = Bind(root, options.variables); err != nil {
+		return "", err
+	}
+	if number, ok := root.(*Number); ok {
+		// число без операций всё равно приводим к записи выбранного режима
+		return FormatMode(options.mode, number.Value)
+	}
+
+	tasks, err := Lower(root, "")
+	if err != nil {
+		return "", err
+	}
+
+	var results map[string]string
+	if options.workers > 1 {
+		results, err = runParallel(tasks, options.mode, options.workers)
+	} else {
+		results, err = runSequential(tasks, options.mode)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Lower кладёт корень дерева последним
+	return results[tasks[len(tasks)-1].ID], nil
+}
+
+// parseNumber читает число для режима float. Число, которое не помещается
+// в float64, - ErrOverflow, а не недопустимый символ.
+func parseNumber(value string) (float64, error) {
+	result, err := strconv.ParseFloat(value, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		return 0, fmt.Errorf("%w: %s", ErrOverflow, value)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrAllowed, value)
+	}
+	return result, nil
+}
+
+// resolve подставляет вместо ссылок результаты уже посчитанных задач
+func resolve(args []models.Operand, results func(taskID string) string) []string {
+	values := make([]string, len(args))
+	for i, arg := range args {
+		if arg.IsRef() {
+			values[i] = results(arg.TaskID)
+		} else {
+			values[i] = arg.Value
+		}
+	}
+	return values
+}
+
+// runSequential выполняет задачи в порядке Lower: зависимости всегда идут раньше
+func runSequential(tasks []*models.Task, mode Mode) (map[string]string, error) {
+	results := make(map[string]string, len(tasks))
+	lookup := func(taskID string) string { return results[taskID] }
+
+	for _, task := range tasks {
+		result, err := ApplyMode(mode, task.Operation, resolve(task.Args, lookup))
+		if err != nil {
+			return nil, err
+		}
+		results[task.ID] = result
+	}
+	return results, nil
+}
+
+// runParallel запускает по горутине на задачу. Задача ждёт, пока закроются
+// каналы её зависимостей, а число одновременных вычислений ограничено workers.
+func runParallel(tasks []*models.Task, mode Mode, workers int) (map[string]string, error) {
+	var (
+		mu       sync.Mutex
+		results  = make(map[string]string, len(tasks))
+		firstErr error
+		wg       sync.WaitGroup
+	)
+
+	done := make(map[string]chan struct{}, len(tasks))
+	for _, task := range tasks {
+		done[task.ID] = make(chan struct{})
+	}
+	lookup := func(taskID string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		return results[taskID]
+	}
+	failed := make(chan struct{})
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			close(failed)
+		}
+	}
+	slots := make(chan struct{}, workers)
+
+	for _, task := range tasks {
+		wg.Add(1)
+		go func(task *models.Task) {
+			defer wg.Done()
+			defer close(done[task.ID])
+
+			for _, dep := range task.Dependencies {
+				select {
+				case <-done[dep]:
+				case <-failed:
+					return
+				}
+			}
+			select {
+			case <-failed:
+				return
+			default:
+			}
+
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			result, err := ApplyMode(mode, task.Operation, resolve(task.Args, lookup))
+			if err != nil {
+				fail(err)
+				return
+			}
+			mu.Lock()
+			results[task.ID] = result
+			mu.Unlock()
+		}(task)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return results, nil
+}
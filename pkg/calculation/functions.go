@@ -0,0 +1,72 @@
+package calculation
+
+import (
+	"fmt"
+	"math"
+	"slices"
+)
+
+// function - встроенная функция: допустимое число аргументов и само вычисление.
+// max < 0 означает "сколько угодно". call получает уже проверенное число аргументов.
+type function struct {
+	min, max int
+	call     func(args []float64) (float64, error)
+}
+
+// functions - встроенные функции, которые можно вызывать в выражениях
+var functions = map[string]function{
+	"sqrt": {1, 1, func(args []float64) (float64, error) {
+		if args[0] < 0 {
+			return 0, ErrFunctionDomain
+		}
+		return math.Sqrt(args[0]), nil
+	}},
+	"abs": {1, 1, unary(math.Abs)},
+	"sin": {1, 1, unary(math.Sin)},
+	"cos": {1, 1, unary(math.Cos)},
+	"tan": {1, 1, unary(math.Tan)},
+	// log(x) - натуральный, log(x, base) - по основанию
+	"log": {1, 2, func(args []float64) (float64, error) {
+		if args[0] <= 0 {
+			return 0, ErrFunctionDomain
+		}
+		if len(args) == 1 {
+			return math.Log(args[0]), nil
+		}
+		base := args[1]
+		if base <= 0 || base == 1 {
+			return 0, ErrFunctionDomain
+		}
+		return math.Log(args[0]) / math.Log(base), nil
+	}},
+	"min": {1, -1, func(args []float64) (float64, error) {
+		return slices.Min(args), nil
+	}},
+	"max": {1, -1, func(args []float64) (float64, error) {
+		return slices.Max(args), nil
+	}},
+}
+
+func unary(f func(float64) float64) func(args []float64) (float64, error) {
+	return func(args []float64) (float64, error) {
+		return f(args[0]), nil
+	}
+}
+
+// IsFunction сообщает, является ли операция вызовом встроенной функции
+func IsFunction(name string) bool {
+	_, ok := functions[name]
+	return ok
+}
+
+// CheckArity проверяет, что функцию name можно вызвать с n аргументами
+func CheckArity(name string, n int) error {
+	fn, ok := functions[name]
+	if !ok {
+		return ErrUnknownFunction
+	}
+	if n < fn.min || (fn.max >= 0 && n > fn.max) {
+		return fmt.Errorf("%w: %s got %d", ErrArity, name, n)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package calculation
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// maxLiteralExponent - наибольший по модулю показатель в записи вида 1e-9.
+// Большие показатели точные режимы не смогли бы даже разобрать.
+const maxLiteralExponent = 4096
+
+// scanNumber читает числовой литерал, который начинается в expression[start],
+// и возвращает его каноническую запись и позицию сразу за литералом.
+//
+// Допустимые литералы: 42, 2.5, .5, 1_000_000, 1e-9, 6.02E23, 0xFF, 0b1010.
+// Знак _ разделяет цифры и стоит только между ними. Каноническая запись
+// не содержит _, лишних нулей и знака + в показателе, а 0xFF и 0b1010
+// становятся десятичными 255 и 10. Её одинаково понимают
+// strconv.ParseFloat и big.Rat.SetString.
+//
+// При ошибке end указывает на конец неправильного литерала, например "1.2.3",
+// чтобы ошибку можно было показать целиком.
+func scanNumber(expression string, start int) (value string, end int, err error) {
+	malformed := func(i int) (string, int, error) {
+		for i < len(expression) && isNumberChar(expression[i]) {
+			i++
+		}
+		return "", i, ErrNumber
+	}
+
+	i := start
+	if expression[i] == '0' && i+1 < len(expression) {
+		base, digit := 0, isDigit
+		switch expression[i+1] {
+		case 'x', 'X':
+			base, digit = 16, isHexDigit
+		case 'b', 'B':
+			base, digit = 2, isBinaryDigit
+		}
+		if base != 0 {
+			digits, j, ok := scanDigits(expression, i+2, digit)
+			if !ok || digits == "" || j < len(expression) && isNumberTail(expression[j]) {
+				return malformed(j)
+			}
+			n, _ := new(big.Int).SetString(digits, base)
+			return n.String(), j, nil
+		}
+	}
+
+	intPart, i, ok := scanDigits(expression, i, isDigit)
+	if !ok {
+		return malformed(i)
+	}
+	var fracPart string
+	if i < len(expression) && expression[i] == '.' {
+		if fracPart, i, ok = scanDigits(expression, i+1, isDigit); !ok {
+			return malformed(i)
+		}
+	}
+	if intPart == "" && fracPart == "" {
+		return malformed(i)
+	}
+
+	exponent := 0
+	if i < len(expression) && (expression[i] == 'e' || expression[i] == 'E') {
+		j := i + 1
+		negative := false
+		if j < len(expression) && (expression[j] == '+' || expression[j] == '-') {
+			negative = expression[j] == '-'
+			j++
+		}
+		var digits string
+		if digits, j, ok = scanDigits(expression, j, isDigit); !ok || digits == "" {
+			return malformed(j)
+		}
+		exponent, err = strconv.Atoi(digits)
+		if err != nil || exponent > maxLiteralExponent {
+			return "", j, fmt.Errorf("%w: exponent is larger than %d", ErrNumber, maxLiteralExponent)
+		}
+		if negative {
+			exponent = -exponent
+		}
+		i = j
+	}
+	if i < len(expression) && isNumberTail(expression[i]) {
+		return malformed(i)
+	}
+
+	return canonicalDecimal(intPart, fracPart, exponent), i, nil
+}
+
+// scanDigits читает цифры, разрешённые digit, начиная с позиции i, и пропускает
+// разделители _. ok = false, если _ стоит не между двумя цифрами.
+func scanDigits(expression string, i int, digit func(byte) bool) (digits string, end int, ok bool) {
+	var b strings.Builder
+	for i < len(expression) {
+		c := expression[i]
+		if c == '_' {
+			if b.Len() == 0 || i+1 >= len(expression) || !digit(expression[i+1]) {
+				return "", i, false
+			}
+			i++
+			continue
+		}
+		if !digit(c) {
+			break
+		}
+		b.WriteByte(c)
+		i++
+	}
+	return b.String(), i, true
+}
+
+// canonicalDecimal собирает запись числа intPart.fracPart * 10^exponent без лишних нулей
+func canonicalDecimal(intPart, fracPart string, exponent int) string {
+	intPart = strings.TrimLeft(intPart, "0")
+	fracPart = strings.TrimRight(fracPart, "0")
+	if intPart == "" && fracPart == "" {
+		return "0"
+	}
+	if intPart == "" {
+		intPart = "0"
+	}
+	value := intPart
+	if fracPart != "" {
+		value += "." + fracPart
+	}
+	if exponent != 0 {
+		value += "e" + strconv.Itoa(exponent)
+	}
+	return value
+}
+
+// isNumberTail - символы, которые не могут стоять сразу после литерала:
+// "1.2.3", "0b102" и "1__0" - ошибки, а не два числа подряд
+func isNumberTail(c byte) bool {
+	return isDigit(c) || c == '.' || c == '_'
+}
+
+// isNumberChar - символы, которые считаются частью неправильного литерала
+func isNumberChar(c byte) bool {
+	return isNumberTail(c) || isIdentStart(c)
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func isBinaryDigit(c byte) bool {
+	return c == '0' || c == '1'
+}
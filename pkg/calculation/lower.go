@@ -0,0 +1,75 @@
+package calculation
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/zalhui/calc_golang/internal/common/models"
+)
+
+// Lower превращает дерево выражения в задачи для агентов.
+// Каждая операция становится задачей, операнды - числами или ссылками
+// на задачи-потомки. Задачи идут в порядке обхода, зависимости раньше зависимых.
+// Выражение из одного числа задач не порождает.
+// OperationTime не заполняется: это настройка оркестратора, а не свойство дерева.
+func Lower(root Node, expressionID string) ([]*models.Task, error) {
+	var tasks []*models.Task
+
+	var lower func(node Node) (models.Operand, error)
+	lower = func(node Node) (models.Operand, error) {
+		var operation string
+		var children []Node
+
+		switch n := node.(type) {
+		case *Number:
+			return models.Operand{Value: n.Value}, nil
+		case *Ref:
+			return models.Operand{TaskID: n.TaskID}, nil
+		case *Ident:
+			// переменные должен был заменить Bind
+			return models.Operand{}, &UnboundError{Variables: []*Ident{n}}
+		case *UnaryOp:
+			if n.Op != "-" {
+				return models.Operand{}, fmt.Errorf("%w: unary %s", ErrAllowed, n.Op)
+			}
+			operation, children = OpNegate, []Node{n.X}
+		case *BinaryOp:
+			if !isOperator(n.Op) {
+				return models.Operand{}, fmt.Errorf("%w: %s", ErrAllowed, n.Op)
+			}
+			operation, children = n.Op, []Node{n.X, n.Y}
+		case *Call:
+			if err := CheckArity(n.Name, len(n.Args)); err != nil {
+				return models.Operand{}, err
+			}
+			operation, children = n.Name, n.Args
+		default:
+			return models.Operand{}, fmt.Errorf("%w: unexpected node %T", ErrValues, node)
+		}
+
+		task := &models.Task{
+			ID:           uuid.NewString(),
+			ExpressionID: expressionID,
+			Operation:    operation,
+			Status:       "pending",
+		}
+		for _, child := range children {
+			arg, err := lower(child)
+			if err != nil {
+				return models.Operand{}, err
+			}
+			if arg.IsRef() {
+				task.Dependencies = append(task.Dependencies, arg.TaskID)
+			}
+			task.Args = append(task.Args, arg)
+		}
+		tasks = append(tasks, task)
+
+		return models.Operand{TaskID: task.ID}, nil
+	}
+
+	if _, err := lower(root); err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
@@ -0,0 +1,322 @@
+package calculation
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Mode - числовой режим, в котором считается выражение
+type Mode string
+
+const (
+	// ModeFloat - float64, как раньше. Быстро, но 0.1+0.2 = 0.30000000000000004.
+	ModeFloat Mode = "float"
+	// ModeDecimal - десятичная арифметика на math/big: +, -, * и целые степени
+	// точны, деление и sqrt округляются до DecimalPlaces знаков после запятой.
+	// Остальные функции и дробные степени считаются в float64, и в результате
+	// остаются только его значащие цифры, не больше 17.
+	ModeDecimal Mode = "decimal"
+	// ModeRational - точные дроби big.Rat: 1/3+1/6 = 1/2. Результаты записываются
+	// как "числитель/знаменатель", иррациональные результаты - ошибка ErrInexact.
+	ModeRational Mode = "rational"
+)
+
+// DecimalPlaces - сколько знаков после запятой хранит режим decimal.
+// Округление банковское: половина округляется к чётной цифре.
+const DecimalPlaces = 28
+
+// maxExactExponent - наибольший по модулю целый показатель степени,
+// который точные режимы возводят без float64
+const maxExactExponent = 10000
+
+// maxExactBits - наибольший размер степени в битах (около 315 000 десятичных
+// знаков), который точные режимы считают без float64: (10^10000)^10000
+// заняла бы сотни мегабайт
+const maxExactBits = 1 << 20
+
+// ParseMode разбирает режим из запроса, пустая строка означает ModeFloat
+func ParseMode(s string) (Mode, error) {
+	switch Mode(s) {
+	case "", ModeFloat:
+		return ModeFloat, nil
+	case ModeDecimal:
+		return ModeDecimal, nil
+	case ModeRational:
+		return ModeRational, nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrMode, s)
+}
+
+// ApplyMode выполняет операцию над аргументами, записанными строками, в режиме mode.
+// Результат тоже строка: в режиме float - кратчайшая запись float64,
+// в режиме decimal - точная десятичная запись без лишних нулей,
+// в режиме rational - несократимая дробь "1/3" или целое число.
+func ApplyMode(mode Mode, operation string, args []string) (string, error) {
+	if mode == ModeDecimal || mode == ModeRational {
+		values := make([]*big.Rat, len(args))
+		for i, arg := range args {
+			value, ok := new(big.Rat).SetString(arg)
+			if !ok {
+				return "", fmt.Errorf("%w: %s", ErrAllowed, arg)
+			}
+			values[i] = value
+		}
+		if mode == ModeRational {
+			result, err := applyExact(operation, values, refuseInexact)
+			if err != nil {
+				return "", err
+			}
+			return result.RatString(), nil
+		}
+		result, err := applyExact(operation, values, approximate)
+		if err != nil {
+			return "", err
+		}
+		return formatDecimal(roundDecimal(result)), nil
+	}
+
+	values := make([]float64, len(args))
+	for i, arg := range args {
+		value, err := parseNumber(arg)
+		if err != nil {
+			return "", err
+		}
+		values[i] = value
+	}
+	result, err := Apply(operation, values)
+	if err != nil {
+		return "", err
+	}
+	return FormatFloat(result), nil
+}
+
+// FormatMode записывает число value так же, как результаты режима mode:
+// в режиме decimal оно округляется до DecimalPlaces знаков, в rational становится дробью
+func FormatMode(mode Mode, value string) (string, error) {
+	return ApplyMode(mode, "+", []string{value, "0"})
+}
+
+// FormatFloat записывает float64 кратчайшей строкой, которая читается обратно без потерь
+func FormatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// ToFloat переводит результат любого режима в float64.
+// Для слишком больших по модулю чисел возвращает ErrOverflow.
+func ToFloat(exact string) (float64, error) {
+	value, ok := new(big.Rat).SetString(exact)
+	if !ok {
+		return 0, fmt.Errorf("%w: %s", ErrAllowed, exact)
+	}
+	result, _ := value.Float64()
+	if math.IsInf(result, 0) {
+		return 0, ErrOverflow
+	}
+	return result, nil
+}
+
+// Approximate записывает точный результат exact (дробь или десятичное число)
+// десятичной дробью ровно с digits знаками после запятой
+func Approximate(exact string, digits int) (string, error) {
+	value, ok := new(big.Rat).SetString(exact)
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrAllowed, exact)
+	}
+	return value.FloatString(digits), nil
+}
+
+// applyExact считает операцию над дробями без округления. Если точного ответа
+// нет, как у sin(1) или 2^0.5, результат решает inexact.
+func applyExact(operation string, args []*big.Rat, inexact func(operation string, args []*big.Rat) (*big.Rat, error)) (*big.Rat, error) {
+	switch operation {
+	case "abs":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("%w: abs got %d", ErrArity, len(args))
+		}
+		return new(big.Rat).Abs(args[0]), nil
+	case "min", "max":
+		if err := CheckArity(operation, len(args)); err != nil {
+			return nil, err
+		}
+		result := args[0]
+		for _, arg := range args[1:] {
+			cmp := arg.Cmp(result)
+			if operation == "min" && cmp < 0 || operation == "max" && cmp > 0 {
+				result = arg
+			}
+		}
+		return result, nil
+	case "sqrt":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("%w: sqrt got %d", ErrArity, len(args))
+		}
+		if args[0].Sign() < 0 {
+			return nil, ErrFunctionDomain
+		}
+		num, numOk := exactSqrt(args[0].Num())
+		den, denOk := exactSqrt(args[0].Denom())
+		if numOk && denOk {
+			return new(big.Rat).SetFrac(num, den), nil
+		}
+		return inexact(operation, args)
+	case OpNegate:
+		if len(args) != 1 {
+			return nil, ErrValues
+		}
+		return new(big.Rat).Neg(args[0]), nil
+	}
+
+	if IsFunction(operation) {
+		// остальные функции трансцендентные, точного ответа у них нет
+		return inexact(operation, args)
+	}
+
+	if len(args) != 2 {
+		return nil, ErrValues
+	}
+	x, y := args[0], args[1]
+
+	switch operation {
+	case "+":
+		return new(big.Rat).Add(x, y), nil
+	case "-":
+		return new(big.Rat).Sub(x, y), nil
+	case "*":
+		return new(big.Rat).Mul(x, y), nil
+	case "/":
+		if y.Sign() == 0 {
+			return nil, ErrDivisionByZero
+		}
+		return new(big.Rat).Quo(x, y), nil
+	case "//":
+		if y.Sign() == 0 {
+			return nil, ErrDivisionByZero
+		}
+		return new(big.Rat).SetInt(floorQuo(x, y)), nil
+	case "%":
+		if y.Sign() == 0 {
+			return nil, ErrModuloByZero
+		}
+		// x - y*floor(x/y), знак остатка совпадает со знаком делителя
+		q := new(big.Rat).SetInt(floorQuo(x, y))
+		return new(big.Rat).Sub(x, q.Mul(q, y)), nil
+	case "^":
+		if x.Sign() == 0 && y.Sign() < 0 {
+			return nil, ErrPowerDomain
+		}
+		if !y.IsInt() || y.Num().CmpAbs(big.NewInt(maxExactExponent)) > 0 {
+			return inexact(operation, args)
+		}
+		n := y.Num().Int64()
+		if int64(x.Num().BitLen()+x.Denom().BitLen())*absInt64(n) > maxExactBits {
+			return inexact(operation, args)
+		}
+		num := new(big.Int).Exp(x.Num(), big.NewInt(absInt64(n)), nil)
+		den := new(big.Int).Exp(x.Denom(), big.NewInt(absInt64(n)), nil)
+		if n < 0 {
+			num, den = den, num
+		}
+		return new(big.Rat).SetFrac(num, den), nil
+	}
+	return nil, ErrAllowed
+}
+
+// approximate - запасной путь режима decimal для операций без точного ответа.
+// Корень считается с точностью больше DecimalPlaces, остальное - через float64,
+// от которого берётся кратчайшая десятичная запись: цифры дальше неё -
+// двоичный шум, а не точность.
+func approximate(operation string, args []*big.Rat) (*big.Rat, error) {
+	if operation == "sqrt" {
+		const prec = 256 // с запасом больше DecimalPlaces десятичных знаков
+		root := new(big.Float).SetPrec(prec).SetRat(args[0])
+		root.Sqrt(root)
+		result, _ := root.Rat(nil)
+		return result, nil
+	}
+	result, err := applyViaFloat(operation, args)
+	if err != nil {
+		return nil, err
+	}
+	value, _ := result.Float64()
+	result, _ = new(big.Rat).SetString(FormatFloat(value))
+	return result, nil
+}
+
+// refuseInexact - запасной путь режима rational: приблизительный ответ не дробь,
+// поэтому это ошибка. Ошибки области определения сообщаются как обычно.
+func refuseInexact(operation string, args []*big.Rat) (*big.Rat, error) {
+	if _, err := applyViaFloat(operation, args); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("%w: %s", ErrInexact, operation)
+}
+
+// applyViaFloat считает операцию в float64
+func applyViaFloat(operation string, args []*big.Rat) (*big.Rat, error) {
+	values := make([]float64, len(args))
+	for i, arg := range args {
+		values[i], _ = arg.Float64()
+	}
+	result, err := Apply(operation, values)
+	if err != nil {
+		return nil, err
+	}
+	if math.IsInf(result, 0) || math.IsNaN(result) {
+		return nil, ErrOverflow
+	}
+	return new(big.Rat).SetFloat64(result), nil
+}
+
+// exactSqrt возвращает корень из x, если x - точный квадрат
+func exactSqrt(x *big.Int) (*big.Int, bool) {
+	root := new(big.Int).Sqrt(x)
+	return root, new(big.Int).Mul(root, root).Cmp(x) == 0
+}
+
+// floorQuo возвращает floor(x / y) для y != 0
+func floorQuo(x, y *big.Rat) *big.Int {
+	q := new(big.Rat).Quo(x, y)
+	// Div у big.Int - евклидово деление, для положительного знаменателя это floor
+	return new(big.Int).Div(q.Num(), q.Denom())
+}
+
+// roundDecimal округляет x до DecimalPlaces знаков после запятой к ближайшему,
+// а ровно половину - к чётной последней цифре
+func roundDecimal(x *big.Rat) *big.Rat {
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(DecimalPlaces), nil)
+	scaled := new(big.Int).Mul(x.Num(), scale)
+
+	q, r := new(big.Int).QuoRem(scaled, x.Denom(), new(big.Int))
+	// сравниваем 2*|r| с знаменателем: больше половины, меньше или ровно половина
+	half := new(big.Int).Abs(r)
+	half.Lsh(half, 1)
+	switch cmp := half.Cmp(x.Denom()); {
+	case cmp > 0, cmp == 0 && q.Bit(0) == 1:
+		if x.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return new(big.Rat).SetFrac(q, scale)
+}
+
+// formatDecimal записывает x без экспоненты и без хвостовых нулей: 0.3, 12, -1.25
+func formatDecimal(x *big.Rat) string {
+	s := strings.TrimRight(x.FloatString(DecimalPlaces), "0")
+	s = strings.TrimSuffix(s, ".")
+	if s == "-0" {
+		return "0"
+	}
+	return s
+}
+
+func absInt64(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
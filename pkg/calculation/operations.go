@@ -0,0 +1,114 @@
+package calculation
+
+import (
+	"math"
+	"slices"
+	"time"
+
+	"github.com/zalhui/calc_golang/config"
+)
+
+// Apply выполняет одну операцию задачи над уже вычисленными аргументами.
+// Агент и Evaluate считают через неё, поэтому результаты у них всегда совпадают.
+func Apply(operation string, args []float64) (float64, error) {
+	if fn, ok := functions[operation]; ok {
+		if err := CheckArity(operation, len(args)); err != nil {
+			return 0, err
+		}
+		return fn.call(args)
+	}
+
+	if operation == OpNegate {
+		if len(args) != 1 {
+			return 0, ErrValues
+		}
+		return -args[0], nil
+	}
+
+	if len(args) != 2 {
+		return 0, ErrValues
+	}
+	arg1, arg2 := args[0], args[1]
+
+	switch operation {
+	case "+":
+		return arg1 + arg2, nil
+	case "-":
+		return arg1 - arg2, nil
+	case "*":
+		return arg1 * arg2, nil
+	case "/":
+		if arg2 == 0 {
+			return 0, ErrDivisionByZero
+		}
+		return arg1 / arg2, nil
+	case "^":
+		if arg1 == 0 && arg2 < 0 {
+			return 0, ErrPowerDomain
+		}
+		result := math.Pow(arg1, arg2)
+		if math.IsNaN(result) {
+			return 0, ErrPowerDomain
+		}
+		if math.IsInf(result, 0) {
+			return 0, ErrOverflow
+		}
+		return result, nil
+	case "%":
+		// Остаток берёт знак делителя, чтобы a == b*(a//b) + a%b
+		if arg2 == 0 {
+			return 0, ErrModuloByZero
+		}
+		return arg1 - arg2*math.Floor(arg1/arg2), nil
+	case "//":
+		if arg2 == 0 {
+			return 0, ErrDivisionByZero
+		}
+		return math.Floor(arg1 / arg2), nil
+	}
+	return 0, ErrAllowed
+}
+
+// Operations - все операции, которые умеет Apply: операторы, унарный минус и функции
+func Operations() []string {
+	names := make([]string, 0, len(functions))
+	for name := range functions {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return append([]string{"+", "-", "*", "/", "^", "%", "//", OpNegate}, names...)
+}
+
+func isOperator(op string) bool {
+	switch op {
+	case "+", "-", "*", "/", "^", "%", "//":
+		return true
+	}
+	return false
+}
+
+// OperationTime - сколько агент должен "считать" операцию по настройкам cfg
+func OperationTime(cfg *config.Config, operation string) time.Duration {
+	switch operation {
+	case "+":
+		return cfg.TimeAddition
+	case "-":
+		return cfg.TimeSubtraction
+	case "*":
+		return cfg.TimeMultiplication
+	case "/":
+		return cfg.TimeDivision
+	case "^":
+		return cfg.TimeExponentiation
+	case "%":
+		return cfg.TimeModulo
+	case "//":
+		return cfg.TimeIntegerDivision
+	case OpNegate:
+		return cfg.TimeSubtraction
+	}
+	if IsFunction(operation) {
+		return cfg.TimeFunction
+	}
+	return 0
+}
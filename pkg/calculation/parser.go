@@ -0,0 +1,256 @@
+package calculation
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+var priority = map[string]int{
+	"+":      1,
+	"-":      1,
+	"*":      2,
+	"/":      2,
+	"%":      2,
+	"//":     2,
+	OpNegate: 3,
+	"^":      4,
+	"(":      0,
+}
+
+// rightAssociative - операторы, которые группируются справа налево: 2^3^2 = 2^(3^2)
+var rightAssociative = map[string]bool{
+	"^": true,
+}
+
+// stackEntry - оператор, скобка или имя функции на стеке алгоритма сортировочной станции
+type stackEntry struct {
+	op  string
+	pos Pos
+}
+
+// Parse разбирает выражение в дерево.
+// Порядок операций определяется приоритетами из priority и rightAssociative.
+// Ошибки возвращаются как *ParseError с позицией проблемного места.
+func Parse(expression string) (Node, error) {
+	var output []Node
+	var operators []stackEntry
+
+	fail := func(err error, offset, length int) (Node, error) {
+		return nil, newParseError(expression, err, offset, length)
+	}
+
+	popOperator := func() {
+		top := operators[len(operators)-1]
+		operators = operators[:len(operators)-1]
+		if top.op == OpNegate {
+			x := output[len(output)-1]
+			output[len(output)-1] = &UnaryOp{Op: "-", OpPos: top.pos, X: x}
+			return
+		}
+		x, y := output[len(output)-2], output[len(output)-1]
+		output = output[:len(output)-2]
+		output = append(output, &BinaryOp{Op: top.op, OpPos: top.pos, X: x, Y: y})
+	}
+
+	// op - operator
+	pushOperator := func(op string, pos Pos) {
+		for len(operators) > 0 {
+			top := priority[operators[len(operators)-1].op]
+			if top < priority[op] || (top == priority[op] && rightAssociative[op]) {
+				break
+			}
+			popOperator()
+		}
+		operators = append(operators, stackEntry{op, pos})
+	}
+
+	// argCounts - число аргументов для каждой открытой скобки, важно только для вызовов функций
+	var argCounts []int
+
+	// expectOperand - ждём число, функцию или открывающую скобку, а не бинарный оператор.
+	// В этом положении + и - являются унарными.
+	expectOperand := true
+
+	i := 0
+	for i < len(expression) {
+		char := rune(expression[i])
+
+		if isDigit(expression[i]) || char == '.' {
+			j := i
+			value, end, err := scanNumber(expression, i)
+			i = end
+			if !expectOperand {
+				return fail(ErrAllowed, j, i-j)
+			}
+			if err != nil {
+				return fail(err, j, i-j)
+			}
+			output = append(output, &Number{Value: value, Raw: expression[j:i], ValuePos: Pos(j)})
+			expectOperand = false
+			continue
+		}
+
+		if isIdentStart(expression[i]) {
+			j := i
+			for i < len(expression) && (isIdentStart(expression[i]) || isDigit(expression[i])) {
+				i++
+			}
+			name := expression[j:i]
+			if !expectOperand {
+				return fail(ErrAllowed, j, i-j)
+			}
+			k := i
+			for k < len(expression) && unicode.IsSpace(rune(expression[k])) {
+				k++
+			}
+			if k < len(expression) && expression[k] == '(' {
+				if !IsFunction(name) {
+					return fail(ErrUnknownFunction, j, len(name))
+				}
+				// имя функции лежит на стеке прямо под своей скобкой
+				operators = append(operators, stackEntry{name, Pos(j)})
+				i = k
+				continue
+			}
+			if IsFunction(name) {
+				return fail(ErrAllowed, j, len(name)) // имена функций не могут быть переменными
+			}
+			output = append(output, &Ident{Name: name, NamePos: Pos(j)})
+			expectOperand = false
+			continue
+		}
+
+		switch char {
+		case '+', '-':
+			if expectOperand {
+				// унарный плюс ничего не меняет, унарный минус ждёт свой операнд на стеке
+				if char == '-' {
+					operators = append(operators, stackEntry{OpNegate, Pos(i)})
+				}
+				break
+			}
+			pushOperator(string(char), Pos(i))
+			expectOperand = true
+		case '/', '*', '%', '^':
+			op, pos := string(char), Pos(i)
+			if char == '/' && i+1 < len(expression) && expression[i+1] == '/' {
+				op = "//"
+				i++
+			}
+			if expectOperand {
+				return fail(ErrValues, int(pos), len(op))
+			}
+			pushOperator(op, pos)
+			expectOperand = true
+		case '(':
+			if !expectOperand {
+				return fail(ErrAllowed, i, 1)
+			}
+			operators = append(operators, stackEntry{"(", Pos(i)})
+			argCounts = append(argCounts, 1)
+		case ',':
+			if expectOperand && len(operators) > 0 && operators[len(operators)-1].op != "(" {
+				return fail(ErrValues, i, 1)
+			}
+			for len(operators) > 0 && operators[len(operators)-1].op != "(" {
+				popOperator()
+			}
+			if len(operators) < 2 || !IsFunction(operators[len(operators)-2].op) {
+				return fail(ErrAllowed, i, 1) // запятая вне вызова функции
+			}
+			if expectOperand {
+				return fail(ErrValues, i, 1)
+			}
+			argCounts[len(argCounts)-1]++
+			expectOperand = true
+		case ')':
+			if expectOperand && len(operators) > 0 && operators[len(operators)-1].op != "(" {
+				if !hasOpenBracket(operators) {
+					return fail(ErrBrackets, i, 1)
+				}
+				return fail(ErrValues, i, 1)
+			}
+			for len(operators) > 0 && operators[len(operators)-1].op != "(" {
+				popOperator()
+			}
+			if len(operators) == 0 {
+				return fail(ErrBrackets, i, 1)
+			}
+			argc := argCounts[len(argCounts)-1]
+			argCounts = argCounts[:len(argCounts)-1]
+			operators = operators[:len(operators)-1] // удаляем '('
+
+			isCall := len(operators) > 0 && IsFunction(operators[len(operators)-1].op)
+			if expectOperand {
+				// пустой список аргументов допустим только у вызова: f()
+				if !isCall || expression[prevNonSpace(expression, i)] != '(' {
+					return fail(ErrValues, i, 1)
+				}
+				argc = 0
+			}
+			if isCall {
+				fn := operators[len(operators)-1]
+				operators = operators[:len(operators)-1]
+				if err := CheckArity(fn.op, argc); err != nil {
+					return fail(err, int(fn.pos), i+1-int(fn.pos))
+				}
+				args := append([]Node(nil), output[len(output)-argc:]...)
+				output = output[:len(output)-argc]
+				output = append(output, &Call{Name: fn.op, NamePos: fn.pos, Args: args, Rparen: Pos(i)})
+			}
+			expectOperand = false
+		default:
+			if !unicode.IsSpace(char) {
+				_, width := utf8.DecodeRuneInString(expression[i:])
+				return fail(ErrAllowed, i, width)
+			}
+		}
+		i++
+	}
+
+	if open, ok := lastOpenBracket(operators); ok {
+		return fail(ErrBrackets, int(open.pos), 1)
+	}
+	if expectOperand {
+		return fail(ErrValues, len(expression), 0)
+	}
+	for len(operators) > 0 {
+		popOperator()
+	}
+	if len(output) != 1 {
+		return fail(ErrValues, len(expression), 0)
+	}
+
+	return output[0], nil
+}
+
+func hasOpenBracket(operators []stackEntry) bool {
+	_, ok := lastOpenBracket(operators)
+	return ok
+}
+
+// lastOpenBracket возвращает самую внутреннюю незакрытую скобку
+func lastOpenBracket(operators []stackEntry) (stackEntry, bool) {
+	for i := len(operators) - 1; i >= 0; i-- {
+		if operators[i].op == "(" {
+			return operators[i], true
+		}
+	}
+	return stackEntry{}, false
+}
+
+// Имена функций и переменных состоят только из латинских букв, цифр и _
+func isIdentStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// prevNonSpace возвращает позицию последнего непробельного символа перед i
+func prevNonSpace(expression string, i int) int {
+	for i--; i > 0 && unicode.IsSpace(rune(expression[i])); i-- {
+	}
+	return i
+}
@@ -0,0 +1,109 @@
+package calculation
+
+import (
+	"fmt"
+	"strings"
+)
+
+// UnboundError - в выражении есть переменные, для которых не передали значения
+type UnboundError struct {
+	Variables []*Ident // в порядке появления в выражении, каждое вхождение отдельно
+}
+
+func (e *UnboundError) Error() string {
+	parts := make([]string, len(e.Variables))
+	for i, v := range e.Variables {
+		parts[i] = fmt.Sprintf("%q at position %d", v.Name, v.NamePos)
+	}
+	return fmt.Sprintf("%v: %s", ErrUnbound, strings.Join(parts, ", "))
+}
+
+func (e *UnboundError) Unwrap() error {
+	return ErrUnbound
+}
+
+// Bind возвращает копию дерева, где вместо переменных стоят их значения.
+// Значения проверяются и приводятся к канонической записи, как литералы.
+// Если каким-то переменным значения не нашлось, возвращает *UnboundError.
+func Bind(root Node, variables map[string]string) (Node, error) {
+	values := make(map[string]string, len(variables))
+	for name, value := range variables {
+		if !isIdentifier(name) || IsFunction(name) {
+			return nil, fmt.Errorf("%w: variable name %q", ErrAllowed, name)
+		}
+		normalized, err := NormalizeNumber(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: variable %s = %q", ErrNumber, name, value)
+		}
+		values[name] = normalized
+	}
+
+	var unbound []*Ident
+	Inspect(root, func(node Node) bool {
+		if ident, ok := node.(*Ident); ok {
+			if _, found := values[ident.Name]; !found {
+				unbound = append(unbound, ident)
+			}
+		}
+		return true
+	})
+	if len(unbound) > 0 {
+		return nil, &UnboundError{Variables: unbound}
+	}
+
+	var bind func(node Node) Node
+	bind = func(node Node) Node {
+		switch n := node.(type) {
+		case *Ident:
+			// Raw - имя переменной, чтобы позиции узла остались прежними
+			return &Number{Value: values[n.Name], Raw: n.Name, ValuePos: n.NamePos}
+		case *UnaryOp:
+			return &UnaryOp{Op: n.Op, OpPos: n.OpPos, X: bind(n.X)}
+		case *BinaryOp:
+			return &BinaryOp{Op: n.Op, OpPos: n.OpPos, X: bind(n.X), Y: bind(n.Y)}
+		case *Call:
+			args := make([]Node, len(n.Args))
+			for i, arg := range n.Args {
+				args[i] = bind(arg)
+			}
+			return &Call{Name: n.Name, NamePos: n.NamePos, Args: args, Rparen: n.Rparen}
+		}
+		return node
+	}
+	return bind(root), nil
+}
+
+// NormalizeNumber проверяет число, записанное строкой, и возвращает его
+// каноническую запись. В отличие от литерала в выражении, допускает знак.
+func NormalizeNumber(value string) (string, error) {
+	sign, digits := "", strings.TrimPrefix(value, "+")
+	if strings.HasPrefix(value, "-") {
+		sign, digits = "-", value[1:]
+	}
+	if digits == "" {
+		return "", ErrNumber
+	}
+	normalized, end, err := scanNumber(digits, 0)
+	if err != nil {
+		return "", err
+	}
+	if end != len(digits) {
+		return "", ErrNumber
+	}
+	if normalized == "0" {
+		return normalized, nil
+	}
+	return sign + normalized, nil
+}
+
+func isIdentifier(name string) bool {
+	if name == "" || !isIdentStart(name[0]) {
+		return false
+	}
+	for i := 1; i < len(name); i++ {
+		if !isIdentStart(name[i]) && !isDigit(name[i]) {
+			return false
+		}
+	}
+	return true
+}